@@ -1,5 +1,8 @@
 package main
 
+// The host must define every function imported here, see "Host functions" in
+// the README.
+
 type extismPointer uint64
 
 //go:wasmimport extism:host/user kubernetes_resource_lookup
@@ -7,3 +10,12 @@ func extismKubernetesResourceLookup(apiVersion extismPointer, kind extismPointer
 
 //go:wasmimport extism:host/user resolve_hostname
 func extismResolveHostname(hostname extismPointer) extismPointer
+
+//go:wasmimport extism:host/user resolve_secret
+func extismResolveSecret(ref extismPointer) extismPointer
+
+//go:wasmimport extism:host/user resolve_image_digest
+func extismResolveImageDigest(ref extismPointer) extismPointer
+
+//go:wasmimport extism:host/user fetch_chart_dependency
+func extismFetchChartDependency(name extismPointer, version extismPointer, repository extismPointer) extismPointer
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	pdk "github.com/extism/go-pdk"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+var logLevelNames = map[pdk.LogLevel]string{
+	pdk.LogTrace: "trace",
+	pdk.LogDebug: "debug",
+	pdk.LogInfo:  "info",
+	pdk.LogWarn:  "warn",
+	pdk.LogError: "error",
+}
+
+// logEntry is a structured log message of the plugin.
+type logEntry struct {
+	Level    string `json:"level"`
+	Message  string `json:"message"`
+	Chart    string `json:"chart,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// logger writes log messages to the host in the format chosen by
+// Input.LogFormat.
+type logger struct {
+	json bool
+}
+
+func newLogger(format string) (*logger, error) {
+	switch format {
+	case "", LogFormatText:
+		return &logger{}, nil
+	case LogFormatJSON:
+		return &logger{json: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, must be %q or %q", format, LogFormatText, LogFormatJSON)
+	}
+}
+
+// Log writes a log message, with the optional chart name, duration and error.
+func (l *logger) Log(level pdk.LogLevel, message string, chart string, duration time.Duration, err error) {
+	entry := logEntry{
+		Level:   logLevelNames[level],
+		Message: message,
+		Chart:   chart,
+	}
+	if duration > 0 {
+		entry.Duration = duration.String()
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	if l.json {
+		data, _ := json.Marshal(entry)
+		pdk.Log(level, string(data))
+		return
+	}
+	pdk.Log(level, entry.text())
+}
+
+// text formats the entry as free-form text, e.g. "failed: <error>".
+func (e logEntry) text() string {
+	var b strings.Builder
+	b.WriteString(e.Message)
+	if e.Error != "" {
+		fmt.Fprintf(&b, ": %s", e.Error)
+	}
+	if e.Chart != "" {
+		fmt.Fprintf(&b, " (chart %s)", e.Chart)
+	}
+	if e.Duration != "" {
+		fmt.Fprintf(&b, " in %s", e.Duration)
+	}
+	return b.String()
+}
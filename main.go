@@ -1,18 +1,90 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
+	"time"
 
 	pdk "github.com/extism/go-pdk"
 	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/engine"
-	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/release"
+	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/releaseutil"
+	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/releasevalues"
 	chart "helm.sh/helm/v4/pkg/chart/v2"
+	chartloader "helm.sh/helm/v4/pkg/chart/v2/loader"
 )
 
 type Input struct {
-	Chart      *chart.Chart `json:"chart"`
-	ValuesJSON []byte       `json:"values"`
+	Chart *chart.Chart `json:"chart"`
+	// ChartArchive is a packaged chart (.tgz), loaded by the plugin. Exactly one
+	// of Chart or ChartArchive must be provided.
+	ChartArchive []byte `json:"chartArchive,omitempty"`
+	ValuesJSON   []byte `json:"values"`
+	// ValuesPath is the path of a file holding the render values (YAML or
+	// JSON), which the host made available to the plugin (e.g. with the
+	// AllowedPaths of the Extism manifest), rather than passing them in
+	// ValuesJSON. Exactly one of ValuesJSON or ValuesPath must be provided.
+	ValuesPath string `json:"valuesPath,omitempty"`
+	// ComputedValues are render values computed by the host for this call,
+	// merged over ValuesJSON (e.g. {"Values": {"token": "..."}})
+	ComputedValues []byte `json:"computedValues,omitempty"`
+
+	// WarningsAsErrors fails the render if any warnings were produced
+	WarningsAsErrors bool `json:"warningsAsErrors,omitempty"`
+	// SingleStream returns all manifests as one YAML stream in Output.Stream,
+	// like `helm template`, instead of per-file Output.Manifests
+	SingleStream bool `json:"singleStream,omitempty"`
+	// WrapInList returns all resources wrapped in a single v1/List object in
+	// Output.Stream, in the same order as SingleStream, instead of per-file
+	// Output.Manifests. It cannot be combined with SingleStream.
+	WrapInList bool `json:"wrapInList,omitempty"`
+	// OutputJSON returns each manifest as JSON rather than YAML. It cannot be
+	// combined with SingleStream.
+	OutputJSON bool `json:"outputJSON,omitempty"`
+	// IncludePartials also returns partials (templates prefixed with '_'),
+	// with their source in Output.Partials
+	IncludePartials bool `json:"includePartials,omitempty"`
+	// PartialResults returns the manifests of the templates that rendered
+	// successfully, and the errors of those that failed in Output.Errors,
+	// instead of failing the render
+	PartialResults bool `json:"partialResults,omitempty"`
+	// OpenAPISchema is an OpenAPI v2 document (e.g. the cluster's /openapi/v2)
+	// to validate the rendered resources against
+	OpenAPISchema []byte `json:"openAPISchema,omitempty"`
+	// SubchartValues are values files (YAML or JSON) keyed by the full path
+	// of the chart they override (e.g. "app/charts/db"), taking precedence
+	// over the chart's values from ValuesJSON
+	SubchartValues map[string][]byte `json:"subchartValues,omitempty"`
+	// LogFormat is the format of the plugin's log messages, "text" (the
+	// default) or "json" for one JSON object per message
+	LogFormat string `json:"logFormat,omitempty"`
+	// GroupByChart additionally returns the manifests grouped by the full
+	// path of their chart in Output.ChartGroups
+	GroupByChart bool `json:"groupByChart,omitempty"`
+	// LookupAttempts is the number of times a lookup the host reports as
+	// retryable is attempted before failing the render, waiting
+	// LookupBackoffMillis before the first retry and twice as long before
+	// each further one
+	LookupAttempts      int `json:"lookupAttempts,omitempty"`
+	LookupBackoffMillis int `json:"lookupBackoffMillis,omitempty"`
+	// RequiredValuePaths are dotted value paths (e.g. "image.repository")
+	// that must be set to a non-empty value for the render to start
+	RequiredValuePaths []string `json:"requiredValuePaths,omitempty"`
+	// Kustomization returns a kustomization.yaml listing the rendered
+	// manifests in Output.Kustomization. It cannot be combined with
+	// SingleStream.
+	Kustomization bool `json:"kustomization,omitempty"`
+	// RemoteDependencies fetches chart dependencies missing from the chart
+	// archive from the host instead of leaving them out of the render
+	RemoteDependencies bool `json:"remoteDependencies,omitempty"`
+	// HooksByPhase additionally returns the hook resources grouped by
+	// lifecycle phase in Output.Hooks. It cannot be combined with
+	// SingleStream.
+	HooksByPhase bool `json:"hooksByPhase,omitempty"`
 }
 
 type OutputManifest struct {
@@ -20,8 +92,53 @@ type OutputManifest struct {
 	Manifest []byte `json:"manifest"`
 }
 
+type OutputError struct {
+	Filename string `json:"filename"`
+	Error    string `json:"error"`
+}
+
+// OutputMetadata identifies the chart and the manifests of a render.
+type OutputMetadata struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	AppVersion string `json:"appVersion,omitempty"`
+	// Digest is the sha256 of the rendered manifests, which is identical for
+	// identical renders.
+	Digest string `json:"digest"`
+}
+
 type Output struct {
 	Manifests []OutputManifest `json:"manifests"`
+	Stream    string           `json:"stream,omitempty"`
+	Warnings  []string         `json:"warnings,omitempty"`
+	// Partials maps the full path of each partial to its source
+	Partials map[string]string `json:"partials,omitempty"`
+	// Errors are the templates that failed to render, with PartialResults
+	Errors []OutputError `json:"errors,omitempty"`
+	// Metadata identifies the root chart and the rendered manifests
+	Metadata OutputMetadata `json:"metadata"`
+	// HostCalls counts the calls to each host function during the render
+	HostCalls map[string]int `json:"hostCalls,omitempty"`
+	// ChartGroups maps the full path of each chart (e.g. "app/charts/db") to
+	// its manifests, with GroupByChart
+	ChartGroups map[string][]OutputManifest `json:"chartGroups,omitempty"`
+	// Hooks maps each lifecycle phase (e.g. "pre-install") to its hook
+	// resources, ordered by weight, with HooksByPhase
+	Hooks map[string][]OutputManifest `json:"hooks,omitempty"`
+	// RenderedBytes is the total size of the output of all templates, and
+	// PeakTemplateBytes that of the largest one, e.g. to tune the memory
+	// limit of the plugin per chart
+	RenderedBytes     int `json:"renderedBytes"`
+	PeakTemplateBytes int `json:"peakTemplateBytes"`
+	// APIVersions are the distinct apiVersion/kind pairs of the rendered
+	// resources, e.g. to check them against the APIs of the target cluster
+	APIVersions []releaseutil.GroupVersionKind `json:"apiVersions,omitempty"`
+	// Kustomization is a kustomization.yaml listing the files of Manifests,
+	// with Kustomization. It is not one of the Manifests.
+	Kustomization *OutputManifest `json:"kustomization,omitempty"`
+
+	// stats summarizes the render for the log
+	stats engine.RenderStats
 }
 
 type ExtismHostFunctions struct {
@@ -46,6 +163,8 @@ func (e *ExtismHostFunctions) LookupKubernetesResource(apiVersion string, kind s
 	type lookupKubernetesResourceResult struct {
 		Error  *string        `json:"error,omitempty"`
 		Result map[string]any `json:"result"`
+		// Retryable marks the error as transient, e.g. due to throttling
+		Retryable bool `json:"retryable,omitempty"`
 	}
 
 	result := lookupKubernetesResourceResult{}
@@ -54,7 +173,11 @@ func (e *ExtismHostFunctions) LookupKubernetesResource(apiVersion string, kind s
 	}
 
 	if result.Error != nil {
-		return nil, fmt.Errorf("host error: %s", *result.Error)
+		err := fmt.Errorf("host error: %s", *result.Error)
+		if result.Retryable {
+			return nil, &engine.RetryableError{Err: err}
+		}
+		return nil, err
 	}
 
 	return result.Result, nil
@@ -72,56 +195,401 @@ func (e *ExtismHostFunctions) ResolveHostname(hostname string) string {
 	return string(resultMem.ReadBytes())
 }
 
+func (e *ExtismHostFunctions) ResolveSecret(ref string) (string, error) {
+	memRef := pdk.AllocateString(ref)
+
+	resultPtr := extismResolveSecret(
+		extismPointer(memRef.Offset()),
+	)
+
+	resultMem := pdk.FindMemory(uint64(resultPtr))
+
+	type resolveSecretResult struct {
+		Error  *string `json:"error,omitempty"`
+		Result string  `json:"result"`
+	}
+
+	result := resolveSecretResult{}
+	if err := json.Unmarshal(resultMem.ReadBytes(), &result); err != nil {
+		return "", fmt.Errorf("failed to deserialize ResolveSecret return json: %w", err)
+	}
+
+	if result.Error != nil {
+		return "", fmt.Errorf("host error: %s", *result.Error)
+	}
+
+	return result.Result, nil
+}
+
+func (e *ExtismHostFunctions) ResolveImageDigest(ref string) (string, error) {
+	memRef := pdk.AllocateString(ref)
+
+	resultPtr := extismResolveImageDigest(
+		extismPointer(memRef.Offset()),
+	)
+
+	resultMem := pdk.FindMemory(uint64(resultPtr))
+
+	type resolveImageDigestResult struct {
+		Error  *string `json:"error,omitempty"`
+		Result string  `json:"result"`
+	}
+
+	result := resolveImageDigestResult{}
+	if err := json.Unmarshal(resultMem.ReadBytes(), &result); err != nil {
+		return "", fmt.Errorf("failed to deserialize ResolveImageDigest return json: %w", err)
+	}
+
+	if result.Error != nil {
+		return "", fmt.Errorf("host error: %s", *result.Error)
+	}
+
+	return result.Result, nil
+}
+
+func (e *ExtismHostFunctions) FetchChartDependency(name, version, repository string) ([]byte, error) {
+	memName := pdk.AllocateString(name)
+	memVersion := pdk.AllocateString(version)
+	memRepository := pdk.AllocateString(repository)
+
+	resultPtr := extismFetchChartDependency(
+		extismPointer(memName.Offset()),
+		extismPointer(memVersion.Offset()),
+		extismPointer(memRepository.Offset()),
+	)
+
+	resultMem := pdk.FindMemory(uint64(resultPtr))
+
+	type fetchChartDependencyResult struct {
+		Error  *string `json:"error,omitempty"`
+		Result []byte  `json:"result"`
+	}
+
+	result := fetchChartDependencyResult{}
+	if err := json.Unmarshal(resultMem.ReadBytes(), &result); err != nil {
+		return nil, fmt.Errorf("failed to deserialize FetchChartDependency return json: %w", err)
+	}
+
+	if result.Error != nil {
+		return nil, fmt.Errorf("host error: %s", *result.Error)
+	}
+
+	return result.Result, nil
+}
+
 func RenderChartTemplates(input Input) (*Output, error) {
 	hostFunctions := ExtismHostFunctions{}
 
 	//e, err := renderer.NewEngine(&hostFunctions, renderer.WithDNS(true))
-	e, err := engine.NewEngine(&hostFunctions)
+	if input.SingleStream && input.OutputJSON {
+		return nil, fmt.Errorf("outputJSON cannot be combined with singleStream")
+	}
+	if input.SingleStream && input.GroupByChart {
+		return nil, fmt.Errorf("groupByChart cannot be combined with singleStream")
+	}
+	if input.SingleStream && input.Kustomization {
+		return nil, fmt.Errorf("kustomization cannot be combined with singleStream")
+	}
+	if input.WrapInList && input.SingleStream {
+		return nil, fmt.Errorf("wrapInList cannot be combined with singleStream")
+	}
+	if input.SingleStream && input.HooksByPhase {
+		return nil, fmt.Errorf("hooksByPhase cannot be combined with singleStream")
+	}
+	if input.WrapInList && (input.OutputJSON || input.GroupByChart || input.Kustomization || input.HooksByPhase) {
+		return nil, fmt.Errorf("outputJSON, groupByChart, kustomization and hooksByPhase cannot be combined with wrapInList")
+	}
+
+	options := []engine.EngineOption{
+		engine.WithWarningsAsErrors(input.WarningsAsErrors),
+		engine.WithOutputJSON(input.OutputJSON),
+		engine.WithIncludePartials(input.IncludePartials),
+		engine.WithGroupByChart(input.GroupByChart),
+		engine.WithKustomization(input.Kustomization),
+		engine.WithRemoteDependencies(input.RemoteDependencies),
+	}
+	if input.LookupAttempts > 0 {
+		backoff := time.Duration(input.LookupBackoffMillis) * time.Millisecond
+		options = append(options, engine.WithLookupRetry(input.LookupAttempts, backoff))
+	}
+	if len(input.RequiredValuePaths) > 0 {
+		options = append(options, engine.WithRequiredValuePaths(input.RequiredValuePaths))
+	}
+	if len(input.OpenAPISchema) > 0 {
+		options = append(options, engine.WithOpenAPIValidation(input.OpenAPISchema))
+	}
+	if len(input.SubchartValues) > 0 {
+		subchartValues := make(map[string]releasevalues.Values, len(input.SubchartValues))
+		for chartPath, data := range input.SubchartValues {
+			vals, err := releasevalues.ReadValues(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse values of subchart %q: %w", chartPath, err)
+			}
+			subchartValues[chartPath] = vals
+		}
+		options = append(options, engine.WithSubchartValues(subchartValues))
+	}
+
+	e, err := engine.NewEngine(&hostFunctions, options...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gotemplate engine: %w", err)
 	}
 
-	var vals map[string]any
-	if err := json.Unmarshal(input.ValuesJSON, &vals); err != nil {
-		return nil, fmt.Errorf("failed to parse input values json: %w", err)
+	vals, err := loadValues(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(input.ComputedValues) > 0 {
+		computed, err := decodeValuesJSON(input.ComputedValues)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse input computed values json: %w", err)
+		}
+		vals = vals.Merge(computed)
 	}
 
-	chrt := input.Chart
+	chrt, err := loadChart(input)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := release.ProcessDependencies(chrt, vals); err != nil {
+	if err := e.ProcessDependencies(chrt, vals); err != nil {
 		return nil, fmt.Errorf("chart dependencies processing failed: %w", err)
 	}
 
-	renderedManifests, err := e.RenderAllChartTemplates(chrt, vals)
-	if err != nil {
+	rendered, err := e.Render(context.Background(), chrt, vals)
+	if err != nil && !(input.PartialResults && len(rendered.Errors) > 0) {
 		return nil, fmt.Errorf("failed to render chart templates: %w", err)
 	}
 
-	result := Output{}
+	result := Output{
+		Warnings:  rendered.Warnings,
+		Partials:  rendered.Partials,
+		HostCalls: rendered.HostCalls,
+
+		RenderedBytes:     rendered.RenderedBytes,
+		PeakTemplateBytes: rendered.PeakTemplateBytes,
+		APIVersions:       releaseutil.RenderedAPIVersions(rendered.Manifests),
+		stats:             rendered.Stats,
+		Metadata: OutputMetadata{
+			Name:       chrt.Metadata.Name,
+			Version:    chrt.Metadata.Version,
+			AppVersion: chrt.Metadata.AppVersion,
+			Digest:     manifestsDigest(rendered.Manifests),
+		},
+	}
 
-	for filename, data := range renderedManifests {
+	if rendered.Kustomization != "" {
+		result.Kustomization = &OutputManifest{
+			Filename: rendered.KustomizationFile,
+			Manifest: []byte(rendered.Kustomization),
+		}
+	}
+
+	for filename, err := range rendered.Errors {
+		result.Errors = append(result.Errors, OutputError{
+			Filename: filename,
+			Error:    err.Error(),
+		})
+	}
+	sort.Slice(result.Errors, func(i, j int) bool {
+		return result.Errors[i].Filename < result.Errors[j].Filename
+	})
+
+	if input.SingleStream {
+		hooks, manifests, err := releaseutil.SortManifests(rendered.Manifests, releaseutil.InstallOrder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sort rendered manifests: %w", err)
+		}
+		result.Stream = releaseutil.Stream(append(manifests, hooks...))
+		return &result, nil
+	}
+
+	if input.WrapInList {
+		hooks, manifests, err := releaseutil.SortManifests(rendered.Manifests, releaseutil.InstallOrder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sort rendered manifests: %w", err)
+		}
+		result.Stream, err = releaseutil.List(append(manifests, hooks...))
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap rendered manifests in a list: %w", err)
+		}
+		return &result, nil
+	}
+
+	for filename, data := range rendered.Manifests {
 		result.Manifests = append(result.Manifests, OutputManifest{
 			Filename: filename,
 			Manifest: []byte(data),
 		})
 	}
+	// Sort for reproducible output, as map iteration order is random
+	sort.Slice(result.Manifests, func(i, j int) bool {
+		return result.Manifests[i].Filename < result.Manifests[j].Filename
+	})
+
+	if rendered.ChartGroups != nil {
+		result.ChartGroups = make(map[string][]OutputManifest, len(rendered.ChartGroups))
+		for chartPath, filenames := range rendered.ChartGroups {
+			for _, filename := range filenames {
+				result.ChartGroups[chartPath] = append(result.ChartGroups[chartPath], OutputManifest{
+					Filename: filename,
+					Manifest: []byte(rendered.Manifests[filename]),
+				})
+			}
+		}
+	}
+
+	if input.HooksByPhase {
+		if result.Hooks, err = hooksByPhase(&result); err != nil {
+			return nil, err
+		}
+	}
 	return &result, nil
 }
 
+// manifestsDigest returns the hex encoded sha256 of the manifests, taken in
+// filename order.
+func manifestsDigest(manifests map[string]string) string {
+	filenames := make([]string, 0, len(manifests))
+	for filename := range manifests {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	h := sha256.New()
+	for _, filename := range filenames {
+		// Separate the fields so that they cannot run into each other
+		fmt.Fprintf(h, "%s\x00%s\x00", filename, manifests[filename])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// hooksByPhase groups the hook resources of the rendered manifests by
+// lifecycle phase (helm.sh/hook), ordered by helm.sh/hook-weight within each
+// phase. Each OutputManifest holds a single hook resource, and a hook for
+// several phases is included in each of them.
+func hooksByPhase(output *Output) (map[string][]OutputManifest, error) {
+	files := make(map[string]string, len(output.Manifests))
+	for _, m := range output.Manifests {
+		files[m.Filename] = string(m.Manifest)
+	}
+
+	hooks, _, err := releaseutil.SortManifests(files, releaseutil.InstallOrder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sort rendered manifests: %w", err)
+	}
+
+	phases := map[string][]OutputManifest{}
+	for phase, manifests := range releaseutil.HooksByPhase(hooks) {
+		for _, m := range manifests {
+			phases[phase] = append(phases[phase], OutputManifest{
+				Filename: m.Name,
+				Manifest: []byte(m.Content),
+			})
+		}
+	}
+	return phases, nil
+}
+
+// loadChart returns the chart to render, loading it from the archive if one
+// was provided.
+func loadChart(input Input) (*chart.Chart, error) {
+	switch {
+	case input.Chart != nil && len(input.ChartArchive) > 0:
+		return nil, fmt.Errorf("only one of chart or chartArchive may be provided")
+	case input.Chart != nil:
+		return input.Chart, nil
+	case len(input.ChartArchive) > 0:
+		chrt, err := chartloader.LoadArchive(bytes.NewReader(input.ChartArchive))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load chart archive: %w", err)
+		}
+		return chrt, nil
+	default:
+		return nil, fmt.Errorf("one of chart or chartArchive must be provided")
+	}
+}
+
+// loadValues returns the render values, reading them from the values file if
+// one was provided.
+func loadValues(input Input) (releasevalues.Values, error) {
+	switch {
+	case len(input.ValuesJSON) > 0 && input.ValuesPath != "":
+		return nil, fmt.Errorf("only one of values or valuesPath may be provided")
+	case input.ValuesPath != "":
+		vals, err := releasevalues.ReadValuesFile(input.ValuesPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read values file %q: %w", input.ValuesPath, err)
+		}
+		return vals, nil
+	default:
+		vals, err := decodeValuesJSON(input.ValuesJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse input values json: %w", err)
+		}
+		return vals, nil
+	}
+}
+
+// decodeValuesJSON decodes a single JSON object of values. Numbers are decoded
+// as json.Number, as from a values file, so that e.g. integers are not
+// formatted as floats.
+func decodeValuesJSON(data []byte) (releasevalues.Values, error) {
+	var vals releasevalues.Values
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&vals); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after top-level value")
+	}
+	return vals, nil
+}
+
+// RunPlugin renders the chart of the plugin input, logging any error. Errors
+// before the log format of the input is known are logged as text.
 func RunPlugin() error {
+	log := &logger{}
 	var input Input
 	if err := pdk.InputJSON(&input); err != nil {
-		return fmt.Errorf("failed to parse input json: %w", err)
+		err = fmt.Errorf("failed to parse input json: %w", err)
+		log.Log(pdk.LogError, "failed", "", 0, err)
+		return err
 	}
 
+	log, err := newLogger(input.LogFormat)
+	if err != nil {
+		(&logger{}).Log(pdk.LogError, "failed", "", 0, err)
+		return err
+	}
+	log.Log(pdk.LogDebug, "running gotemplate-renderer plugin", "", 0, nil)
+
+	chrt, err := loadChart(input)
+	if err != nil {
+		log.Log(pdk.LogError, "failed", "", 0, err)
+		return err
+	}
+	// Render the loaded chart, so that an archive is not loaded again and the
+	// name of its chart is logged too
+	input.Chart, input.ChartArchive = chrt, nil
+	chartName := chrt.Name()
+
+	start := time.Now()
 	output, err := RenderChartTemplates(input)
+	duration := time.Since(start)
 	if err != nil {
-		pdk.Log(pdk.LogError, fmt.Sprintf("failed: %s", err.Error()))
+		log.Log(pdk.LogError, "failed", chartName, duration, err)
 		return err
 	}
+	log.Log(pdk.LogInfo, "rendered chart", output.Metadata.Name, duration, nil)
+	log.Log(pdk.LogInfo, output.stats.String(), output.Metadata.Name, 0, nil)
 
 	if err := pdk.OutputJSON(output); err != nil {
-		return fmt.Errorf("failed to write output json: %w", err)
+		err = fmt.Errorf("failed to write output json: %w", err)
+		log.Log(pdk.LogError, "failed", output.Metadata.Name, 0, err)
+		return err
 	}
 
 	return nil
@@ -130,10 +598,7 @@ func RunPlugin() error {
 //go:wasmexport helm_chart_renderer
 func HelmChartRenderer() uint64 {
 
-	pdk.Log(pdk.LogDebug, "running gotemplate-renderer plugin")
-
 	if err := RunPlugin(); err != nil {
-		pdk.Log(pdk.LogError, err.Error())
 		pdk.SetError(err)
 		return 1
 	}
@@ -0,0 +1,148 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/releasevalues"
+	chart "helm.sh/helm/v4/pkg/chart/v2"
+)
+
+// resultCache is a least recently used cache of successful render results,
+// keyed by resultCacheKey. It is safe for concurrent use.
+type resultCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *resultCacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type resultCacheEntry struct {
+	key    string
+	result *RenderResult
+}
+
+func newResultCache(size int) *resultCache {
+	return &resultCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// get returns a copy of the result cached for key.
+func (c *resultCache) get(key string) (*RenderResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return copyRenderResult(elem.Value.(*resultCacheEntry).result), true
+}
+
+// add caches a copy of result for key, evicting the least recently used result
+// if the cache is full.
+func (c *resultCache) add(key string, result *RenderResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&resultCacheEntry{key: key, result: copyRenderResult(result)})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*resultCacheEntry).key)
+	}
+}
+
+// copyRenderResult returns a copy of a successful render result, sharing
+// nothing with it that the caller could modify. No host functions are called
+// for a cached result, so its HostCalls are empty.
+func copyRenderResult(r *RenderResult) *RenderResult {
+	var chartGroups map[string][]string
+	if r.ChartGroups != nil {
+		chartGroups = make(map[string][]string, len(r.ChartGroups))
+		for chartPath, filenames := range r.ChartGroups {
+			chartGroups[chartPath] = slices.Clone(filenames)
+		}
+	}
+	return &RenderResult{
+		Manifests:   maps.Clone(r.Manifests),
+		Warnings:    slices.Clone(r.Warnings),
+		Partials:    maps.Clone(r.Partials),
+		Errors:      maps.Clone(r.Errors),
+		HostCalls:   map[string]int{},
+		ChartGroups: chartGroups,
+
+		RenderedBytes:     r.RenderedBytes,
+		PeakTemplateBytes: r.PeakTemplateBytes,
+		Stats:             r.Stats,
+
+		KustomizationFile: r.KustomizationFile,
+		Kustomization:     r.Kustomization,
+	}
+}
+
+// resultCacheKey returns the hex encoded sha256 of the content of a chart, its
+// dependencies and the render values. It returns false if the values cannot be
+// encoded as JSON.
+func resultCacheKey(chrt *chart.Chart, values releasevalues.Values) (string, bool) {
+	h := sha256.New()
+	if err := hashChart(h, chrt); err != nil {
+		return "", false
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", false
+	}
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum(nil)), true
+}
+
+// hashChart writes the content of a chart and its dependencies to h.
+func hashChart(h hash.Hash, c *chart.Chart) error {
+	// The dependencies are not exported, so they are not part of the JSON
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	// Separate the charts so that they cannot run into each other
+	fmt.Fprintf(h, "%d\x00", len(data))
+	h.Write(data)
+
+	for _, child := range c.Dependencies() {
+		if err := hashChart(h, child); err != nil {
+			return err
+		}
+	}
+	fmt.Fprint(h, "\x00")
+	return nil
+}
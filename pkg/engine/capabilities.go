@@ -0,0 +1,144 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/Masterminds/semver/v3"
+
+	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/releasevalues"
+)
+
+// VersionSet is a set of Kubernetes API versions.
+type VersionSet []string
+
+// Has returns true if the version string is in the set.
+//
+//	vs.Has("apps/v1")
+func (v VersionSet) Has(apiVersion string) bool {
+	return slices.Contains(v, apiVersion)
+}
+
+// newVersionSet builds a deduplicated VersionSet, preserving the order in which
+// versions are first seen.
+func newVersionSet(versions ...[]string) VersionSet {
+	seen := make(map[string]struct{})
+	vs := VersionSet{}
+	for _, list := range versions {
+		for _, v := range list {
+			if _, ok := seen[v]; ok {
+				continue
+			}
+			seen[v] = struct{}{}
+			vs = append(vs, v)
+		}
+	}
+	return vs
+}
+
+// toStringSlice converts a decoded list of API versions to a []string.
+func toStringSlice(v interface{}) []string {
+	switch vv := v.(type) {
+	case VersionSet:
+		return vv
+	case []string:
+		return vv
+	case []interface{}:
+		s := make([]string, 0, len(vv))
+		for _, item := range vv {
+			s = append(s, fmt.Sprint(item))
+		}
+		return s
+	}
+	return nil
+}
+
+// prepareCapabilities returns a shallow copy of the render values whose
+// Capabilities.APIVersions is a VersionSet with the versions added with
+// WithAddedAPIVersions merged in. Without added versions, the Capabilities
+// are left as supplied.
+func (e *Engine) prepareCapabilities(vals releasevalues.Values) releasevalues.Values {
+	if len(e.options.AddedAPIVersions) == 0 {
+		return vals
+	}
+
+	caps := map[string]interface{}{}
+	switch c := vals["Capabilities"].(type) {
+	case map[string]interface{}:
+		caps = c
+	case releasevalues.Values:
+		caps = c
+	case nil:
+	default:
+		// Capabilities supplied as a typed structure are used as-is.
+		return vals
+	}
+
+	out := make(releasevalues.Values, len(vals))
+	for k, v := range vals {
+		out[k] = v
+	}
+
+	outCaps := make(map[string]interface{}, len(caps)+1)
+	for k, v := range caps {
+		outCaps[k] = v
+	}
+	outCaps["APIVersions"] = newVersionSet(toStringSlice(caps["APIVersions"]), e.options.AddedAPIVersions)
+
+	out["Capabilities"] = outCaps
+	return out
+}
+
+// apiVersionsOf returns the API versions of the Capabilities in the render
+// values.
+func apiVersionsOf(vals releasevalues.Values) VersionSet {
+	caps, err := vals.Table("Capabilities")
+	if err != nil {
+		return nil
+	}
+	return newVersionSet(toStringSlice(caps["APIVersions"]))
+}
+
+// kubeVersionAtLeast returns true if the Kubernetes version of the
+// Capabilities in the render values is at least minimum (e.g. "1.25").
+//
+// Pre-release and build suffixes are ignored, as cloud providers add them to
+// release versions (e.g. "v1.25.3-gke.100"), and semver would otherwise order
+// such a version before "1.25.3".
+func kubeVersionAtLeast(vals releasevalues.Values, minimum string) (bool, error) {
+	threshold, err := semver.NewVersion(minimum)
+	if err != nil {
+		return false, fmt.Errorf("invalid Kubernetes version %q: %w", minimum, err)
+	}
+
+	caps, _ := vals.Table("Capabilities")
+	kubeVersion, _ := caps.Table("KubeVersion")
+	version, _ := kubeVersion["Version"].(string)
+	if version == "" {
+		return false, errors.New("no Kubernetes version in Capabilities.KubeVersion.Version")
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return false, fmt.Errorf("invalid Kubernetes version %q in Capabilities: %w", version, err)
+	}
+
+	release := semver.New(v.Major(), v.Minor(), v.Patch(), "", "")
+	return !release.LessThan(threshold), nil
+}
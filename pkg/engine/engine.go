@@ -17,31 +17,119 @@ limitations under the License.
 package engine
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"sort"
 	"strings"
 	"text/template"
+	"time"
 
+	"sigs.k8s.io/yaml"
+
+	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/release"
+	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/releaseutil"
 	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/releasevalues"
 	chart "helm.sh/helm/v4/pkg/chart/v2"
 )
 
 // Engine is an implementation of the Helm rendering implementation for templates.
+//
+// An Engine is safe for concurrent use, provided its HostFunctions are. Each
+// render runs on its own copy of the engine (see newRender) with a fresh
+// template set, so renders share no mutable state other than the result
+// cache, which is locked.
 type Engine struct {
 	options       engineOptions
 	hostFunctions HostFunctions
-	goTemplate    *template.Template
+	// resultCache caches render results, see WithResultCache
+	resultCache *resultCache
+
+	// The fields below are per render, and only set on the copy made by newRender.
+
+	goTemplate *template.Template
+	// warnings collected during the current render
+	warnings []string
+	// deprecationWarned holds the deprecation warnings already collected, to
+	// warn about each deprecated function once per template
+	deprecationWarned map[string]bool
+	// renderContext is the top-level context of the template being rendered
+	renderContext releasevalues.Values
+	// renderedBytes is the size of the output rendered so far
+	renderedBytes int
+	// peakTemplateBytes is the size of the largest output of a single template
+	peakTemplateBytes int
+	// stats counts the templates handled by the current render
+	stats RenderStats
+	// kustomization is the kustomization.yaml of the current render, with
+	// WithKustomization
+	kustomization string
+	// templateErrors are the errors of the templates that failed to render
+	templateErrors map[string]error
+	// hostCalls counts the calls to each method of hostFunctions
+	hostCalls map[string]int
+	// trace records the template executions, with WithExecutionTrace
+	trace executionTrace
+	// prepared is set when goTemplate already holds the parsed templates (see
+	// Prepare)
+	prepared bool
 }
 
 type engineOptions struct {
-	EnableDNS bool
-	Strict    bool
-	LintMode  bool
+	EnableDNS     bool
+	EnableSecrets bool
+	EnableImages  bool
+	RemoteDeps    bool
+	Strict        bool
+	LintMode      bool
+
+	WarningsAsErrors   bool
+	FailFast           bool
+	ManifestLint       bool
+	LabelValidation    bool
+	RootChartOnly      bool
+	OutputJSON         bool
+	TabDetection       bool
+	MaxOutputSize      int
+	IncludePartials    bool
+	StrictScope        bool
+	ValueInterpolation bool
+	DefineCollisions   bool
+	GroupByChart       bool
+	LookupAttempts     int
+	LookupBackoff      time.Duration
+	NoRecursionGuard   bool
+	Kustomization      bool
+	PruneEmpty         bool
+
+	TemplateNamespace  string
+	MissingKeySentinel string
+	Release            *Release
+	ValuesLookup       *valuesLookup
+
+	AddedAPIVersions   []string
+	AllowedRegistries  []string
+	OpenAPISchema      *openAPISchema
+	CommonLabels       map[string]string
+	MandatoryLabels    []string
+	PruneKeep          []string
+	RequiredValuePaths []string
+
+	ValuesDump      io.Writer
+	ExecutionTrace  io.Writer
+	SubchartValues  map[string]releasevalues.Values
+	ResourcePresets map[string]releasevalues.Values
+
+	DeprecatedFunctions []string
+	FailOnDeprecated    bool
+	FailOnMissingLabels bool
 }
 
 type EngineOption func(e *Engine) error
@@ -56,6 +144,35 @@ func WithDNS(enable bool) EngineOption {
 	}
 }
 
+// WithSecrets when enabled allows templates to resolve secret references via
+// the host (resolveSecret). When disabled, resolveSecret will return empty strings
+func WithSecrets(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.EnableSecrets = enable
+		return nil
+	}
+}
+
+// WithImageResolution when enabled allows templates to pin image references
+// to their digest via the host (imageDigest). When disabled, imageDigest
+// returns the reference unchanged.
+func WithImageResolution(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.EnableImages = enable
+		return nil
+	}
+}
+
+// WithRemoteDependencies when enabled lets ProcessDependencies fetch the
+// dependencies a chart declares but does not vendor into its charts/ directory
+// via the host (FetchChartDependency).
+func WithRemoteDependencies(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.RemoteDeps = enable
+		return nil
+	}
+}
+
 // WithStrict when enabled causes template rendering will fail if a template references
 // a value that was not passed in
 func WithStrict(enable bool) EngineOption {
@@ -65,6 +182,17 @@ func WithStrict(enable bool) EngineOption {
 	}
 }
 
+// WithMissingKeySentinel sets the text a reference to a missing value renders
+// as, instead of nothing (e.g. "__MISSING__", so that reviewers can spot
+// values typos in diffs of the manifests). It has no effect with WithStrict,
+// which fails the render instead.
+func WithMissingKeySentinel(s string) EngineOption {
+	return func(e *Engine) error {
+		e.options.MissingKeySentinel = s
+		return nil
+	}
+}
+
 // WithLintMode when enanbles the template engine to optate in "lint mode"
 // Lint mode:
 // - disables 'required' template function (as values may be missing, so don't fail)
@@ -77,65 +205,897 @@ func WithLintMode(enable bool) EngineOption {
 	}
 }
 
+// WithWarningsAsErrors when enabled causes a render that produced any warnings
+// to fail, with the warnings aggregated into the returned error.
+//
+// This includes the 'required' and 'fail' messages which lint mode would
+// otherwise only report as warnings, so combining it with WithLintMode turns
+// those back into failures.
+func WithWarningsAsErrors(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.WarningsAsErrors = enable
+		return nil
+	}
+}
+
+// WithFailFast when enabled stops rendering at the first template that fails,
+// rather than rendering every template and reporting all failures together.
+func WithFailFast(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.FailFast = enable
+		return nil
+	}
+}
+
+// WithManifestLint when enabled produces a warning for each rendered document
+// missing the apiVersion, kind or metadata.name fields required of every
+// Kubernetes resource. Use WithWarningsAsErrors to fail on these.
+func WithManifestLint(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.ManifestLint = enable
+		return nil
+	}
+}
+
+// WithLabelValidation when enabled produces a warning for each label or
+// annotation of a rendered resource that does not have valid Kubernetes
+// syntax: keys must be a name of up to 63 characters with an optional DNS
+// subdomain prefix, and label values a name of up to 63 characters.
+func WithLabelValidation(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.LabelValidation = enable
+		return nil
+	}
+}
+
+// WithMandatoryLabels requires every rendered resource to set each of the
+// label keys in its metadata.labels, e.g. to enforce a labelling policy. A
+// resource missing any produces a warning naming it and the missing keys or,
+// when fail is set, fails the render. Documents without metadata are not
+// checked. Labels added by WithCommonLabels count.
+func WithMandatoryLabels(keys []string, fail bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.MandatoryLabels = append(e.options.MandatoryLabels, keys...)
+		e.options.FailOnMissingLabels = fail
+		return nil
+	}
+}
+
+// WithPruneEmpty when enabled removes the fields of the rendered resources
+// whose value is null, an empty string, an empty map or an empty list, e.g.
+// left behind by conditional template logic, at any depth. A map or list
+// emptied that way is removed in turn. Fields whose empty value is meaningful
+// to Kubernetes (emptyDir, podSelector and namespaceSelector by default, see
+// WithPruneKeep) are kept. Files holding a pruned resource are re-encoded,
+// which drops their comments.
+func WithPruneEmpty(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.PruneEmpty = enable
+		return nil
+	}
+}
+
+// WithPruneKeep sets the names of the fields WithPruneEmpty keeps even if
+// they are empty, replacing the defaults. Without any, every empty field is
+// pruned.
+func WithPruneKeep(fields ...string) EngineOption {
+	return func(e *Engine) error {
+		e.options.PruneKeep = append([]string{}, fields...)
+		return nil
+	}
+}
+
+// WithCommonLabels adds labels to the metadata.labels of every rendered
+// resource, e.g. app.kubernetes.io/managed-by, so templates need not declare
+// them. Labels a resource sets itself are not overridden. Files holding a
+// labelled resource are re-encoded, which drops their comments.
+func WithCommonLabels(labels map[string]string) EngineOption {
+	return func(e *Engine) error {
+		if e.options.CommonLabels == nil {
+			e.options.CommonLabels = map[string]string{}
+		}
+		for k, v := range labels {
+			e.options.CommonLabels[k] = v
+		}
+		return nil
+	}
+}
+
+// WithResourcePresets replaces the table of container resources the
+// 'resourcePreset' function looks up, mapping each preset name (e.g. "small")
+// to its "requests" and "limits". By default the presets small, medium and
+// large are available.
+func WithResourcePresets(presets map[string]map[string]interface{}) EngineOption {
+	return func(e *Engine) error {
+		e.options.ResourcePresets = make(map[string]releasevalues.Values, len(presets))
+		for name, resources := range presets {
+			e.options.ResourcePresets[name] = releasevalues.Values(resources).DeepCopy()
+		}
+		return nil
+	}
+}
+
+// WithRootChartOnly when enabled renders only the templates of the root chart,
+// skipping all subcharts. This speeds up iterating on a parent chart alone.
+func WithRootChartOnly(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.RootChartOnly = enable
+		return nil
+	}
+}
+
+// WithTemplateNamespace prefixes the full path of every template with
+// namespace, e.g. "team-a/app/templates/cm.yaml", so that the output of
+// several engines rendering into shared infrastructure cannot collide. The
+// prefixed paths are the keys of the rendered manifests and are seen by
+// templates in .Template.Name and .Template.BasePath, so a template included
+// by path must be named relative to .Template.BasePath. Named templates
+// (define) are not affected.
+func WithTemplateNamespace(namespace string) EngineOption {
+	return func(e *Engine) error {
+		namespace = strings.Trim(namespace, "/")
+		if namespace != path.Clean(namespace) || strings.HasPrefix(namespace, "..") {
+			return fmt.Errorf("invalid template namespace %q", namespace)
+		}
+		e.options.TemplateNamespace = namespace
+		return nil
+	}
+}
+
+// WithOutputJSON when enabled converts the rendered manifests to indented JSON.
+// A file containing a single document becomes a JSON object, and a file
+// containing several documents becomes a JSON array of them. A file without
+// any documents becomes an empty JSON array.
+func WithOutputJSON(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.OutputJSON = enable
+		return nil
+	}
+}
+
+// WithTabDetection when enabled fails the render of any template whose output
+// has a line indented with a tab, which YAML does not allow, naming the file
+// and line rather than leaving the mistake to an opaque YAML parser error.
+func WithTabDetection(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.TabDetection = enable
+		return nil
+	}
+}
+
+// WithMaxOutputSize limits the total size in bytes of the rendered output of
+// all templates. A render exceeding it is aborted, protecting the host from
+// templates that, maliciously or by mistake, generate huge output.
+func WithMaxOutputSize(bytes int) EngineOption {
+	return func(e *Engine) error {
+		if bytes < 0 {
+			return fmt.Errorf("maximum output size must not be negative: %d", bytes)
+		}
+		e.options.MaxOutputSize = bytes
+		return nil
+	}
+}
+
+// WithRecursionGuard when disabled stops counting the nesting of 'include'
+// calls, which otherwise fails a render once a template includes itself more
+// than 1000 times over. This saves the bookkeeping of every include and allows
+// legitimately deeper recursion, but a template recursing infinitely is then
+// only stopped by exhausting the stack, crashing the plugin. Only disable it
+// for trusted charts. The guard is enabled by default.
+func WithRecursionGuard(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.NoRecursionGuard = !enable
+		return nil
+	}
+}
+
+// WithKustomization when enabled generates a kustomization.yaml to go next
+// to the root chart's templates directory (e.g. "app/kustomization.yaml"),
+// listing every manifest holding a resource, so that the output can be fed to
+// Kustomize as is. It is returned in RenderResult.Kustomization rather than
+// among the manifests. Combined with WithOutputJSON, manifests holding several
+// resources become a v1 List, which Kustomize reads, rather than an array.
+func WithKustomization(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.Kustomization = enable
+		return nil
+	}
+}
+
+// WithIncludePartials when enabled also renders partials (templates prefixed
+// with '_') into the returned manifests, and returns their source in
+// RenderResult.Partials, e.g. for tooling listing the helpers a chart defines.
+func WithIncludePartials(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.IncludePartials = enable
+		return nil
+	}
+}
+
+// WithGroupByChart when enabled also returns the filenames of the rendered
+// manifests grouped by the full path of the chart they belong to in
+// RenderResult.ChartGroups, e.g. for tooling presenting the output per chart.
+func WithGroupByChart(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.GroupByChart = enable
+		return nil
+	}
+}
+
+// valuesLookup identifies a key of a cluster resource holding values.
+type valuesLookup struct {
+	APIVersion, Kind, Namespace, Name, Key string
+}
+
+// WithValuesFromLookup loads base values from a key of the data of a cluster
+// resource, typically a ConfigMap, at the start of each render. The supplied
+// values take precedence over them. Nothing is loaded if the resource or key
+// does not exist.
+func WithValuesFromLookup(apiVersion, kind, namespace, name, key string) EngineOption {
+	return func(e *Engine) error {
+		e.options.ValuesLookup = &valuesLookup{
+			APIVersion: apiVersion,
+			Kind:       kind,
+			Namespace:  namespace,
+			Name:       name,
+			Key:        key,
+		}
+		return nil
+	}
+}
+
+// WithValueInterpolation when enabled resolves ${path} references within
+// string values against the chart values before rendering, see
+// releasevalues.InterpolateValues.
+func WithValueInterpolation(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.ValueInterpolation = enable
+		return nil
+	}
+}
+
+// WithStrictScopeIsolation when enabled fails the render of any subchart
+// template referencing a value which is not set in the subchart's own values
+// (or globals) but is set in its parent's, as the template has most likely
+// been written expecting the parent's values.
+func WithStrictScopeIsolation(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.StrictScope = enable
+		return nil
+	}
+}
+
+// WithDefineCollisionCheck when enabled fails the render if two templates
+// define a named template with the same name but a different body, e.g. when
+// two subcharts vendor different versions of the same library. Otherwise the
+// definition parsed last silently wins for every chart.
+func WithDefineCollisionCheck(enable bool) EngineOption {
+	return func(e *Engine) error {
+		e.options.DefineCollisions = enable
+		return nil
+	}
+}
+
+// WithReleaseStruct sets the release information available to templates as
+// .Release, instead of taking it from the render values.
+func WithReleaseStruct(release Release) EngineOption {
+	return func(e *Engine) error {
+		e.options.Release = &release
+		return nil
+	}
+}
+
+// WithAddedAPIVersions adds API versions to those supplied in the render
+// values' Capabilities, rather than replacing them. This allows rendering charts
+// that target API versions (e.g. CRDs) which are not yet installed.
+func WithAddedAPIVersions(versions []string) EngineOption {
+	return func(e *Engine) error {
+		e.options.AddedAPIVersions = append(e.options.AddedAPIVersions, versions...)
+		return nil
+	}
+}
+
+// WithAllowedRegistries restricts the container images rendered manifests may
+// reference to those from the given registries (e.g. "ghcr.io" or
+// "registry.example.com/team"). Images without an explicit registry are from
+// docker.io. A render referencing any other image fails.
+func WithAllowedRegistries(registries []string) EngineOption {
+	return func(e *Engine) error {
+		e.options.AllowedRegistries = append(e.options.AllowedRegistries, registries...)
+		return nil
+	}
+}
+
+// WithOpenAPIValidation validates the rendered resources against an OpenAPI
+// v2 document, such as the one served by the Kubernetes API server at
+// /openapi/v2. A render with resources holding fields unknown to, or of a
+// different type than, the schema of their kind fails. Resources of kinds
+// without a schema are not validated.
+func WithOpenAPIValidation(schema []byte) EngineOption {
+	return func(e *Engine) error {
+		s, err := parseOpenAPISchema(schema)
+		if err != nil {
+			return err
+		}
+		e.options.OpenAPISchema = s
+		return nil
+	}
+}
+
+// WithValuesDump writes the effective .Values of every chart scope to w as
+// YAML, after scoping and merging of chart defaults. Each scope is written as
+// a separate document headed by the chart's full path, in the order the
+// charts are visited. This is useful for debugging why subchart values do not
+// resolve as expected. w is shared by all renders of the engine.
+func WithValuesDump(w io.Writer) EngineOption {
+	return func(e *Engine) error {
+		e.options.ValuesDump = w
+		return nil
+	}
+}
+
+// WithExecutionTrace writes a report of the template executions of every
+// render to w once it finishes: how many times each template file, included
+// template and 'tpl' snippet was executed, and how long that took in total,
+// e.g. to find a helper included thousands of times in a range. The time of
+// an included template includes that of the templates it includes in turn. w
+// is shared by all renders of the engine.
+func WithExecutionTrace(w io.Writer) EngineOption {
+	return func(e *Engine) error {
+		e.options.ExecutionTrace = w
+		return nil
+	}
+}
+
+// WithResultCache caches the results of up to size successful renders, keyed
+// by a hash of the chart's content and the render values. Rendering the same
+// chart with the same values again returns the cached result, without calling
+// any template or host functions, so lookups are not repeated either. A size
+// of 0 disables the cache.
+//
+// Renders are never cached when WithValuesFromLookup is set, as the looked up
+// values are not part of the cache key, nor with WithValuesDump or
+// WithExecutionTrace, whose output is only written by an actual render.
+func WithResultCache(size int) EngineOption {
+	return func(e *Engine) error {
+		if size < 0 {
+			return fmt.Errorf("result cache size must not be negative: %d", size)
+		}
+		e.resultCache = nil
+		if size > 0 {
+			e.resultCache = newResultCache(size)
+		}
+		return nil
+	}
+}
+
+// WithSubchartValues overrides the values of individual charts, keyed by the
+// chart's full path (e.g. "app/charts/db"). The values are merged over the
+// chart's scoped values, after its own defaults, so they take precedence over
+// anything set for the chart in the main values tree. Like any of its values,
+// they are passed on to the chart's own subcharts, but not to its siblings.
+func WithSubchartValues(values map[string]releasevalues.Values) EngineOption {
+	return func(e *Engine) error {
+		if e.options.SubchartValues == nil {
+			e.options.SubchartValues = map[string]releasevalues.Values{}
+		}
+		for chartPath, vals := range values {
+			e.options.SubchartValues[chartPath] = vals
+		}
+		return nil
+	}
+}
+
+// WithDeprecatedFunctions marks template functions as deprecated. A template
+// calling one of them produces a warning naming the template and function or,
+// when fail is set, fails to render. Calls are detected as they happen, so
+// calls in branches that are not executed go unnoticed.
+func WithDeprecatedFunctions(names []string, fail bool) EngineOption {
+	return func(e *Engine) error {
+		funcs := funcMap()
+		for _, name := range names {
+			if _, ok := funcs[name]; !ok {
+				return fmt.Errorf("cannot deprecate unknown template function %q", name)
+			}
+		}
+		e.options.DeprecatedFunctions = append(e.options.DeprecatedFunctions, names...)
+		e.options.FailOnDeprecated = fail
+		return nil
+	}
+}
+
+// WithLookupRetry retries a Kubernetes lookup failing with a RetryableError
+// up to attempts times in total, waiting backoff before the first retry and
+// doubling the wait before each further one. This applies to lookups of a
+// single resource and of all resources of a kind alike.
+func WithLookupRetry(attempts int, backoff time.Duration) EngineOption {
+	return func(e *Engine) error {
+		if attempts < 1 {
+			return fmt.Errorf("lookup attempts must be at least 1, got %d", attempts)
+		}
+		if backoff < 0 {
+			return fmt.Errorf("lookup backoff must not be negative, got %s", backoff)
+		}
+		e.options.LookupAttempts = attempts
+		e.options.LookupBackoff = backoff
+		return nil
+	}
+}
+
+// WithRequiredValuePaths requires each of the dotted value paths (e.g.
+// "image.repository") to be set to a non-empty value before rendering starts.
+// The values of the root chart, including its defaults, are checked, and all
+// missing paths are reported together.
+func WithRequiredValuePaths(paths []string) EngineOption {
+	return func(e *Engine) error {
+		for _, p := range paths {
+			if p == "" {
+				return errors.New("required value path cannot be empty")
+			}
+		}
+		e.options.RequiredValuePaths = append(e.options.RequiredValuePaths, paths...)
+		return nil
+	}
+}
+
 type HostFunctions interface {
+	// LookupKubernetesResource returns the named resource, or all resources of
+	// the kind if name is empty. An empty namespace queries cluster-scoped
+	// resources (or all namespaces for namespaced kinds).
 	LookupKubernetesResource(apiversion string, kind string, namespace string, name string) (map[string]interface{}, error)
 	ResolveHostname(hostname string) string
+	// ResolveSecret returns the secret value for ref from an external secret
+	// store. How refs are interpreted is decided by the host.
+	ResolveSecret(ref string) (string, error)
+	// ResolveImageDigest returns the image reference (e.g. "nginx:1.27")
+	// pinned to the digest the registry currently has for it, in the form
+	// "repository@sha256:...".
+	ResolveImageDigest(ref string) (string, error)
+	// FetchChartDependency returns the packaged chart (.tgz) of a dependency
+	// declared in Chart.yaml, e.g. from its chart repository.
+	FetchChartDependency(name, version, repository string) ([]byte, error)
+}
+
+// countingHostFunctions counts the calls to each method of HostFunctions, by
+// method name.
+type countingHostFunctions struct {
+	HostFunctions
+	calls map[string]int
+}
+
+func (c *countingHostFunctions) LookupKubernetesResource(apiversion string, kind string, namespace string, name string) (map[string]interface{}, error) {
+	c.calls["LookupKubernetesResource"]++
+	return c.HostFunctions.LookupKubernetesResource(apiversion, kind, namespace, name)
+}
+
+func (c *countingHostFunctions) ResolveHostname(hostname string) string {
+	c.calls["ResolveHostname"]++
+	return c.HostFunctions.ResolveHostname(hostname)
+}
+
+func (c *countingHostFunctions) ResolveSecret(ref string) (string, error) {
+	c.calls["ResolveSecret"]++
+	return c.HostFunctions.ResolveSecret(ref)
+}
+
+func (c *countingHostFunctions) ResolveImageDigest(ref string) (string, error) {
+	c.calls["ResolveImageDigest"]++
+	return c.HostFunctions.ResolveImageDigest(ref)
+}
+
+func (c *countingHostFunctions) FetchChartDependency(name, version, repository string) ([]byte, error) {
+	c.calls["FetchChartDependency"]++
+	return c.HostFunctions.FetchChartDependency(name, version, repository)
 }
 
 // New creates a new instance of Engine using the passed in rest config.
 func NewEngine(hostFunctions HostFunctions, options ...EngineOption) (*Engine, error) {
 
-	e := Engine{
-		hostFunctions: hostFunctions,
+	e := Engine{
+		hostFunctions: hostFunctions,
+	}
+
+	errs := []error{}
+	for _, o := range options {
+		err := o(&e)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("error creating engine: %w", err)
+	}
+
+	return &e, nil
+}
+
+// newRender returns a copy of the engine with a fresh template set, to hold
+// the state of a single render bound to ctx.
+func (e *Engine) newRender(ctx context.Context) *Engine {
+	rootName := "gotpl"
+	if e.options.TemplateNamespace != "" {
+		rootName = e.options.TemplateNamespace
+	}
+	t := template.New(rootName)
+	if e.options.Strict {
+		t.Option("missingkey=error")
+	} else {
+		// Not that zero will attempt to add default values for types it knows,
+		// but will still emit <no value> for others. We mitigate that later.
+		t.Option("missingkey=zero")
+	}
+
+	return e.newRenderOn(ctx, t)
+}
+
+// newRenderOn returns a copy of the engine to hold the state of a single
+// render bound to ctx using the template set t.
+func (e *Engine) newRenderOn(ctx context.Context, t *template.Template) *Engine {
+	r := &Engine{
+		options:        e.options,
+		goTemplate:     t,
+		templateErrors: map[string]error{},
+		hostCalls:      map[string]int{},
+
+		deprecationWarned: map[string]bool{},
+	}
+	hostFunctions := e.hostFunctions
+	if e.options.LookupAttempts > 1 {
+		hostFunctions = &retryingHostFunctions{
+			HostFunctions: hostFunctions,
+			ctx:           ctx,
+			attempts:      e.options.LookupAttempts,
+			backoff:       e.options.LookupBackoff,
+		}
+	}
+	r.hostFunctions = &countingHostFunctions{HostFunctions: hostFunctions, calls: r.hostCalls}
+	if e.options.ExecutionTrace != nil {
+		r.trace = executionTrace{}
+	}
+
+	r.initFunMap()
+
+	return r
+}
+
+// ProcessDependencies enables and disables the dependencies of a chart per its
+// conditions and tags, and imports their values, like
+// release.ProcessDependencies. With WithRemoteDependencies, dependencies
+// missing from the chart are fetched via the host first.
+func (e *Engine) ProcessDependencies(chrt *chart.Chart, values releasevalues.Values) error {
+	var opts []release.DependencyOption
+	if e.options.RemoteDeps {
+		opts = append(opts, release.WithDependencyFetcher(e.hostFunctions.FetchChartDependency))
+	}
+	return release.ProcessDependencies(chrt, values, opts...)
+}
+
+// Render takes a chart, optional values, and value overrides, and attempts to render the Go templates.
+//
+// Render can be called repeatedly, and concurrently, on the same engine.
+//
+// This will look in the chart's 'templates' data (e.g. the 'templates/' directory)
+// and attempt to render the templates there using the values passed in.
+//
+// Values are scoped to their templates. A dependency template will not have
+// access to the values set for its parent. If chart "foo" includes chart "bar",
+// "bar" will not have access to the vil.es for "foo".
+//
+// Values should be prepared with something like `chartutils.ReadValues`.
+// The values.yaml defaults of the chart and its dependencies are coalesced
+// under them, so a null value removes a default. A key that a null already
+// removed from values coalesced by the host gets its default back.
+//
+// Values are passed through the templates according to scope. If the top layer
+// chart includes the chart foo, which includes the chart bar, the values map
+// will be examined for a table called "foo". If "foo" is found in vals,
+// that section of the values will be passed into the "foo" chart. And if that
+// section contains a value named "bar", that value will be passed on to the
+// bar chart during render time.
+func (e *Engine) RenderAllChartTemplates(chrt *chart.Chart, values releasevalues.Values) (map[string]string, error) {
+	return e.RenderAllChartTemplatesContext(context.Background(), chrt, values)
+}
+
+// RenderAllChartTemplatesContext is like RenderAllChartTemplates, but aborts
+// rendering once ctx is cancelled.
+//
+// When some templates fail to render, the output of the templates that
+// rendered successfully is returned along with the error.
+//
+// Go templates cannot be interrupted mid-execution, so cancellation is checked
+// between template executions. A cancelled render returns ctx.Err() along
+// with the output of the templates rendered before the cancellation.
+func (e *Engine) RenderAllChartTemplatesContext(ctx context.Context, chrt *chart.Chart, values releasevalues.Values) (map[string]string, error) {
+	result, err := e.Render(ctx, chrt, values)
+	return result.Manifests, err
+}
+
+// RenderResult is the outcome of rendering a chart.
+type RenderResult struct {
+	// Manifests maps the full path of each rendered template to its output.
+	Manifests map[string]string
+	// Warnings are problems found during rendering that did not fail it.
+	Warnings []string
+	// Partials maps the full path of each partial to its source. Only set
+	// with WithIncludePartials.
+	Partials map[string]string
+	// Errors maps the full path of each template that failed to render to its
+	// error. These templates are missing from Manifests.
+	Errors map[string]error
+	// HostCalls counts the calls made to each method of the HostFunctions
+	// during the render, by method name (e.g. "LookupKubernetesResource").
+	HostCalls map[string]int
+	// ChartGroups maps the full path of each chart (e.g. "parent/charts/sub")
+	// to the sorted filenames of its manifests. Only set with WithGroupByChart.
+	ChartGroups map[string][]string
+	// RenderedBytes is the total size of the output of all templates, before
+	// post-rendering, and PeakTemplateBytes the size of the largest one. They
+	// indicate how much memory a render of the chart needs.
+	RenderedBytes     int
+	PeakTemplateBytes int
+	// Stats summarizes what the render did.
+	Stats RenderStats
+	// Kustomization is a kustomization.yaml listing the manifests holding a
+	// resource, to be written to its full path KustomizationFile. It is not
+	// one of the Manifests. Only set with WithKustomization.
+	KustomizationFile string
+	Kustomization     string
+}
+
+// RenderStats counts the templates handled by a render.
+type RenderStats struct {
+	// Parsed is the number of templates parsed.
+	Parsed int
+	// Rendered is the number of templates rendered successfully, of which
+	// Empty rendered only whitespace.
+	Rendered int
+	Empty    int
+	// Skipped is the number of templates not rendered: partials, and the
+	// templates of library charts or without content.
+	Skipped int
+	// Duration is the time the render took.
+	Duration time.Duration
+}
+
+// String returns a one-line summary of the render, e.g. "parsed 12 templates,
+// rendered 8 (3 empty), skipped 4 in 15ms".
+func (s RenderStats) String() string {
+	return fmt.Sprintf("parsed %d templates, rendered %d (%d empty), skipped %d in %s", s.Parsed, s.Rendered, s.Empty, s.Skipped, s.Duration)
+}
+
+// Render renders all templates of a chart like RenderAllChartTemplatesContext,
+// additionally reporting the warnings collected during rendering.
+//
+// A RenderResult is returned even when rendering fails. If only some
+// templates failed, its Manifests hold the output of the others.
+func (e *Engine) Render(ctx context.Context, chrt *chart.Chart, values releasevalues.Values) (*RenderResult, error) {
+	if e.resultCache == nil || e.options.ValuesLookup != nil || e.options.ValuesDump != nil || e.options.ExecutionTrace != nil {
+		return e.newRender(ctx).render(ctx, chrt, values)
+	}
+
+	key, cacheable := resultCacheKey(chrt, values)
+	if cacheable {
+		if result, ok := e.resultCache.get(key); ok {
+			return result, nil
+		}
+	}
+	result, err := e.newRender(ctx).render(ctx, chrt, values)
+	if err == nil && cacheable {
+		e.resultCache.add(key, result)
+	}
+	return result, err
+}
+
+// render implements Render on a per-render copy of the engine.
+func (e *Engine) render(ctx context.Context, chrt *chart.Chart, values releasevalues.Values) (*RenderResult, error) {
+	start := time.Now()
+	if e.options.ValuesLookup != nil {
+		var err error
+		if values, err = e.mergeLookupValues(values); err != nil {
+			return &RenderResult{}, err
+		}
+	}
+	values, err := coalesceChartValues(chrt, values)
+	if err != nil {
+		return &RenderResult{}, err
+	}
+	if e.options.ValueInterpolation {
+		if values, err = interpolateValues(values); err != nil {
+			return &RenderResult{}, err
+		}
+	}
+	if len(e.options.RequiredValuePaths) > 0 {
+		if err := checkRequiredValuePaths(values, e.options.RequiredValuePaths); err != nil {
+			return &RenderResult{}, err
+		}
+	}
+	values = e.prepareCapabilities(values)
+	values = e.prepareRelease(values)
+
+	tmap := e.allTemplates(chrt, values)
+	manifests, err := e.renderTemplates(ctx, tmap)
+	if err == nil {
+		err = e.postRender(manifests, e.templatePath(chrt))
+	}
+	if e.trace != nil {
+		if traceErr := e.trace.write(e.options.ExecutionTrace); traceErr != nil {
+			e.warn("failed to write execution trace: %s", traceErr)
+		}
+	}
+
+	if e.options.WarningsAsErrors && len(e.warnings) > 0 {
+		errs := []error{err}
+		for _, w := range e.warnings {
+			errs = append(errs, fmt.Errorf("warning treated as error: %s", w))
+		}
+		err = errors.Join(errs...)
+	}
+
+	result := &RenderResult{
+		Manifests: manifests,
+		Warnings:  e.warnings,
+		Errors:    e.templateErrors,
+		HostCalls: e.hostCalls,
+
+		RenderedBytes:     e.renderedBytes,
+		PeakTemplateBytes: e.peakTemplateBytes,
+		Stats:             e.stats,
+	}
+	if e.options.Kustomization {
+		result.KustomizationFile = path.Join(e.templatePath(chrt), kustomizationFileName)
+		result.Kustomization = e.kustomization
+	}
+	result.Stats.Duration = time.Since(start)
+	if e.options.IncludePartials {
+		result.Partials = map[string]string{}
+		for filename, r := range tmap {
+			if strings.HasPrefix(path.Base(filename), "_") {
+				result.Partials[filename] = r.tpl
+			}
+		}
+	}
+	if e.options.GroupByChart {
+		result.ChartGroups = groupByChart(tmap, manifests)
+	}
+	return result, err
+}
+
+// groupByChart returns the filenames of the manifests grouped by the full path
+// of their chart, taken from the base path recorded by recAllTpls.
+func groupByChart(tmap map[string]renderable, manifests map[string]string) map[string][]string {
+	groups := map[string][]string{}
+	for filename := range manifests {
+		r, ok := tmap[filename]
+		if !ok {
+			continue
+		}
+		chartPath := path.Dir(r.basePath)
+		groups[chartPath] = append(groups[chartPath], filename)
+	}
+	for _, filenames := range groups {
+		sort.Strings(filenames)
+	}
+	return groups
+}
+
+// mergeLookupValues returns a shallow copy of the render values with the
+// values loaded from the cluster (see WithValuesFromLookup) merged under
+// .Values.
+func (e *Engine) mergeLookupValues(vals releasevalues.Values) (releasevalues.Values, error) {
+	l := e.options.ValuesLookup
+
+	obj, err := e.hostFunctions.LookupKubernetesResource(l.APIVersion, l.Kind, l.Namespace, l.Name)
+	if err != nil {
+		return vals, fmt.Errorf("failed to look up values from %s %s/%s: %w", l.Kind, l.Namespace, l.Name, err)
+	}
+	data, _ := obj["data"].(map[string]interface{})
+	doc, ok := data[l.Key].(string)
+	if !ok {
+		return vals, nil
+	}
+
+	base, err := releasevalues.ReadValues([]byte(doc))
+	if err != nil {
+		return vals, fmt.Errorf("failed to parse values from key %q of %s %s/%s: %w", l.Key, l.Kind, l.Namespace, l.Name, err)
+	}
+
+	supplied, _ := vals.Table("Values")
+	out := make(releasevalues.Values, len(vals))
+	for k, v := range vals {
+		out[k] = v
+	}
+	out["Values"] = base.Merge(supplied)
+	return out, nil
+}
+
+// coalesceChartValues returns a shallow copy of the render values with the
+// values.yaml defaults of the chart and its subcharts coalesced under
+// .Values. As in Helm, a null in the supplied values removes the default
+// rather than overriding it.
+func coalesceChartValues(chrt *chart.Chart, vals releasevalues.Values) (releasevalues.Values, error) {
+	supplied, _ := vals.Table("Values")
+	coalesced, err := release.CoalesceValues(chrt, supplied)
+	if err != nil {
+		return vals, fmt.Errorf("failed to coalesce chart values: %w", err)
+	}
+
+	out := make(releasevalues.Values, len(vals))
+	for k, v := range vals {
+		out[k] = v
+	}
+	out["Values"] = coalesced
+	return out, nil
+}
+
+// interpolateValues returns a shallow copy of the render values with the
+// references within .Values resolved.
+func interpolateValues(vals releasevalues.Values) (releasevalues.Values, error) {
+	chartValues, _ := vals.Table("Values")
+	interpolated, err := releasevalues.InterpolateValues(chartValues)
+	if err != nil {
+		return vals, fmt.Errorf("failed to interpolate values: %w", err)
 	}
 
-	errs := []error{}
-	for _, o := range options {
-		err := o(&e)
+	out := make(releasevalues.Values, len(vals))
+	for k, v := range vals {
+		out[k] = v
+	}
+	out["Values"] = interpolated
+	return out, nil
+}
+
+// checkRequiredValuePaths returns an error listing the paths that are missing
+// or empty in the values of the root chart, already coalesced with its
+// defaults.
+func checkRequiredValuePaths(vals releasevalues.Values, paths []string) error {
+	chartValues, _ := vals.Table("Values")
+
+	var errs []error
+	for _, p := range paths {
+		v, err := chartValues.PathValue(p)
 		if err != nil {
-			errs = append(errs, err)
+			// PathValue does not return tables
+			if t, tableErr := chartValues.Table(p); tableErr == nil {
+				v, err = t, nil
+			}
+		}
+		if err != nil || isEmptyValue(v) {
+			errs = append(errs, fmt.Errorf("required value %q is missing or empty", p))
 		}
 	}
-	if err := errors.Join(errs...); err != nil {
-		return nil, fmt.Errorf("error creating engine: %w", err)
+	if len(errs) > 0 {
+		return fmt.Errorf("values validation failed: %w", errors.Join(errs...))
 	}
+	return nil
+}
 
-	e.goTemplate = template.New("gotpl")
-	if e.options.Strict {
-		e.goTemplate.Option("missingkey=error")
-	} else {
-		// Not that zero will attempt to add default values for types it knows,
-		// but will still emit <no value> for others. We mitigate that later.
-		e.goTemplate.Option("missingkey=zero")
+// isEmptyValue reports whether v is nil, an empty string or an empty
+// collection.
+func isEmptyValue(v interface{}) bool {
+	if v == nil {
+		return true
 	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Map, reflect.Slice, reflect.Array:
+		return rv.Len() == 0
+	}
+	return false
+}
 
-	e.initFunMap()
-
-	return &e, nil
+// warn records a warning for the current render.
+func (e *Engine) warn(format string, args ...interface{}) {
+	e.warnings = append(e.warnings, fmt.Sprintf(format, args...))
 }
 
-// Render takes a chart, optional values, and value overrides, and attempts to render the Go templates.
-//
-// Render can be called repeatedly on the same engine.
-//
-// This will look in the chart's 'templates' data (e.g. the 'templates/' directory)
-// and attempt to render the templates there using the values passed in.
-//
-// Values are scoped to their templates. A dependency template will not have
-// access to the values set for its parent. If chart "foo" includes chart "bar",
-// "bar" will not have access to the vil.es for "foo".
-//
-// Values should be prepared with something like `chartutils.ReadValues`.
-//
-// Values are passed through the templates according to scope. If the top layer
-// chart includes the chart foo, which includes the chart bar, the values map
-// will be examined for a table called "foo". If "foo" is found in vals,
-// that section of the values will be passed into the "foo" chart. And if that
-// section contains a value named "bar", that value will be passed on to the
-// bar chart during render time.
-func (e *Engine) RenderAllChartTemplates(chrt *chart.Chart, values releasevalues.Values) (map[string]string, error) {
-	tmap := allTemplates(chrt, values)
-	return e.renderTemplates(tmap)
+// lintFail returns msg as the error of a template function validating values,
+// or records it as a warning and returns nil in lint mode, like 'required'.
+func (e *Engine) lintFail(msg string) error {
+	if e.options.LintMode {
+		e.warn("%s", msg)
+		return nil
+	}
+	return fmt.Errorf("%s", warnWrap(msg))
 }
 
 // renderable is an object that can be rendered.
@@ -160,7 +1120,17 @@ func warnWrap(warn string) string {
 
 // 'include' needs to be defined in the scope of a 'tpl' template as
 // well as regular file-loaded templates.
+//
+// includedNames counts the nesting of each included template, to fail on
+// runaway recursion. If it is nil, the recursion is not guarded.
 func includeFun(goTemplate *template.Template, includedNames map[string]int) func(string, interface{}) (string, error) {
+	if includedNames == nil {
+		return func(name string, data interface{}) (string, error) {
+			var buf strings.Builder
+			err := goTemplate.ExecuteTemplate(&buf, name, data)
+			return buf.String(), err
+		}
+	}
 	return func(name string, data interface{}) (string, error) {
 		var buf strings.Builder
 		if v, ok := includedNames[name]; ok {
@@ -177,10 +1147,77 @@ func includeFun(goTemplate *template.Template, includedNames map[string]int) fun
 	}
 }
 
+// 'includeB64' renders a template like 'include' and returns the output base64
+// encoded, e.g. to embed a rendered configuration file in a Secret.
+func includeB64Fun(include func(string, interface{}) (string, error)) func(string, interface{}) (string, error) {
+	return func(name string, data interface{}) (string, error) {
+		out, err := include(name, data)
+		if err != nil {
+			return "", err
+		}
+		// See comment in renderWithReferences explaining the <no value> hack.
+		out = strings.ReplaceAll(out, "<no value>", "")
+		return base64.StdEncoding.EncodeToString([]byte(out)), nil
+	}
+}
+
+// 'includeIfPresent' renders a template like 'include', but returns an empty
+// string if the output is only whitespace, so that the caller can omit the
+// enclosing YAML key:
+//
+//	{{- with includeIfPresent "app.annotations" . }}
+//	annotations:
+//	  {{- . | nindent 2 }}
+//	{{- end }}
+func includeIfPresentFun(include func(string, interface{}) (string, error)) func(string, interface{}) (string, error) {
+	return func(name string, data interface{}) (string, error) {
+		out, err := include(name, data)
+		if err != nil {
+			return "", err
+		}
+		// See comment in renderWithReferences explaining the <no value> hack.
+		out = strings.ReplaceAll(out, "<no value>", "")
+		if strings.TrimSpace(out) == "" {
+			return "", nil
+		}
+		return out, nil
+	}
+}
+
+// 'includeYaml' renders a template like 'include' and parses the output as
+// YAML, so that the caller can navigate the result rather than treating it as
+// an opaque string:
+//
+//	{{ (includeYaml "app.containers" .).containers | len }}
+//
+// Unlike 'fromYaml', output that is not valid YAML is an error.
+func includeYamlFun(include func(string, interface{}) (string, error)) func(string, interface{}) (interface{}, error) {
+	return func(name string, data interface{}) (interface{}, error) {
+		out, err := include(name, data)
+		if err != nil {
+			return nil, err
+		}
+		// See comment in renderWithReferences explaining the <no value> hack.
+		out = strings.ReplaceAll(out, "<no value>", "")
+		var v interface{}
+		if err := yaml.Unmarshal([]byte(out), &v); err != nil {
+			return nil, fmt.Errorf("includeYaml: output of template %q is not valid YAML: %w", name, err)
+		}
+		return v, nil
+	}
+}
+
 // As does 'tpl', so that nested calls to 'tpl' see the templates
 // defined by their enclosing contexts.
-func tplFun(parent *template.Template, includedNames map[string]int, strict bool) func(string, interface{}) (string, error) {
+//
+// The snippet is executed with vals as its dot. If vals is a map, the top-level
+// objects of the enclosing render context (.Chart, .Release, .Template, etc.)
+// which it does not define are added, so that a snippet rendered against e.g.
+// .Values can still reach them.
+func (e *Engine) tplFun(parent *template.Template, includedNames map[string]int) func(string, interface{}) (string, error) {
 	return func(tpl string, vals interface{}) (string, error) {
+		vals = withRenderContext(vals, e.renderContext)
+
 		t, err := parent.Clone()
 		if err != nil {
 			return "", fmt.Errorf("cannot clone template: %w", err)
@@ -188,19 +1225,18 @@ func tplFun(parent *template.Template, includedNames map[string]int, strict bool
 
 		// Re-inject the missingkey option, see text/template issue https://github.com/golang/go/issues/43022
 		// We have to go by strict from our engine configuration, as the option fields are private in Template.
-		// TODO: Remove workaround (and the strict parameter) once we build only with golang versions with a fix.
-		if strict {
+		// TODO: Remove workaround once we build only with golang versions with a fix.
+		if e.options.Strict {
 			t.Option("missingkey=error")
 		} else {
 			t.Option("missingkey=zero")
 		}
 
-		// Re-inject 'include' so that it can close over our clone of t;
-		// this lets any 'define's inside tpl be 'include'd.
-		t.Funcs(template.FuncMap{
-			"include": includeFun(t, includedNames),
-			"tpl":     tplFun(t, includedNames, strict),
-		})
+		// Re-inject 'include' and the like so that they can close over our
+		// clone of t; this lets any 'define's inside tpl be 'include'd.
+		funcMap := e.templateFuncs(t, includedNames)
+		e.deprecateFuncs(funcMap)
+		t.Funcs(funcMap)
 
 		// We need a .New template, as template text which is just blanks
 		// or comments after parsing out defines just adds new named
@@ -219,25 +1255,144 @@ func tplFun(parent *template.Template, includedNames map[string]int, strict bool
 		}
 
 		// See comment in renderWithReferences explaining the <no value> hack.
-		return strings.ReplaceAll(buf.String(), "<no value>", ""), nil
+		return strings.ReplaceAll(buf.String(), "<no value>", e.options.MissingKeySentinel), nil
+	}
+}
+
+// templateFuncs returns the template functions which execute the templates of
+// t, like 'include' and 'tpl'. Each 'tpl' call binds them to its own clone of
+// t.
+func (e *Engine) templateFuncs(t *template.Template, includedNames map[string]int) template.FuncMap {
+	include := includeFun(t, includedNames)
+	if e.trace != nil {
+		include = e.trace.traceInclude(include)
+	}
+	tpl := e.tplFun(t, includedNames)
+	if e.trace != nil {
+		untraced := tpl
+		tpl = func(text string, vals interface{}) (string, error) {
+			defer e.trace.record("tpl", time.Now())
+			return untraced(text, vals)
+		}
+	}
+
+	return template.FuncMap{
+		"include":          include,
+		"includeB64":       includeB64Fun(include),
+		"includeIfPresent": includeIfPresentFun(include),
+		"includeYaml":      includeYamlFun(include),
+		"configChecksum": configChecksumFun(include, func() releasevalues.Values {
+			return e.renderContext
+		}),
+		"tpl": tpl,
+	}
+}
+
+// 'configChecksum' renders a template of the current chart, named relative to
+// its templates directory, in the current render context and returns the
+// sha256 of the output. Used to annotate workloads so that they roll out when
+// e.g. a ConfigMap changes:
+//
+//	checksum/config: {{ configChecksum "configmap.yaml" }}
+func configChecksumFun(include func(string, interface{}) (string, error), renderContext func() releasevalues.Values) func(string) (string, error) {
+	return func(name string) (string, error) {
+		vals := renderContext()
+
+		basePath := ""
+		if t, err := vals.Table("Template"); err == nil {
+			basePath, _ = t["BasePath"].(string)
+		}
+
+		out, err := include(path.Join(basePath, name), vals)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(out))), nil
+	}
+}
+
+// withRenderContext returns vals extended with the top-level objects of the
+// render context that it does not define itself. Values other than maps are
+// returned unchanged.
+func withRenderContext(vals interface{}, renderContext releasevalues.Values) interface{} {
+	var m map[string]interface{}
+	switch vv := vals.(type) {
+	case map[string]interface{}:
+		m = vv
+	case releasevalues.Values:
+		m = vv
+	default:
+		return vals
+	}
+
+	missing := false
+	for k := range renderContext {
+		if _, ok := m[k]; !ok {
+			missing = true
+			break
+		}
 	}
+	if !missing {
+		return vals
+	}
+
+	out := make(map[string]interface{}, len(m)+len(renderContext))
+	for k, v := range renderContext {
+		out[k] = v
+	}
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
 }
 
 // initFunMap creates the Engine's FuncMap and adds context-specific functions.
 func (e *Engine) initFunMap() {
 	funcMap := funcMap()
-	includedNames := make(map[string]int)
+	var includedNames map[string]int
+	if !e.options.NoRecursionGuard {
+		includedNames = make(map[string]int)
+	}
 
 	// Add the template-rendering functions here so we can close over t.
-	funcMap["include"] = includeFun(e.goTemplate, includedNames)
-	funcMap["tpl"] = tplFun(e.goTemplate, includedNames, e.options.Strict)
-
+	for name, fn := range e.templateFuncs(e.goTemplate, includedNames) {
+		funcMap[name] = fn
+	}
+	// 'subchartNames' lists the subcharts of the chart being rendered, which
+	// excludes those disabled by conditions or tags.
+	funcMap["subchartNames"] = func() []string {
+		subcharts, _ := e.renderContext["Subcharts"].(map[string]interface{})
+		names := make([]string, 0, len(subcharts))
+		for name := range subcharts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	// 'envValue' looks up a dotted path of the .Values of the chart being
+	// rendered under .Values.environments.<env> first, falling back to the
+	// path itself, or nil if neither is set:
+	//
+	//	replicas: {{ envValue .Values.environment "replicas" | default 1 }}
+	funcMap["envValue"] = func(env string, key string) interface{} {
+		vals, _ := e.renderContext.Table("Values")
+		if v := vals.Get(releasevalues.JoinPath("environments", env)+"."+key, nil); v != nil {
+			return v
+		}
+		return vals.Get(key, nil)
+	}
+	// 'filesList' lists the paths of the files of the chart being rendered
+	// matching a glob pattern, like .Files.Glob but without their contents.
+	funcMap["filesList"] = func(pattern string) []string {
+		f, _ := e.renderContext["Files"].(files)
+		return f.Glob(pattern).Names()
+	}
 	// Add the `required` function here so we can use lintMode
 	funcMap["required"] = func(warn string, val interface{}) (interface{}, error) {
 		if val == nil {
 			if e.options.LintMode {
 				// Don't fail on missing required values when linting
-				log.Printf("[INFO] Missing required value: %s", warn)
+				e.warn("Missing required value: %s", warn)
 				return "", nil
 			}
 			return val, fmt.Errorf("%s", warnWrap(warn))
@@ -245,7 +1400,7 @@ func (e *Engine) initFunMap() {
 			if val == "" {
 				if e.options.LintMode {
 					// Don't fail on missing required values when linting
-					log.Printf("[INFO] Missing required value: %s", warn)
+					e.warn("Missing required value: %s", warn)
 					return "", nil
 				}
 				return val, fmt.Errorf("%s", warnWrap(warn))
@@ -258,16 +1413,131 @@ func (e *Engine) initFunMap() {
 	funcMap["fail"] = func(msg string) (string, error) {
 		if e.options.LintMode {
 			// Don't fail when linting
-			log.Printf("[INFO] Fail: %s", msg)
+			e.warn("Fail: %s", msg)
 			return "", nil
 		}
 		return "", fmt.Errorf("%s", warnWrap(msg))
 	}
 
+	// 'requireAPIVersion' fails the render if the cluster lacks an API version
+	// (e.g. "batch/v1" or "batch/v1/CronJob").
+	funcMap["requireAPIVersion"] = func(apiVersion string) (string, error) {
+		if apiVersionsOf(e.renderContext).Has(apiVersion) {
+			return "", nil
+		}
+		return "", e.lintFail(fmt.Sprintf("API version %q is not available in the cluster", apiVersion))
+	}
+
+	// 'mustPort' returns a value as a port number, failing unless it is an
+	// integer within 1-65535.
+	//
+	//	port: {{ mustPort .Values.service.port }}
+	funcMap["mustPort"] = func(v interface{}) (int, error) {
+		port, err := parsePort(v)
+		if err == nil {
+			return port, nil
+		}
+		return 0, e.lintFail(err.Error())
+	}
+
+	// 'mutuallyExclusive' returns the one non-empty value of the given values,
+	// or nil if none is set, failing with message if more than one is set.
+	//
+	//	{{ mutuallyExclusive "set either existingSecret or password" .Values.existingSecret .Values.password }}
+	funcMap["mutuallyExclusive"] = func(msg string, vals ...interface{}) (interface{}, error) {
+		var set interface{}
+		count := 0
+		for _, v := range vals {
+			if !isEmptyValue(v) {
+				set = v
+				count++
+			}
+		}
+		if count <= 1 {
+			return set, nil
+		}
+		return nil, e.lintFail(msg)
+	}
+
+	// 'mustName' returns name unchanged, failing unless it is a valid DNS-1123
+	// label (see 'normalizeName').
+	funcMap["mustName"] = func(name string) (string, error) {
+		err := checkName(name)
+		if err == nil {
+			return name, nil
+		}
+		return name, e.lintFail(err.Error())
+	}
+
+	// 'resourcePreset' returns the requests and limits of a named preset of
+	// container resources, see WithResourcePresets.
+	//
+	//	resources: {{ resourcePreset .Values.size | toYaml | nindent 2 }}
+	funcMap["resourcePreset"] = func(name string) (map[string]interface{}, error) {
+		presets := e.options.ResourcePresets
+		if presets == nil {
+			presets = defaultResourcePresets
+		}
+		resources, ok := presets[name]
+		if !ok {
+			names := make([]string, 0, len(presets))
+			for n := range presets {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown resource preset %q, expected one of %s", name, strings.Join(names, ", "))
+		}
+		return resources.DeepCopy(), nil
+	}
+
+	// 'mustEnum' returns value unchanged, failing unless it is one of the
+	// allowed strings.
+	//
+	//	type: {{ mustEnum .Values.strategy "RollingUpdate" "Recreate" }}
+	funcMap["mustEnum"] = func(value interface{}, allowed ...string) (interface{}, error) {
+		if s, ok := value.(string); ok {
+			for _, a := range allowed {
+				if s == a {
+					return value, nil
+				}
+			}
+		}
+		return value, e.lintFail(fmt.Sprintf("value %q is not one of %s", toString(value), strings.Join(allowed, ", ")))
+	}
+
+	// 'isLintMode' lets templates skip blocks which are expensive or need a
+	// cluster while linting.
+	funcMap["isLintMode"] = func() bool {
+		return e.options.LintMode
+	}
+
+	// 'kubeVersionAtLeast' compares the Kubernetes version of the Capabilities
+	// being rendered against a minimum version.
+	funcMap["kubeVersionAtLeast"] = func(minimum string) (bool, error) {
+		return kubeVersionAtLeast(e.renderContext, minimum)
+	}
+
+	// 'revisionSuffix' formats the release revision as a short suffix for
+	// revision-scoped names, e.g. in blue/green deployments.
+	//
+	//	name: {{ .Release.Name }}-{{ revisionSuffix }}
+	funcMap["revisionSuffix"] = func() string {
+		return fmt.Sprintf("r%d", releaseFromValues(e.renderContext["Release"]).Revision)
+	}
+
 	// If we are not linting and have a cluster connection, provide a Kubernetes-backed
 	// implementation.
 	if !e.options.LintMode {
-		funcMap["lookup"] = e.hostFunctions.LookupKubernetesResource
+		lookup := func(apiVersion string, kind string, namespace string, name string) (map[string]interface{}, error) {
+			if namespace != "" && isClusterScoped(kind) {
+				// A namespace must not scope the query of a cluster-scoped resource.
+				e.warn("lookup of cluster-scoped %s %q: ignoring namespace %q", kind, name, namespace)
+				namespace = ""
+			}
+			return e.hostFunctions.LookupKubernetesResource(apiVersion, kind, namespace, name)
+		}
+		funcMap["lookup"] = lookup
+		funcMap["lookupSecretData"] = lookupSecretData(lookup)
 	}
 
 	funcMap["getHostByName"] = func() func(string) string {
@@ -283,44 +1553,147 @@ func (e *Engine) initFunMap() {
 
 	}()
 
+	funcMap["resolveSecret"] = func(ref string) (string, error) {
+		// When secrets are not enabled return an empty string.
+		if !e.options.EnableSecrets {
+			return "", nil
+		}
+
+		secret, err := e.hostFunctions.ResolveSecret(ref)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve secret %q: %w", ref, err)
+		}
+		return secret, nil
+	}
+
+	funcMap["imageDigest"] = func(ref string) (string, error) {
+		// When image resolution is not enabled return the reference as is.
+		if !e.options.EnableImages {
+			return ref, nil
+		}
+
+		pinned, err := e.hostFunctions.ResolveImageDigest(ref)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve digest of image %q: %w", ref, err)
+		}
+		return pinned, nil
+	}
+
+	e.deprecateFuncs(funcMap)
+
 	e.goTemplate.Funcs(funcMap)
 }
 
+// deprecateFuncs wraps the functions of funcMap which are deprecated with
+// deprecatedFun.
+func (e *Engine) deprecateFuncs(funcMap template.FuncMap) {
+	for _, name := range e.options.DeprecatedFunctions {
+		if fn, ok := funcMap[name]; ok {
+			funcMap[name] = e.deprecatedFun(name, fn)
+		}
+	}
+}
+
+// deprecatedFun wraps the template function fn, named name, to warn or fail
+// when a template calls it (see WithDeprecatedFunctions). Each template is
+// warned about once per function.
+func (e *Engine) deprecatedFun(name string, fn interface{}) interface{} {
+	v := reflect.ValueOf(fn)
+	return reflect.MakeFunc(v.Type(), func(args []reflect.Value) []reflect.Value {
+		filename := ""
+		if tpl, ok := e.renderContext["Template"].(releasevalues.Values); ok {
+			filename, _ = tpl["Name"].(string)
+		}
+		msg := fmt.Sprintf("%s: function %q is deprecated", filename, name)
+		if e.options.FailOnDeprecated {
+			// text/template turns panics in functions into execution errors,
+			// which lets this fail functions that do not return an error.
+			panic(errors.New(warnWrap(msg)))
+		}
+		if !e.deprecationWarned[msg] {
+			e.deprecationWarned[msg] = true
+			e.warn("%s", msg)
+		}
+		if v.Type().IsVariadic() {
+			return v.CallSlice(args)
+		}
+		return v.Call(args)
+	}).Interface()
+}
+
 // render takes a map of templates/values and renders them.
-func (e *Engine) renderTemplates(tpls map[string]renderable) (map[string]string, error) {
+func (e *Engine) renderTemplates(ctx context.Context, tpls map[string]renderable) (map[string]string, error) {
 	// We want to parse the templates in a predictable order. The order favors
 	// higher-level (in file system) templates over deeply nested templates.
 	keys := sortTemplates(tpls)
+	results := make(map[string]string, len(keys))
 
-	for _, filename := range keys {
-		r := tpls[filename]
-		if _, err := e.goTemplate.New(filename).Parse(r.tpl); err != nil {
-			return map[string]string{}, cleanupParseError(filename, err)
+	if !e.prepared {
+		if err := e.parseTemplates(keys, tpls); err != nil {
+			return results, err
 		}
 	}
 
-	results := make(map[string]string, len(keys))
+	e.stats.Parsed = len(keys)
 
-	errs := make([]error, len(tpls))
+	var errs []error
 	for _, filename := range keys {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
 		// Don't render partials. We don't care out the direct output of partials.
 		// They are only included from other templates.
-		if strings.HasPrefix(path.Base(filename), "_") {
+		if strings.HasPrefix(path.Base(filename), "_") && !e.options.IncludePartials {
+			e.stats.Skipped++
 			continue
 		}
 
-		r := tpls[filename]
-		rendered, err := e.renderTemplate(filename, r)
+		// Templates may already have failed checks while being collected
+		var rendered string
+		err, failed := e.templateErrors[filename]
+		if !failed {
+			rendered, err = e.renderTemplate(filename, tpls[filename])
+		}
 		if err != nil {
+			// Failed templates are left out of the results, so that the
+			// output of the successful ones can still be inspected.
+			e.templateErrors[filename] = err
+			if e.options.FailFast || errors.Is(err, errMaxOutputSize) {
+				return results, err
+			}
 			errs = append(errs, err)
+			continue
 		}
 
 		results[filename] = rendered
+		e.stats.Rendered++
+		if strings.TrimSpace(rendered) == "" {
+			e.stats.Empty++
+		}
 	}
 
 	return results, errors.Join(errs...)
 }
 
+// parseTemplates parses the templates into the template set in the order of
+// keys, so that later definitions of a named template replace earlier ones.
+func (e *Engine) parseTemplates(keys []string, tpls map[string]renderable) error {
+	if e.options.DefineCollisions {
+		if err := checkDefineCollisions(keys, tpls); err != nil {
+			return err
+		}
+	}
+
+	for _, filename := range keys {
+		r := tpls[filename]
+		if _, err := e.goTemplate.New(filename).Parse(r.tpl); err != nil {
+			return cleanupParseError(filename, err)
+		}
+	}
+	return nil
+}
+
 // render takes a map of templates/values and renders them.
 func (e *Engine) renderTemplate(filename string, renderable renderable) (result string, err error) {
 	// Basically, what we do here is start with an empty parent template and then
@@ -337,21 +1710,114 @@ func (e *Engine) renderTemplate(filename string, renderable renderable) (result
 	}()
 
 	// At render time, add information about the template that is being rendered.
-	vals := renderable.vals
+	// The values of a chart scope are shared by its templates, so each gets its
+	// own copy to add its Template to.
+	vals := make(releasevalues.Values, len(renderable.vals)+1)
+	for k, v := range renderable.vals {
+		vals[k] = v
+	}
 	vals["Template"] = releasevalues.Values{"Name": filename, "BasePath": renderable.basePath}
+	e.renderContext = vals
 	var buf strings.Builder
-	if err := e.goTemplate.ExecuteTemplate(&buf, filename, vals); err != nil {
+	var w io.Writer = &buf
+	if e.options.MaxOutputSize > 0 {
+		w = &limitedWriter{w: &buf, remaining: e.options.MaxOutputSize - e.renderedBytes}
+	}
+	start := time.Now()
+	err = e.goTemplate.ExecuteTemplate(w, filename, vals)
+	if e.trace != nil {
+		e.trace.record(filename, start)
+	}
+	e.renderedBytes += buf.Len()
+	e.peakTemplateBytes = max(e.peakTemplateBytes, buf.Len())
+	if errors.Is(err, errMaxOutputSize) {
+		return "", fmt.Errorf("rendering %s: %w of %d bytes", filename, errMaxOutputSize, e.options.MaxOutputSize)
+	}
+	if err != nil {
 		return "", cleanupExecError(filename, err)
 	}
 
 	// Work around the issue where Go will emit "<no value>" even if Options(missing=zero)
 	// is set. Since missing=error will never get here, we do not need to handle
-	// the Strict case.
-	result = strings.ReplaceAll(buf.String(), "<no value>", "")
+	// the Strict case. The output is stripped unless WithMissingKeySentinel
+	// sets what to replace it with.
+	result = strings.ReplaceAll(buf.String(), "<no value>", e.options.MissingKeySentinel)
+
+	if e.options.TabDetection && path.Base(filename) != releaseutil.NotesFileName {
+		if err := checkTabIndentation(filename, result); err != nil {
+			return "", err
+		}
+	}
 
 	return
 }
 
+// errMaxOutputSize is returned when the rendered output exceeds the size set
+// by WithMaxOutputSize.
+var errMaxOutputSize = errors.New("rendered output exceeds the maximum size")
+
+// limitedWriter writes to w until remaining bytes have been written, failing
+// with errMaxOutputSize thereafter.
+type limitedWriter struct {
+	w         io.Writer
+	remaining int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.remaining {
+		n, err := l.w.Write(p[:max(l.remaining, 0)])
+		l.remaining -= n
+		if err == nil {
+			err = errMaxOutputSize
+		}
+		return n, err
+	}
+	n, err := l.w.Write(p)
+	l.remaining -= n
+	return n, err
+}
+
+// checkTabIndentation returns an error naming the first line of the rendered
+// template that is indented with a tab.
+//
+// Tabs within the content of a block scalar ("|" or ">") are not indentation,
+// once its first line has established the indentation of the block with
+// spaces, so e.g. an embedded Makefile passes.
+func checkTabIndentation(filename string, rendered string) error {
+	inBlock := false
+	// parentIndent is the indentation of the line starting the block scalar,
+	// and blockIndent that of its content, or -1 until its first line
+	parentIndent, blockIndent := 0, -1
+	for i, line := range strings.Split(rendered, "\n") {
+		spaces := len(line) - len(strings.TrimLeft(line, " "))
+		if inBlock {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if blockIndent < 0 && spaces > parentIndent {
+				blockIndent = spaces
+			}
+			if blockIndent >= 0 && spaces >= blockIndent {
+				continue
+			}
+			inBlock = false
+		}
+
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if strings.Contains(indent, "\t") {
+			return fmt.Errorf("%s:%d: line is indented with a tab, YAML requires spaces for indentation", filename, i+1)
+		}
+		if blockScalarRegex.MatchString(strings.TrimSpace(line)) {
+			inBlock, parentIndent, blockIndent = true, spaces, -1
+		}
+	}
+	return nil
+}
+
+// blockScalarRegex matches a line whose value starts a block scalar, e.g.
+// "data: |-" or "- >".
+var blockScalarRegex = regexp.MustCompile(`(?:^|:\s+|-\s+)[|>][1-9+-]*(?:\s+#.*)?$`)
+
 func cleanupParseError(filename string, err error) error {
 	tokens := strings.Split(err.Error(), ": ")
 	if len(tokens) == 1 {
@@ -363,7 +1829,7 @@ func cleanupParseError(filename string, err error) error {
 	location := tokens[1]
 	// The remaining tokens make up a stacktrace-like chain, ending with the relevant error
 	errMsg := tokens[len(tokens)-1]
-	return fmt.Errorf("parse error at (%s): %s", string(location), errMsg)
+	return newRenderError(location, fmt.Sprintf("parse error at (%s): %s", string(location), errMsg), err)
 }
 
 func cleanupExecError(filename string, err error) error {
@@ -383,10 +1849,10 @@ func cleanupExecError(filename string, err error) error {
 
 	parts := warnRegex.FindStringSubmatch(tokens[2])
 	if len(parts) >= 2 {
-		return fmt.Errorf("execution error at (%s): %s", string(location), parts[1])
+		return newRenderError(location, fmt.Sprintf("execution error at (%s): %s", string(location), parts[1]), err)
 	}
 
-	return err
+	return newRenderError(location, err.Error(), err)
 }
 
 func sortTemplates(tpls map[string]renderable) []string {
@@ -416,9 +1882,9 @@ func (p byPathLen) Less(i, j int) bool {
 // allTemplates returns all templates for a chart and its dependencies.
 //
 // As it goes, it also prepares the values in a scope-sensitive manner.
-func allTemplates(c *chart.Chart, vals releasevalues.Values) map[string]renderable {
+func (e *Engine) allTemplates(c *chart.Chart, vals releasevalues.Values) map[string]renderable {
 	templates := make(map[string]renderable)
-	recAllTpls(c, templates, vals)
+	e.recAllTpls(c, templates, vals)
 	return templates
 }
 
@@ -426,7 +1892,7 @@ func allTemplates(c *chart.Chart, vals releasevalues.Values) map[string]renderab
 //
 // As it recurses, it also sets the values to be appropriate for the template
 // scope.
-func recAllTpls(c *chart.Chart, templates map[string]renderable, vals releasevalues.Values) map[string]interface{} {
+func (e *Engine) recAllTpls(c *chart.Chart, templates map[string]renderable, vals releasevalues.Values) map[string]interface{} {
 	subCharts := make(map[string]interface{})
 	chartMetaData := struct {
 		chart.Metadata
@@ -443,25 +1909,59 @@ func recAllTpls(c *chart.Chart, templates map[string]renderable, vals releaseval
 	}
 
 	// If there is a {{.Values.ThisChart}} in the parent metadata,
-	// copy that into the {{.Values}} for this template.
-	if c.IsRoot() {
-		next["Values"] = vals["Values"]
-	} else if vs, err := vals.Table("Values." + c.Name()); err == nil {
-		next["Values"] = vs
+	// copy that into the {{.Values}} for this template. The parent's values are
+	// already scoped to the parent, so only this chart's name is looked up in
+	// them. The name is quoted as a path key so that names containing dots
+	// still resolve at any depth.
+	scoped := releasevalues.Values{}
+	if vs, err := vals.Table("Values"); err == nil {
+		if c.IsRoot() {
+			scoped = vs
+		} else if cvs, err := vs.Table(releasevalues.JoinPath(c.Name())); err == nil {
+			scoped = cvs
+		}
+	}
+
+	// The values.yaml defaults of every scope were coalesced under the
+	// supplied values by render.
+	next["Values"] = scoped
+	if override, ok := e.options.SubchartValues[c.ChartFullPath()]; ok {
+		next["Values"] = scoped.Merge(override)
+	}
+
+	if e.options.ValuesDump != nil {
+		e.dumpValues(c.ChartFullPath(), next["Values"].(releasevalues.Values))
 	}
 
-	for _, child := range c.Dependencies() {
-		subCharts[child.Name()] = recAllTpls(child, templates, next)
+	if !e.options.RootChartOnly {
+		for _, child := range c.Dependencies() {
+			subCharts[child.Name()] = e.recAllTpls(child, templates, next)
+		}
 	}
 
-	newParentID := c.ChartFullPath()
-	for _, t := range c.Templates {
+	newParentID := e.templatePath(c)
+	for i, t := range c.Templates {
+		// Nil or empty templates usually indicate a problem loading the chart.
 		if t == nil {
+			e.warn("chart %q: skipping template %d: template is nil", c.ChartFullPath(), i)
+			e.stats.Skipped++
+			continue
+		}
+		if len(t.Data) == 0 {
+			e.warn("chart %q: skipping template %d (%q): template is empty", c.ChartFullPath(), i, t.Name)
+			e.stats.Skipped++
 			continue
 		}
 		if !isTemplateValid(c, t.Name) {
+			// Library charts only provide partials, so a manifest template here
+			// is most likely a mistake by the chart author.
+			e.warn("library chart %q: skipping template %q: library charts may only contain partials (templates prefixed with '_')", c.ChartFullPath(), t.Name)
+			e.stats.Skipped++
 			continue
 		}
+		if e.options.StrictScope && !c.IsRoot() {
+			e.checkScopeIsolation(path.Join(newParentID, t.Name), t.Data, next, vals)
+		}
 		templates[path.Join(newParentID, t.Name)] = renderable{
 			tpl:      string(t.Data),
 			vals:     next,
@@ -472,6 +1972,82 @@ func recAllTpls(c *chart.Chart, templates map[string]renderable, vals releaseval
 	return next
 }
 
+// templatePath returns the path the templates of a chart are keyed under: the
+// full path of the chart, within the template namespace if one is set.
+func (e *Engine) templatePath(c *chart.Chart) string {
+	return path.Join(e.options.TemplateNamespace, c.ChartFullPath())
+}
+
+// checkScopeIsolation records an error for a subchart template referencing
+// values only set in the scope of its parent.
+func (e *Engine) checkScopeIsolation(filename string, data []byte, vals, parentVals releasevalues.Values) {
+	refs := map[string]struct{}{}
+	if err := collectValueReferences(filename, data, nil, refs); err != nil {
+		// Reported when the template is parsed for rendering
+		return
+	}
+
+	own, _ := vals.Table("Values")
+	parent, _ := parentVals.Table("Values")
+
+	var violations []string
+	for ref := range refs {
+		if releasevalues.ParsePath(ref)[0] == "global" {
+			continue
+		}
+		if own.Get(ref, nil) == nil && parent.Get(ref, nil) != nil {
+			violations = append(violations, ".Values."+ref)
+		}
+	}
+	if len(violations) > 0 {
+		sort.Strings(violations)
+		e.templateErrors[filename] = fmt.Errorf("%s: scope violation: %s only set in the scope of the parent chart", filename, strings.Join(violations, ", "))
+	}
+}
+
+// checkDefineCollisions returns an error naming both templates if a named
+// template is defined with differing bodies by two templates.
+func checkDefineCollisions(keys []string, tpls map[string]renderable) error {
+	type definition struct {
+		filename string
+		body     string
+	}
+	defined := map[string]definition{}
+
+	for _, filename := range keys {
+		t, err := template.New(filename).Funcs(funcMap()).Parse(tpls[filename].tpl)
+		if err != nil {
+			return cleanupParseError(filename, err)
+		}
+		for _, tt := range t.Templates() {
+			if tt.Name() == filename || tt.Tree == nil {
+				continue
+			}
+			body := tt.Tree.Root.String()
+			prev, ok := defined[tt.Name()]
+			if !ok {
+				defined[tt.Name()] = definition{filename, body}
+				continue
+			}
+			if prev.body != body {
+				return fmt.Errorf("template %q is defined differently in %s and %s", tt.Name(), prev.filename, filename)
+			}
+		}
+	}
+	return nil
+}
+
+// dumpValues writes the values of a chart scope to the values dump.
+func (e *Engine) dumpValues(chartPath string, vals releasevalues.Values) {
+	data, err := yaml.Marshal(vals)
+	if err == nil {
+		_, err = fmt.Fprintf(e.options.ValuesDump, "---\n# Chart: %s\n%s", chartPath, data)
+	}
+	if err != nil {
+		e.warn("failed to dump values of chart %q: %s", chartPath, err)
+	}
+}
+
 // isTemplateValid returns true if the template is valid for the chart type
 func isTemplateValid(ch *chart.Chart, templateName string) bool {
 	if isLibraryChart(ch) {
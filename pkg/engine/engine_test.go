@@ -0,0 +1,3274 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+
+	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/releasevalues"
+	chart "helm.sh/helm/v4/pkg/chart/v2"
+	chartutil "helm.sh/helm/v4/pkg/chart/v2/util"
+)
+
+type mockHostFunctions struct {
+	lookup             func(apiVersion string, kind string, namespace string, name string) (map[string]interface{}, error)
+	resolveSecret      func(ref string) (string, error)
+	resolveImageDigest func(ref string) (string, error)
+	fetchDependency    func(name, version, repository string) ([]byte, error)
+}
+
+func (m *mockHostFunctions) LookupKubernetesResource(apiVersion string, kind string, namespace string, name string) (map[string]interface{}, error) {
+	if m.lookup == nil {
+		return map[string]interface{}{}, nil
+	}
+	return m.lookup(apiVersion, kind, namespace, name)
+}
+
+func (m *mockHostFunctions) ResolveHostname(_ string) string {
+	return ""
+}
+
+func (m *mockHostFunctions) ResolveSecret(ref string) (string, error) {
+	if m.resolveSecret == nil {
+		return "", nil
+	}
+	return m.resolveSecret(ref)
+}
+
+func (m *mockHostFunctions) ResolveImageDigest(ref string) (string, error) {
+	if m.resolveImageDigest == nil {
+		return ref, nil
+	}
+	return m.resolveImageDigest(ref)
+}
+
+func (m *mockHostFunctions) FetchChartDependency(name, version, repository string) ([]byte, error) {
+	if m.fetchDependency == nil {
+		return nil, fmt.Errorf("chart %s-%s not found in %s", name, version, repository)
+	}
+	return m.fetchDependency(name, version, repository)
+}
+
+// newTestChart builds an application chart from a map of template name to
+// template source.
+func newTestChart(name string, templates map[string]string) *chart.Chart {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV2,
+			Name:       name,
+			Version:    "0.1.0",
+		},
+	}
+	for n, data := range templates {
+		c.Templates = append(c.Templates, &chart.File{Name: n, Data: []byte(data)})
+	}
+	return c
+}
+
+// newRenderValues wraps chart values in the top-level render values structure.
+func newRenderValues(values map[string]interface{}) releasevalues.Values {
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	return releasevalues.Values{
+		"Values": values,
+		"Release": map[string]interface{}{
+			"Name":      "test-release",
+			"Namespace": "default",
+			"Revision":  1,
+			"IsInstall": true,
+			"IsUpgrade": false,
+			"Service":   "Helm",
+		},
+		"Capabilities": map[string]interface{}{},
+	}
+}
+
+func TestRenderAllChartTemplatesContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lookups := 0
+	host := &mockHostFunctions{
+		lookup: func(_, _, _, _ string) (map[string]interface{}, error) {
+			lookups++
+			cancel()
+			return map[string]interface{}{}, nil
+		},
+	}
+
+	e, err := NewEngine(host)
+	require.NoError(t, err)
+
+	tpl := `{{ lookup "v1" "ConfigMap" "default" "cfg" }}`
+	c := newTestChart("cancel", map[string]string{
+		"templates/a.yaml": tpl,
+		"templates/b.yaml": tpl,
+		"templates/c.yaml": tpl,
+	})
+
+	_, err = e.RenderAllChartTemplatesContext(ctx, c, newRenderValues(nil))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, lookups)
+}
+
+func TestRenderWarnsOnLibraryChartManifest(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	lib := newTestChart("lib", map[string]string{
+		"templates/_helpers.tpl":    `{{ define "lib.name" }}lib{{ end }}`,
+		"templates/deployment.yaml": `kind: Deployment`,
+	})
+	lib.Metadata.Type = "library"
+
+	c := newTestChart("app", map[string]string{
+		"templates/configmap.yaml": `name: {{ include "lib.name" . }}`,
+	})
+	c.AddDependency(lib)
+
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, "name: lib", result.Manifests["app/templates/configmap.yaml"])
+	assert.NotContains(t, result.Manifests, "app/charts/lib/templates/deployment.yaml")
+	require.Len(t, result.Warnings, 1)
+	assert.Contains(t, result.Warnings[0], "templates/deployment.yaml")
+}
+
+func TestRenderStats(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	lib := newTestChart("lib", map[string]string{
+		"templates/_helpers.tpl":    `{{ define "lib.name" }}lib{{ end }}`,
+		"templates/deployment.yaml": `kind: Deployment`,
+	})
+	lib.Metadata.Type = "library"
+
+	c := newTestChart("app", map[string]string{
+		"templates/_helpers.tpl":   `{{ define "app.name" }}app{{ end }}`,
+		"templates/configmap.yaml": `name: {{ include "lib.name" . }}`,
+		"templates/service.yaml":   `kind: Service`,
+		"templates/optional.yaml":  `{{ if .Values.enabled }}kind: Secret{{ end }}`,
+		"templates/blank.yaml":     ``,
+	})
+	c.AddDependency(lib)
+
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	stats := result.Stats
+	assert.Positive(t, stats.Duration)
+	stats.Duration = 0
+	// The templates of both charts but the library chart's deployment and the
+	// blank one are parsed, of which the partials are not rendered.
+	assert.Equal(t, RenderStats{Parsed: 5, Rendered: 3, Empty: 1, Skipped: 4}, stats)
+	assert.Equal(t, "parsed 5 templates, rendered 3 (1 empty), skipped 4 in 0s", stats.String())
+}
+
+func TestWithAddedAPIVersions(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{}, WithAddedAPIVersions([]string{"example.com/v1alpha1", "apps/v1"}))
+	require.NoError(t, err)
+
+	c := newTestChart("caps", map[string]string{
+		"templates/caps.yaml": `{{ .Capabilities.APIVersions.Has "apps/v1" }} {{ .Capabilities.APIVersions.Has "example.com/v1alpha1" }} {{ .Capabilities.APIVersions.Has "missing/v1" }} {{ len .Capabilities.APIVersions }}`,
+	})
+
+	vals := newRenderValues(nil)
+	vals["Capabilities"] = map[string]interface{}{
+		"APIVersions": []interface{}{"v1", "apps/v1"},
+	}
+
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "true true false 3", manifests["caps/templates/caps.yaml"])
+
+	// Without added versions the Capabilities are left as supplied
+	e, err = NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	c = newTestChart("caps", map[string]string{
+		"templates/caps.yaml": `{{ typeOf .Capabilities.APIVersions }} {{ .Capabilities.APIVersions }}`,
+	})
+	vals["Capabilities"] = map[string]interface{}{
+		"APIVersions": []interface{}{"v1", "apps/v1", "v1"},
+	}
+	manifests, err = e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "[]interface {} [v1 apps/v1 v1]", manifests["caps/templates/caps.yaml"])
+}
+
+func TestRenderMergesChartDefaultValues(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	sub := newTestChart("sub", map[string]string{
+		"templates/sub.yaml": `{{ .Values.port }} {{ .Values.protocol }}`,
+	})
+	sub.Values = map[string]interface{}{
+		"port":     80,
+		"protocol": "TCP",
+	}
+
+	c := newTestChart("app", map[string]string{
+		"templates/app.yaml": `{{ .Values.replicaCount }} {{ .Values.image.repository }}:{{ .Values.image.tag }}`,
+	})
+	c.Values = map[string]interface{}{
+		"replicaCount": 1,
+		"image": map[string]interface{}{
+			"repository": "nginx",
+			"tag":        "stable",
+		},
+	}
+	c.AddDependency(sub)
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{
+		"image": map[string]interface{}{"tag": "v2"},
+		"sub":   map[string]interface{}{"port": 8080},
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, "1 nginx:v2", manifests["app/templates/app.yaml"])
+	assert.Equal(t, "8080 TCP", manifests["app/charts/sub/templates/sub.yaml"])
+}
+
+func TestRenderNullValueRemovesChartDefault(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	sub := newTestChart("sub", map[string]string{
+		"templates/sub.yaml": `{{ hasKey .Values "protocol" }} {{ .Values.port }}`,
+	})
+	sub.Values = map[string]interface{}{
+		"port":     80,
+		"protocol": "TCP",
+	}
+
+	c := newTestChart("app", map[string]string{
+		"templates/app.yaml": `{{ hasKey .Values.image "tag" }} {{ .Values.image.repository }}`,
+	})
+	c.Values = map[string]interface{}{
+		"image": map[string]interface{}{
+			"repository": "nginx",
+			"tag":        "stable",
+		},
+	}
+	c.AddDependency(sub)
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{
+		"image": map[string]interface{}{"tag": nil},
+		"sub":   map[string]interface{}{"protocol": nil},
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, "false nginx", manifests["app/templates/app.yaml"])
+	assert.Equal(t, "false 80", manifests["app/charts/sub/templates/sub.yaml"])
+}
+
+func TestWithWarningsAsErrors(t *testing.T) {
+	c := newTestChart("warn", map[string]string{
+		"templates/cm.yaml": `name: {{ required "name is required" .Values.name }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithLintMode(true))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Missing required value: name is required"}, result.Warnings)
+
+	e, err = NewEngine(&mockHostFunctions{}, WithLintMode(true), WithWarningsAsErrors(true))
+	require.NoError(t, err)
+	_, err = e.Render(context.Background(), c, newRenderValues(nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "name is required")
+}
+
+func TestLookupSecretData(t *testing.T) {
+	host := &mockHostFunctions{
+		lookup: func(apiVersion, kind, namespace, name string) (map[string]interface{}, error) {
+			if apiVersion == "v1" && kind == "Secret" && namespace == "default" && name == "db" {
+				return map[string]interface{}{
+					"apiVersion": "v1",
+					"kind":       "Secret",
+					"data": map[string]interface{}{
+						"password": "aHVudGVyMg==",
+					},
+				}, nil
+			}
+			return map[string]interface{}{}, nil
+		},
+	}
+
+	e, err := NewEngine(host)
+	require.NoError(t, err)
+
+	c := newTestChart("secret", map[string]string{
+		"templates/found.yaml":       `{{ lookupSecretData "v1" "Secret" "default" "db" "password" }}`,
+		"templates/missing-key.yaml": `{{ lookupSecretData "v1" "Secret" "default" "db" "username" }}`,
+		"templates/missing.yaml":     `{{ lookupSecretData "v1" "Secret" "default" "other" "password" }}`,
+	})
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", manifests["secret/templates/found.yaml"])
+	assert.Equal(t, "", manifests["secret/templates/missing-key.yaml"])
+	assert.Equal(t, "", manifests["secret/templates/missing.yaml"])
+}
+
+func TestWithFailFast(t *testing.T) {
+	c := newTestChart("broken", map[string]string{
+		"templates/a.yaml": `{{ fail "first broken template" }}`,
+		"templates/b.yaml": `{{ fail "second broken template" }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithFailFast(true))
+	require.NoError(t, err)
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.Error(t, err)
+	assert.Equal(t, "execution error at (broken/templates/b.yaml:1:3): second broken template", err.Error())
+
+	e, err = NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "first broken template")
+	assert.Contains(t, err.Error(), "second broken template")
+}
+
+func TestReferencedValuePaths(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	sub := newTestChart("sub", map[string]string{
+		"templates/sub.yaml": `{{ if .Values.enabled }}{{ .Values.global.domain }}{{ end }}`,
+	})
+
+	c := newTestChart("app", map[string]string{
+		"templates/_helpers.tpl": `{{ define "app.name" }}{{ default .Chart.Name .Values.nameOverride }}{{ end }}`,
+		"templates/deployment.yaml": `
+name: {{ include "app.name" . }}
+image: {{ .Values.image.repository }}:{{ .Values.image.tag | default "latest" }}
+{{- with .Values.service }}
+port: {{ .port }}
+{{- end }}
+{{- $resources := .Values.resources }}
+limits: {{ $resources.limits.cpu }}
+{{- range .Values.hosts }}
+host: {{ .name }}.{{ $.Values.domain }}
+{{- end }}
+`,
+	})
+	c.AddDependency(sub)
+
+	paths, err := e.ReferencedValuePaths(c)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"domain",
+		"global.domain",
+		"hosts",
+		"image.repository",
+		"image.tag",
+		"nameOverride",
+		"resources",
+		"resources.limits.cpu",
+		"service",
+		"service.port",
+		"sub.enabled",
+	}, paths)
+}
+
+func TestTplSeesRenderContext(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	sub := newTestChart("sub", map[string]string{
+		"templates/root.yaml":   `{{ tpl .Values.snippet . }}`,
+		"templates/values.yaml": `{{ tpl .Values.snippet .Values }}`,
+	})
+	c := newTestChart("app", nil)
+	c.AddDependency(sub)
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{
+		"sub": map[string]interface{}{
+			"snippet": `{{ .Chart.Name }} {{ .Template.Name }} {{ .Release.Name }}`,
+		},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "sub app/charts/sub/templates/root.yaml test-release", manifests["app/charts/sub/templates/root.yaml"])
+	assert.Equal(t, "sub app/charts/sub/templates/values.yaml test-release", manifests["app/charts/sub/templates/values.yaml"])
+}
+
+func TestWithManifestLint(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{}, WithManifestLint(true))
+	require.NoError(t, err)
+
+	c := newTestChart("lint", map[string]string{
+		"templates/cm.yaml": `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: complete
+---
+# empty document
+---
+apiVersion: v1
+metadata:
+  name: no-kind
+`,
+		"templates/NOTES.txt": `Thanks for installing!`,
+	})
+
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lint/templates/cm.yaml: document 1: missing required field(s): kind"}, result.Warnings)
+}
+
+func TestToYamlCanonical(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("canonical", map[string]string{
+		"templates/cm.yaml": `{{ toYamlCanonical .Values }}`,
+	})
+	vals := newRenderValues(map[string]interface{}{
+		"zeta": map[string]interface{}{
+			"beta": map[string]interface{}{
+				"z":     json.Number("10"),
+				"a":     json.Number("1.5"),
+				"m":     "10",
+				"list":  []interface{}{"b", "a"},
+				"empty": nil,
+			},
+			"alpha": true,
+		},
+		"alpha": "first",
+	})
+
+	expected := `alpha: first
+zeta:
+  alpha: true
+  beta:
+    a: 1.5
+    empty: null
+    list:
+      - b
+      - a
+    m: "10"
+    z: 10`
+
+	for i := 0; i < 5; i++ {
+		result, err := e.Render(context.Background(), c, vals)
+		require.NoError(t, err)
+		assert.Equal(t, expected, result.Manifests["canonical/templates/cm.yaml"])
+	}
+}
+
+func TestToYamlBlock(t *testing.T) {
+	script := "#!/bin/sh\nset -e\n\nif [ -n \"$DEBUG\" ]; then\n  set -x\nfi\nexec /app/server\n"
+
+	c := newTestChart("block", map[string]string{
+		"templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: scripts
+data:
+  {{- toYamlBlock .Values.scripts | nindent 2 }}`,
+		"templates/job.yaml": `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+spec:
+  command:
+    - /bin/sh
+    - -c
+    - |
+      {{- .Values.scripts.run | nindent 6 }}`,
+	})
+	vals := newRenderValues(map[string]interface{}{
+		"scripts": map[string]interface{}{
+			"run":    script,
+			"banner": "  indented\nbanner",
+			"name":   "server",
+		},
+	})
+
+	// Common labels re-serialize the manifests, which must keep the block scalars
+	e, err := NewEngine(&mockHostFunctions{}, WithCommonLabels(map[string]string{"team": "platform"}))
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+
+	assert.Equal(t, `apiVersion: v1
+data:
+  banner: |2-
+      indented
+    banner
+  name: server
+  run: |
+    #!/bin/sh
+    set -e
+
+    if [ -n "$DEBUG" ]; then
+      set -x
+    fi
+    exec /app/server
+kind: ConfigMap
+metadata:
+  labels:
+    team: platform
+  name: scripts
+`, manifests["block/templates/cm.yaml"])
+
+	var job map[string]interface{}
+	require.NoError(t, yaml.Unmarshal([]byte(manifests["block/templates/job.yaml"]), &job))
+	assert.Equal(t, []interface{}{"/bin/sh", "-c", script}, job["spec"].(map[string]interface{})["command"])
+
+	var cm map[string]interface{}
+	require.NoError(t, yaml.Unmarshal([]byte(manifests["block/templates/cm.yaml"]), &cm))
+	assert.Equal(t, vals["Values"].(map[string]interface{})["scripts"], cm["data"])
+}
+
+func TestResolveSecret(t *testing.T) {
+	host := &mockHostFunctions{
+		resolveSecret: func(ref string) (string, error) {
+			if ref == "vault:db/password" {
+				return "hunter2", nil
+			}
+			return "", errors.New("not found")
+		},
+	}
+
+	c := newTestChart("secrets", map[string]string{
+		"templates/secret.yaml": `password: {{ resolveSecret "vault:db/password" }}`,
+	})
+
+	e, err := NewEngine(host, WithSecrets(true))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "password: hunter2", result.Manifests["secrets/templates/secret.yaml"])
+
+	// Disabled secrets resolve to empty strings
+	e, err = NewEngine(host)
+	require.NoError(t, err)
+	result, err = e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "password: ", result.Manifests["secrets/templates/secret.yaml"])
+
+	// Host errors name the ref
+	c = newTestChart("secrets", map[string]string{
+		"templates/secret.yaml": `password: {{ resolveSecret "vault:missing" }}`,
+	})
+	e, err = NewEngine(host, WithSecrets(true))
+	require.NoError(t, err)
+	_, err = e.Render(context.Background(), c, newRenderValues(nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `failed to resolve secret "vault:missing": not found`)
+}
+
+func TestWithRootChartOnly(t *testing.T) {
+	sub := newTestChart("sub", map[string]string{
+		"templates/sub.yaml": `sub: {{ .Values.name }}`,
+	})
+
+	c := newTestChart("umbrella", map[string]string{
+		"templates/root.yaml": `root: {{ .Values.name }}`,
+	})
+	c.AddDependency(sub)
+
+	e, err := NewEngine(&mockHostFunctions{}, WithRootChartOnly(true))
+	require.NoError(t, err)
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{
+		"name": "parent",
+		"sub":  map[string]interface{}{"name": "child"},
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"umbrella/templates/root.yaml": "root: parent",
+	}, manifests)
+}
+
+func TestWithAllowedRegistries(t *testing.T) {
+	deployment := func(image string) *chart.Chart {
+		return newTestChart("registries", map[string]string{
+			"templates/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: init
+          image: ghcr.io/example/init:v1
+      containers:
+        - name: web
+          image: ` + image,
+		})
+	}
+
+	e, err := NewEngine(&mockHostFunctions{}, WithAllowedRegistries([]string{"ghcr.io", "docker.io/library"}))
+	require.NoError(t, err)
+
+	for _, image := range []string{"ghcr.io/example/web:v1", "nginx:1.27", "docker.io/library/nginx@sha256:abc"} {
+		_, err = e.Render(context.Background(), deployment(image), newRenderValues(nil))
+		assert.NoError(t, err, image)
+	}
+
+	for _, image := range []string{"quay.io/example/web:v1", "example/web", "localhost:5000/web"} {
+		_, err = e.Render(context.Background(), deployment(image), newRenderValues(nil))
+		require.Error(t, err, image)
+		assert.Contains(t, err.Error(), `registries/templates/deployment.yaml: document 0: image "`+image+`" is not from an allowed registry`)
+	}
+}
+
+func TestRenderNestedSubchartValues(t *testing.T) {
+	grandchild := newTestChart("grand.child", map[string]string{
+		"templates/cm.yaml": `{{ .Values.greeting }} {{ .Values.name }} {{ .Values.global.env }}`,
+	})
+	grandchild.Values = map[string]interface{}{"greeting": "hello", "name": "default"}
+
+	child := newTestChart("child", map[string]string{
+		"templates/cm.yaml": `{{ index .Values "grand.child" "name" }}`,
+	})
+	child.Values = map[string]interface{}{
+		"grand.child": map[string]interface{}{"greeting": "hi"},
+	}
+	child.AddDependency(grandchild)
+
+	c := newTestChart("root", map[string]string{})
+	c.AddDependency(child)
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{
+		"global": map[string]interface{}{"env": "prod"},
+		"child": map[string]interface{}{
+			"global": map[string]interface{}{"env": "prod"},
+			"grand.child": map[string]interface{}{
+				"name":   "deep",
+				"global": map[string]interface{}{"env": "prod"},
+			},
+		},
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, "deep", manifests["root/charts/child/templates/cm.yaml"])
+	assert.Equal(t, "hi deep prod", manifests["root/charts/child/charts/grand.child/templates/cm.yaml"])
+}
+
+func TestWithValuesDump(t *testing.T) {
+	sub := newTestChart("sub", map[string]string{
+		"templates/sub.yaml": `{{ .Values.port }}`,
+	})
+	sub.Values = map[string]interface{}{"port": 80, "protocol": "TCP"}
+
+	c := newTestChart("app", map[string]string{
+		"templates/app.yaml": `{{ .Values.name }}`,
+	})
+	c.AddDependency(sub)
+
+	var dump bytes.Buffer
+	e, err := NewEngine(&mockHostFunctions{}, WithValuesDump(&dump))
+	require.NoError(t, err)
+
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{
+		"name": "app",
+		"sub":  map[string]interface{}{"port": 8080},
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, `---
+# Chart: app
+name: app
+sub:
+  port: 8080
+---
+# Chart: app/charts/sub
+port: 8080
+protocol: TCP
+`, dump.String())
+}
+
+func TestRenderConcurrent(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	// Every chart defines the same partial differently, so renders sharing a
+	// template set would produce each other's output.
+	const renders = 8
+	charts := make([]*chart.Chart, renders)
+	for i := range charts {
+		charts[i] = newTestChart(fmt.Sprintf("chart%d", i), map[string]string{
+			"templates/_helpers.tpl": fmt.Sprintf(`{{ define "name" }}chart%d{{ end }}`, i),
+			"templates/cm.yaml":      `{{ include "name" . }} {{ tpl "{{ .Values.n }}" . }}`,
+		})
+	}
+
+	var wg sync.WaitGroup
+	results := make([]map[string]string, renders)
+	errs := make([]error, renders)
+	for i := range charts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = e.RenderAllChartTemplates(charts[i], newRenderValues(map[string]interface{}{"n": i}))
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range charts {
+		require.NoError(t, errs[i])
+		assert.Equal(t, map[string]string{
+			fmt.Sprintf("chart%d/templates/cm.yaml", i): fmt.Sprintf("chart%d %d", i, i),
+		}, results[i])
+	}
+}
+
+func TestLookupClusterScoped(t *testing.T) {
+	var namespaces []string
+	host := &mockHostFunctions{
+		lookup: func(_, kind, namespace, name string) (map[string]interface{}, error) {
+			namespaces = append(namespaces, namespace)
+			return map[string]interface{}{
+				"metadata": map[string]interface{}{"name": name},
+				"kind":     kind,
+			}, nil
+		},
+	}
+
+	e, err := NewEngine(host)
+	require.NoError(t, err)
+
+	c := newTestChart("nodes", map[string]string{
+		"templates/nodes.yaml": `{{ (lookup "v1" "Node" "" "node-1").metadata.name }}
+{{ (lookup "v1" "Node" .Release.Namespace "node-2").metadata.name }}
+{{ (lookup "v1" "ConfigMap" .Release.Namespace "cm").metadata.name }}`,
+	})
+
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, "node-1\nnode-2\ncm", result.Manifests["nodes/templates/nodes.yaml"])
+	assert.Equal(t, []string{"", "", "default"}, namespaces)
+	assert.Equal(t, []string{`lookup of cluster-scoped Node "node-2": ignoring namespace "default"`}, result.Warnings)
+}
+
+func TestConfigChecksum(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("app", map[string]string{
+		"templates/configmap.yaml":  `data: {{ .Values.data }}`,
+		"templates/deployment.yaml": `checksum/config: {{ configChecksum "configmap.yaml" }}`,
+	})
+
+	checksum := func(data string) string {
+		manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"data": data}))
+		require.NoError(t, err)
+		return manifests["app/templates/deployment.yaml"]
+	}
+
+	sum := sha256.Sum256([]byte("data: a"))
+	assert.Equal(t, fmt.Sprintf("checksum/config: %x", sum), checksum("a"))
+	assert.Equal(t, checksum("a"), checksum("a"))
+	assert.NotEqual(t, checksum("a"), checksum("b"))
+}
+
+func TestWithOutputJSON(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{}, WithOutputJSON(true))
+	require.NoError(t, err)
+
+	c := newTestChart("json", map[string]string{
+		"templates/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: {{ .Values.replicas }}`,
+		"templates/configmaps.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b`,
+	})
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"replicas": 3}))
+	require.NoError(t, err)
+
+	assert.Equal(t, `{
+  "apiVersion": "apps/v1",
+  "kind": "Deployment",
+  "metadata": {
+    "name": "web"
+  },
+  "spec": {
+    "replicas": 3
+  }
+}`, manifests["json/templates/deployment.yaml"])
+
+	var configMaps []map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(manifests["json/templates/configmaps.yaml"]), &configMaps))
+	require.Len(t, configMaps, 2)
+	assert.Equal(t, "b", configMaps[1]["metadata"].(map[string]interface{})["name"])
+}
+
+func TestWithOutputJSONNonObjects(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{}, WithOutputJSON(true))
+	require.NoError(t, err)
+
+	c := newTestChart("json", map[string]string{
+		"templates/list.yaml":     "- a\n- b\n",
+		"templates/scalar.yaml":   "42\n---\ntext\n",
+		"templates/comments.yaml": "# Nothing to render\n",
+		"templates/empty.yaml":    `{{- if false }}kind: ConfigMap{{ end }}`,
+		"templates/_helpers.tpl":  `{{ define "json.name" }}json{{ end }}`,
+	})
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{}))
+	require.NoError(t, err)
+
+	assert.Equal(t, "[\n  \"a\",\n  \"b\"\n]", manifests["json/templates/list.yaml"])
+	assert.Equal(t, "[\n  42,\n  \"text\"\n]", manifests["json/templates/scalar.yaml"])
+	assert.Equal(t, "[]", manifests["json/templates/comments.yaml"])
+	assert.Equal(t, "[]", manifests["json/templates/empty.yaml"])
+}
+
+func TestWithTabDetection(t *testing.T) {
+	c := newTestChart("tabs", map[string]string{
+		"templates/cm.yaml":   "apiVersion: v1\nkind: ConfigMap\ndata:\n\tkey: {{ .Values.value }}\n",
+		"templates/NOTES.txt": "Notes may\n\tuse tabs\n",
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithTabDetection(true))
+	require.NoError(t, err)
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"value": "x"}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "tabs/templates/cm.yaml:4: line is indented with a tab, YAML requires spaces for indentation")
+	assert.NotContains(t, err.Error(), "NOTES.txt")
+
+	e, err = NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"value": "x"}))
+	assert.NoError(t, err)
+}
+
+func TestWithTabDetectionBlockScalar(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{}, WithTabDetection(true))
+	require.NoError(t, err)
+
+	// Tabs in the content of block scalars are not indentation
+	c := newTestChart("tabs", map[string]string{
+		"templates/cm.yaml":  "apiVersion: v1\nkind: ConfigMap\ndata:\n  Makefile: |\n    build:\n    \tgo build ./...\n\n    \tgo vet ./...\n  data.tsv: >-\n    a\tb\n    \tc\n  after: x\n",
+		"templates/job.yaml": "command:\n  - |\n    \tmake\n",
+	})
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Contains(t, manifests["tabs/templates/cm.yaml"], "    \tgo build ./...")
+
+	// Indentation after a block scalar ends is checked again
+	c = newTestChart("tabs", map[string]string{
+		"templates/cm.yaml": "data:\n  script: |\n    \techo\n\tkey: value\n",
+	})
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	assert.ErrorContains(t, err, "tabs/templates/cm.yaml:4: line is indented with a tab")
+
+	// A block scalar whose indentation starts with a tab is not valid
+	c = newTestChart("tabs", map[string]string{
+		"templates/cm.yaml": "data:\n  script: |\n\techo\n",
+	})
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	assert.ErrorContains(t, err, "tabs/templates/cm.yaml:3: line is indented with a tab")
+}
+
+func TestSubchartNames(t *testing.T) {
+	c := newTestChart("umbrella", map[string]string{
+		"templates/_helpers.tpl": `{{ define "hasRedis" }}{{ has "redis" subchartNames }}{{ end }}`,
+		"templates/cm.yaml":      `{{ subchartNames | join "," }} {{ include "hasRedis" . }}`,
+	})
+	c.AddDependency(newTestChart("redis", map[string]string{
+		"templates/cm.yaml": `[{{ subchartNames | join "," }}]`,
+	}))
+	c.AddDependency(newTestChart("postgresql", nil))
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, "postgresql,redis true", manifests["umbrella/templates/cm.yaml"])
+	assert.Equal(t, "[]", manifests["umbrella/charts/redis/templates/cm.yaml"])
+}
+
+func TestRenderNilTemplates(t *testing.T) {
+	c := newTestChart("broken", map[string]string{
+		"templates/cm.yaml": `ok`,
+	})
+	c.Templates = append(c.Templates, nil, &chart.File{Name: "templates/empty.yaml"})
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"broken/templates/cm.yaml": "ok"}, result.Manifests)
+	assert.Equal(t, []string{
+		`chart "broken": skipping template 1: template is nil`,
+		`chart "broken": skipping template 2 ("templates/empty.yaml"): template is empty`,
+	}, result.Warnings)
+}
+
+func TestWithMaxOutputSize(t *testing.T) {
+	c := newTestChart("bomb", map[string]string{
+		"templates/a.yaml": `{{ repeat 60 "a" }}`,
+		"templates/b.yaml": `{{ range until 100 }}{{ repeat 1000 "b" }}{{ end }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithMaxOutputSize(100))
+	require.NoError(t, err)
+
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rendering bomb/templates/b.yaml: rendered output exceeds the maximum size of 100 bytes")
+
+	// The limit applies to the output of all templates together
+	e, err = NewEngine(&mockHostFunctions{}, WithMaxOutputSize(100))
+	require.NoError(t, err)
+	c = newTestChart("bomb", map[string]string{
+		"templates/a.yaml": `{{ repeat 60 "a" }}`,
+		"templates/b.yaml": `{{ repeat 60 "b" }}`,
+	})
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rendered output exceeds the maximum size of 100 bytes")
+
+	// Each render has its own budget
+	e, err = NewEngine(&mockHostFunctions{}, WithMaxOutputSize(200))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+		require.NoError(t, err)
+	}
+}
+
+func TestRenderReleaseTyped(t *testing.T) {
+	c := newTestChart("release", map[string]string{
+		"templates/cm.yaml": `{{ if .Release.IsUpgrade }}upgrade{{ else }}install{{ end }} {{ .Release.Name }} {{ add .Release.Revision 1 }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	// Release information decoded from JSON, with a bool supplied as a string
+	vals := newRenderValues(nil)
+	vals["Release"] = map[string]interface{}{
+		"Name":      "test-release",
+		"Revision":  json.Number("2"),
+		"IsInstall": false,
+		"IsUpgrade": "true",
+	}
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "upgrade test-release 3", manifests["release/templates/cm.yaml"])
+
+	vals["Release"] = map[string]interface{}{"Name": "test-release", "IsUpgrade": "false"}
+	manifests, err = e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "install test-release 1", manifests["release/templates/cm.yaml"])
+
+	e, err = NewEngine(&mockHostFunctions{}, WithReleaseStruct(Release{Name: "typed", Revision: 4, IsUpgrade: true}))
+	require.NoError(t, err)
+	manifests, err = e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "upgrade typed 5", manifests["release/templates/cm.yaml"])
+
+	// Templates see the Release itself, so keys that are not its fields are
+	// not available
+	c = newTestChart("release", map[string]string{
+		"templates/cm.yaml": `{{ typeOf .Release }} {{ kindIs "bool" .Release.IsInstall }}`,
+	})
+	vals["Release"] = map[string]interface{}{"Name": "test-release", "Chart": "web-1.0.0"}
+	manifests, err = e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "engine.Release true", manifests["release/templates/cm.yaml"])
+}
+
+func TestRevisionSuffix(t *testing.T) {
+	c := newTestChart("canary", map[string]string{
+		"templates/deployment.yaml": `name: {{ .Release.Name }}-{{ revisionSuffix }}`,
+		"templates/_helpers.tpl":    `{{ define "canary.name" }}{{ .Release.Name }}-{{ revisionSuffix }}{{ end }}`,
+		"templates/svc.yaml":        `name: {{ include "canary.name" . }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	vals := newRenderValues(nil)
+	vals["Release"] = map[string]interface{}{"Name": "web", "Revision": json.Number("3")}
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "name: web-r3", manifests["canary/templates/deployment.yaml"])
+	assert.Equal(t, "name: web-r3", manifests["canary/templates/svc.yaml"])
+
+	vals["Release"] = map[string]interface{}{"Name": "web", "Revision": "4"}
+	manifests, err = e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "name: web-r4", manifests["canary/templates/deployment.yaml"])
+
+	e, err = NewEngine(&mockHostFunctions{}, WithReleaseStruct(Release{Name: "web", Revision: 12}))
+	require.NoError(t, err)
+	manifests, err = e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "name: web-r12", manifests["canary/templates/deployment.yaml"])
+}
+
+func TestWithIncludePartials(t *testing.T) {
+	helpers := `{{ define "app.name" }}app{{ end }}`
+	c := newTestChart("partials", map[string]string{
+		"templates/_helpers.tpl": helpers,
+		"templates/cm.yaml":      `{{ include "app.name" . }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithIncludePartials(true))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"partials/templates/_helpers.tpl": helpers}, result.Partials)
+	assert.Equal(t, map[string]string{
+		"partials/templates/_helpers.tpl": "",
+		"partials/templates/cm.yaml":      "app",
+	}, result.Manifests)
+
+	e, err = NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	result, err = e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	assert.Nil(t, result.Partials)
+	assert.Equal(t, map[string]string{"partials/templates/cm.yaml": "app"}, result.Manifests)
+}
+
+func TestWithGroupByChart(t *testing.T) {
+	db := newTestChart("db", map[string]string{
+		"templates/statefulset.yaml": `kind: StatefulSet`,
+	})
+	sub := newTestChart("sub", map[string]string{
+		"templates/_helpers.tpl":  `{{ define "sub.name" }}sub{{ end }}`,
+		"templates/service.yaml":  `kind: Service`,
+		"templates/configmap.yml": `kind: ConfigMap`,
+	})
+	sub.AddDependency(db)
+	c := newTestChart("umbrella", map[string]string{
+		"templates/deployment.yaml": `kind: Deployment`,
+	})
+	c.AddDependency(sub)
+
+	e, err := NewEngine(&mockHostFunctions{}, WithGroupByChart(true))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string][]string{
+		"umbrella": {"umbrella/templates/deployment.yaml"},
+		"umbrella/charts/sub": {
+			"umbrella/charts/sub/templates/configmap.yml",
+			"umbrella/charts/sub/templates/service.yaml",
+		},
+		"umbrella/charts/sub/charts/db": {"umbrella/charts/sub/charts/db/templates/statefulset.yaml"},
+	}, result.ChartGroups)
+
+	e, err = NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	result, err = e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Nil(t, result.ChartGroups)
+}
+
+func TestWithRequiredValuePaths(t *testing.T) {
+	c := newTestChart("required", map[string]string{
+		"templates/cm.yaml": `{{ .Values.image.repository }}`,
+	})
+	c.Values = map[string]interface{}{
+		"image": map[string]interface{}{"repository": "nginx"},
+	}
+
+	e, err := NewEngine(&mockHostFunctions{}, WithRequiredValuePaths([]string{
+		"image.repository", "image.tag", "database.host", "tls", "replicas",
+	}))
+	require.NoError(t, err)
+
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{
+		"image":    map[string]interface{}{"tag": ""},
+		"tls":      map[string]interface{}{"secretName": "tls"},
+		"replicas": 0,
+	}))
+	require.Error(t, err)
+	assert.ErrorContains(t, err, `required value "image.tag" is missing or empty`)
+	assert.ErrorContains(t, err, `required value "database.host" is missing or empty`)
+	// Defaults, non-empty tables and zero numbers satisfy the requirement
+	assert.NotContains(t, err.Error(), `"image.repository"`)
+	assert.NotContains(t, err.Error(), `"tls"`)
+	assert.NotContains(t, err.Error(), `"replicas"`)
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{
+		"image":    map[string]interface{}{"tag": "1.27"},
+		"database": map[string]interface{}{"host": "db"},
+		"tls":      map[string]interface{}{"secretName": "tls"},
+		"replicas": 0,
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "nginx", manifests["required/templates/cm.yaml"])
+
+	_, err = NewEngine(&mockHostFunctions{}, WithRequiredValuePaths([]string{""}))
+	assert.Error(t, err)
+}
+
+func TestWithTemplateNamespace(t *testing.T) {
+	sub := newTestChart("sub", map[string]string{
+		"templates/_helpers.tpl": `{{ define "sub.name" }}sub-{{ .Release.Name }}{{ end }}`,
+		"templates/cm.yaml":      `{{ include "sub.name" . }} {{ .Template.Name }}`,
+	})
+	c := newTestChart("app", map[string]string{
+		"templates/_config.tpl": `port: {{ .Values.port }}`,
+		"templates/cm.yaml":     `{{ include (print .Template.BasePath "/_config.tpl") . }} {{ tpl "{{ .Template.BasePath }}" . }}`,
+	})
+	c.AddDependency(sub)
+
+	e, err := NewEngine(&mockHostFunctions{}, WithTemplateNamespace("team-a"))
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"port": 80}))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"team-a/app/templates/cm.yaml":            "port: 80 team-a/app/templates",
+		"team-a/app/charts/sub/templates/cm.yaml": "sub-test-release team-a/app/charts/sub/templates/cm.yaml",
+	}, manifests)
+
+	// Prepared charts are keyed alike
+	p, err := e.Prepare(c)
+	require.NoError(t, err)
+	prepared, err := p.Render(newRenderValues(map[string]interface{}{"port": 80}))
+	require.NoError(t, err)
+	assert.Equal(t, manifests, prepared)
+
+	_, err = NewEngine(&mockHostFunctions{}, WithTemplateNamespace("../escape"))
+	assert.Error(t, err)
+}
+
+func TestWithKustomization(t *testing.T) {
+	sub := newTestChart("sub", map[string]string{
+		"templates/service.yaml": `kind: Service`,
+	})
+	c := newTestChart("app", map[string]string{
+		"templates/_helpers.tpl":  `{{ define "app.name" }}app{{ end }}`,
+		"templates/NOTES.txt":     `Installed {{ include "app.name" . }}`,
+		"templates/empty.yaml":    `{{ if .Values.enabled }}kind: ConfigMap{{ end }}`,
+		"templates/comment.yaml":  `# nothing to see here`,
+		"templates/multi.yaml":    "kind: ConfigMap\n---\nkind: Secret",
+		"templates/workload.yaml": `kind: Deployment`,
+	})
+	c.AddDependency(sub)
+
+	e, err := NewEngine(&mockHostFunctions{}, WithKustomization(true))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	kustomization := `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+- charts/sub/templates/service.yaml
+- templates/multi.yaml
+- templates/workload.yaml
+`
+	assert.Equal(t, "app/kustomization.yaml", result.KustomizationFile)
+	assert.Equal(t, kustomization, result.Kustomization)
+	assert.NotContains(t, result.Manifests, "app/kustomization.yaml")
+
+	// With JSON output, files with several resources become a List
+	e, err = NewEngine(&mockHostFunctions{}, WithKustomization(true), WithOutputJSON(true))
+	require.NoError(t, err)
+	result, err = e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, kustomization, result.Kustomization)
+	assert.JSONEq(t, `{"apiVersion": "v1", "kind": "List", "items": [{"kind": "ConfigMap"}, {"kind": "Secret"}]}`, result.Manifests["app/templates/multi.yaml"])
+	assert.JSONEq(t, `{"kind": "Deployment"}`, result.Manifests["app/templates/workload.yaml"])
+
+	e, err = NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	result, err = e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Empty(t, result.KustomizationFile)
+	assert.Empty(t, result.Kustomization)
+}
+
+func TestToSeconds(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("seconds", map[string]string{
+		"templates/pod.yaml": `{{ toSeconds .Values.timeout }}`,
+	})
+
+	for value, seconds := range map[interface{}]string{
+		"30s":    "30",
+		"5m":     "300",
+		"1h30m":  "5400",
+		"1500ms": "1",
+		"45":     "45",
+		45:       "45",
+	} {
+		manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"timeout": value}))
+		require.NoError(t, err, value)
+		assert.Equal(t, seconds, manifests["seconds/templates/pod.yaml"], value)
+	}
+
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"timeout": "soon"}))
+	assert.ErrorContains(t, err, `toSeconds: "soon" is not a duration`)
+}
+
+func TestMustPort(t *testing.T) {
+	c := newTestChart("port", map[string]string{
+		"templates/svc.yaml": `port: {{ mustPort .Values.port }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	for _, port := range []interface{}{8080, "8080", 8080.0} {
+		manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"port": port}))
+		require.NoError(t, err)
+		assert.Equal(t, "port: 8080", manifests["port/templates/svc.yaml"])
+	}
+
+	for port, msg := range map[interface{}]string{
+		0:      "port 0 is out of range 1-65535",
+		70000:  "port 70000 is out of range 1-65535",
+		"http": `port "http" is not a number`,
+		80.5:   "port 80.5 is not an integer",
+	} {
+		_, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"port": port}))
+		assert.ErrorContains(t, err, msg)
+	}
+
+	// Linting only warns
+	e, err = NewEngine(&mockHostFunctions{}, WithLintMode(true))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(map[string]interface{}{"port": "http"}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{`port "http" is not a number`}, result.Warnings)
+}
+
+func TestMutuallyExclusive(t *testing.T) {
+	c := newTestChart("db", map[string]string{
+		"templates/secret.yaml": `secret: {{ mutuallyExclusive "set either existingSecret or password" .Values.existingSecret .Values.password | default "none" }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	// Exactly one set
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"password": "hunter2"}))
+	require.NoError(t, err)
+	assert.Equal(t, "secret: hunter2", manifests["db/templates/secret.yaml"])
+
+	// None set
+	manifests, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"existingSecret": ""}))
+	require.NoError(t, err)
+	assert.Equal(t, "secret: none", manifests["db/templates/secret.yaml"])
+
+	// Two set
+	both := map[string]interface{}{"existingSecret": "db-creds", "password": "hunter2"}
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(both))
+	assert.ErrorContains(t, err, "set either existingSecret or password")
+
+	// Linting only warns
+	e, err = NewEngine(&mockHostFunctions{}, WithLintMode(true))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(both))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"set either existingSecret or password"}, result.Warnings)
+}
+
+func TestRequireAPIVersion(t *testing.T) {
+	c := newTestChart("api", map[string]string{
+		"templates/cronjob.yaml": `{{ requireAPIVersion "batch/v1/CronJob" }}kind: CronJob`,
+	})
+
+	vals := newRenderValues(nil)
+	vals["Capabilities"] = map[string]interface{}{
+		"APIVersions": []interface{}{"v1", "batch/v1", "batch/v1/CronJob"},
+	}
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "kind: CronJob", manifests["api/templates/cronjob.yaml"])
+
+	// Absent
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `API version "batch/v1/CronJob" is not available in the cluster`)
+	assert.NotContains(t, err.Error(), warnStartDelim)
+
+	// Lint mode
+	e, err = NewEngine(&mockHostFunctions{}, WithLintMode(true))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "kind: CronJob", result.Manifests["api/templates/cronjob.yaml"])
+	assert.Equal(t, []string{`API version "batch/v1/CronJob" is not available in the cluster`}, result.Warnings)
+}
+
+func TestWithValuesFromLookup(t *testing.T) {
+	configMaps := map[string]map[string]interface{}{
+		"env": {
+			"data": map[string]interface{}{
+				"values.yaml": "replicas: 2\nimage:\n  repository: nginx\n  tag: stable\n",
+			},
+		},
+		"broken": {
+			"data": map[string]interface{}{
+				"values.yaml": "image: [",
+			},
+		},
+	}
+	host := &mockHostFunctions{
+		lookup: func(_, _, _, name string) (map[string]interface{}, error) {
+			if cm, ok := configMaps[name]; ok {
+				return cm, nil
+			}
+			return map[string]interface{}{}, nil
+		},
+	}
+
+	c := newTestChart("lookup", map[string]string{
+		"templates/cm.yaml": `{{ .Values.replicas }} {{ .Values.image.repository }}:{{ .Values.image.tag }}`,
+	})
+	vals := newRenderValues(map[string]interface{}{
+		"image": map[string]interface{}{"tag": "v2"},
+	})
+
+	e, err := NewEngine(host, WithValuesFromLookup("v1", "ConfigMap", "config", "env", "values.yaml"))
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "2 nginx:v2", manifests["lookup/templates/cm.yaml"])
+
+	// Missing resources are skipped
+	e, err = NewEngine(host, WithValuesFromLookup("v1", "ConfigMap", "config", "missing", "values.yaml"))
+	require.NoError(t, err)
+	manifests, err = e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, " :v2", manifests["lookup/templates/cm.yaml"])
+
+	// Malformed values fail the render
+	e, err = NewEngine(host, WithValuesFromLookup("v1", "ConfigMap", "config", "broken", "values.yaml"))
+	require.NoError(t, err)
+	_, err = e.RenderAllChartTemplates(c, vals)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `failed to parse values from key "values.yaml" of ConfigMap config/broken`)
+}
+
+func TestRenderPartialResults(t *testing.T) {
+	c := newTestChart("partial", map[string]string{
+		"templates/good.yaml": `good`,
+		"templates/bad.yaml":  `{{ fail "broken" }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.Error(t, err)
+
+	assert.Equal(t, map[string]string{"partial/templates/good.yaml": "good"}, result.Manifests)
+	require.Len(t, result.Errors, 1)
+	assert.ErrorContains(t, result.Errors["partial/templates/bad.yaml"], "broken")
+
+	// A cancelled render still returns the templates rendered before it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	host := &mockHostFunctions{
+		lookup: func(_, _, _, _ string) (map[string]interface{}, error) {
+			cancel()
+			return map[string]interface{}{}, nil
+		},
+	}
+	e, err = NewEngine(host)
+	require.NoError(t, err)
+
+	c = newTestChart("partial", map[string]string{
+		"templates/a.yaml": `a`,
+		"templates/b.yaml": `{{ lookup "v1" "ConfigMap" "default" "cfg" | len }}`,
+	})
+	result, err = e.Render(ctx, c, newRenderValues(nil))
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, map[string]string{"partial/templates/b.yaml": "0"}, result.Manifests)
+}
+
+func TestMergeCopy(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("merge", map[string]string{
+		"templates/cm.yaml": `{{- $defaults := dict "image" (dict "repository" "nginx" "tag" "stable") "port" 80 -}}
+{{- range $name := list "a" "b" }}
+{{- $svc := mergeCopy (dict "name" $name "image" (dict "tag" $name)) $defaults }}
+{{ toJson $svc }}
+{{- end }}
+{{ toJson $defaults }}
+{{ toJson (mustMergeCopy (dict "a" 1) (dict "a" 2 "b" 2) (dict "b" 3 "c" 3)) }}`,
+	})
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, `
+{"image":{"repository":"nginx","tag":"a"},"name":"a","port":80}
+{"image":{"repository":"nginx","tag":"b"},"name":"b","port":80}
+{"image":{"repository":"nginx","tag":"stable"},"port":80}
+{"a":1,"b":2,"c":3}`, manifests["merge/templates/cm.yaml"])
+}
+
+func TestMergeCopyKeepsEmptyValues(t *testing.T) {
+	dst := map[string]interface{}{
+		"key":     nil,
+		"name":    "",
+		"enabled": false,
+		"image":   map[string]interface{}{"tag": nil},
+	}
+	src := map[string]interface{}{
+		"key":     "value",
+		"name":    "app",
+		"enabled": true,
+		"image":   map[string]interface{}{"repository": "nginx", "tag": "stable"},
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"key":     nil,
+		"name":    "",
+		"enabled": false,
+		"image":   map[string]interface{}{"repository": "nginx", "tag": nil},
+	}, mergeCopy(dst, src))
+}
+
+func TestMergeCopyDoesNotModifyInputs(t *testing.T) {
+	dst := map[string]interface{}{"image": map[string]interface{}{"tag": "v1"}}
+	src := map[string]interface{}{"image": map[string]interface{}{"repository": "nginx", "tag": "stable"}}
+
+	out := mergeCopy(dst, src)
+	out["image"].(map[string]interface{})["pullPolicy"] = "Always"
+
+	assert.Equal(t, map[string]interface{}{"image": map[string]interface{}{"tag": "v1"}}, dst)
+	assert.Equal(t, map[string]interface{}{"image": map[string]interface{}{"repository": "nginx", "tag": "stable"}}, src)
+	assert.Equal(t, map[string]interface{}{"image": map[string]interface{}{"repository": "nginx", "tag": "v1", "pullPolicy": "Always"}}, out)
+}
+
+func TestWithValueInterpolation(t *testing.T) {
+	c := newTestChart("interpolate", map[string]string{
+		"templates/cm.yaml": `{{ .Values.host }}`,
+	})
+	vals := newRenderValues(map[string]interface{}{
+		"global": map[string]interface{}{"domain": "example.com"},
+		"host":   "app.${global.domain}",
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithValueInterpolation(true))
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "app.example.com", manifests["interpolate/templates/cm.yaml"])
+
+	e, err = NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	manifests, err = e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "app.${global.domain}", manifests["interpolate/templates/cm.yaml"])
+}
+
+func TestIncludeB64(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("b64", map[string]string{
+		"templates/_config.tpl": `{{ define "config" }}host: {{ .Values.host }}
+port: {{ .Values.missing }}{{ end }}`,
+		"templates/config.yaml": `{{ include "config" . }}`,
+		"templates/secret.yaml": `config.yaml: {{ includeB64 "config" . }}`,
+	})
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"host": "example.com"}))
+	require.NoError(t, err)
+
+	encoded := strings.TrimPrefix(manifests["b64/templates/secret.yaml"], "config.yaml: ")
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, manifests["b64/templates/config.yaml"], string(decoded))
+	assert.Equal(t, "host: example.com\nport: ", string(decoded))
+}
+
+func TestWithStrictScopeIsolation(t *testing.T) {
+	sub := newTestChart("sub", map[string]string{
+		"templates/sub.yaml": `{{ .Values.port }} {{ .Values.dbHost }} {{ .Values.global.env }}`,
+	})
+	sub.Values = map[string]interface{}{"port": 80}
+
+	c := newTestChart("app", map[string]string{
+		"templates/app.yaml": `{{ .Values.dbHost }}`,
+	})
+	c.AddDependency(sub)
+
+	vals := newRenderValues(map[string]interface{}{
+		"dbHost": "db",
+		"global": map[string]interface{}{"env": "prod"},
+		"sub":    map[string]interface{}{"global": map[string]interface{}{"env": "prod"}},
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithStrictScopeIsolation(true))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, vals)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "app/charts/sub/templates/sub.yaml: scope violation: .Values.dbHost only set in the scope of the parent chart")
+	assert.Equal(t, map[string]string{"app/templates/app.yaml": "db"}, result.Manifests)
+
+	// Without the option the subchart silently sees nothing
+	e, err = NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "80  prod", manifests["app/charts/sub/templates/sub.yaml"])
+}
+
+func TestFormatError(t *testing.T) {
+	c := newTestChart("app", map[string]string{
+		"templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ required "name is required" .Values.name }}
+data:
+  key: value
+  other: value`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.Error(t, err)
+
+	var re *RenderError
+	require.ErrorAs(t, err, &re)
+	assert.Equal(t, "app/templates/cm.yaml", re.Template)
+	assert.Equal(t, 4, re.Line)
+	assert.Equal(t, 11, re.Column)
+
+	assert.Equal(t, `execution error at (app/templates/cm.yaml:4:11): name is required
+  2 | kind: ConfigMap
+  3 | metadata:
+> 4 |   name: {{ required "name is required" .Values.name }}
+    |           ^
+  5 | data:
+  6 |   key: value`, FormatError(err, c))
+
+	// Errors without a location are formatted as their message
+	assert.Equal(t, "boom", FormatError(errors.New("boom"), c))
+
+	// Templates are found within a template namespace
+	e, err = NewEngine(&mockHostFunctions{}, WithTemplateNamespace("team-a"))
+	require.NoError(t, err)
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.Error(t, err)
+	assert.Equal(t, `execution error at (team-a/app/templates/cm.yaml:4:11): name is required
+  2 | kind: ConfigMap
+  3 | metadata:
+> 4 |   name: {{ required "name is required" .Values.name }}
+    |           ^
+  5 | data:
+  6 |   key: value`, FormatError(err, c))
+}
+
+func TestWithDefineCollisionCheck(t *testing.T) {
+	newChart := func(fullname string) *chart.Chart {
+		a := newTestChart("a", map[string]string{
+			"templates/_helpers.tpl": `{{- define "mylib.fullname" -}}{{ .Release.Name }}-a{{- end -}}`,
+			"templates/cm.yaml":      `name: {{ include "mylib.fullname" . }}`,
+		})
+		b := newTestChart("b", map[string]string{
+			"templates/_helpers.tpl": `{{- define "mylib.fullname" -}}` + fullname + `{{- end -}}`,
+			"templates/cm.yaml":      `name: {{ include "mylib.fullname" . }}`,
+		})
+		c := newTestChart("app", nil)
+		c.AddDependency(a, b)
+		return c
+	}
+
+	e, err := NewEngine(&mockHostFunctions{}, WithDefineCollisionCheck(true))
+	require.NoError(t, err)
+	_, err = e.RenderAllChartTemplates(newChart("{{ .Release.Name }}-b"), newRenderValues(nil))
+	assert.EqualError(t, err, `template "mylib.fullname" is defined differently in app/charts/b/templates/_helpers.tpl and app/charts/a/templates/_helpers.tpl`)
+
+	// Identical definitions do not collide
+	manifests, err := e.RenderAllChartTemplates(newChart("{{ .Release.Name }}-a"), newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "name: test-release-a", manifests["app/charts/b/templates/cm.yaml"])
+
+	// Without the option the last definition silently wins
+	e, err = NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	manifests, err = e.RenderAllChartTemplates(newChart("{{ .Release.Name }}-b"), newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, manifests["app/charts/a/templates/cm.yaml"], manifests["app/charts/b/templates/cm.yaml"])
+}
+
+func TestFilesScopedToChart(t *testing.T) {
+	sub := newTestChart("sub", map[string]string{
+		"templates/cm.yaml": `{{ .Files.Get "files/config.txt" }}|{{ .Files.Get "./files/config.txt" }}|{{ .Files.Lines "/files/config.txt" | len }}`,
+	})
+	sub.Files = []*chart.File{{Name: "files/config.txt", Data: []byte("a=1\nb=2\n")}}
+
+	c := newTestChart("app", map[string]string{
+		"templates/cm.yaml": `{{ .Files.Get "files/config.txt" }}|{{ .Files.Get "charts/sub/files/config.txt" }}|{{ .Files.Glob "**" | len }}`,
+	})
+	c.AddDependency(sub)
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, "a=1\nb=2\n|a=1\nb=2\n|2", manifests["app/charts/sub/templates/cm.yaml"])
+	// The parent cannot read the subchart's files
+	assert.Equal(t, "||0", manifests["app/templates/cm.yaml"])
+}
+
+func TestChartMetadataAtEveryScope(t *testing.T) {
+	tpl := `{{ .Chart.Name }}|{{ .Chart.AppVersion }}|{{ index .Chart.Annotations "category" }}|{{ len .Chart.Dependencies }}|{{ len .Chart.Maintainers }}|{{ .Chart.IsRoot }}`
+	sub := newTestChart("sub", map[string]string{"templates/cm.yaml": tpl})
+	sub.Metadata.AppVersion = "2.0.0"
+	sub.Metadata.Annotations = map[string]string{"category": "Database"}
+	c := newTestChart("app", map[string]string{"templates/cm.yaml": tpl})
+	c.Metadata.AppVersion = "1.0.0"
+	c.Metadata.Annotations = map[string]string{"category": "WebApp"}
+	c.Metadata.Dependencies = []*chart.Dependency{{Name: "sub", Version: "0.1.0"}}
+	c.Metadata.Maintainers = []*chart.Maintainer{{Name: "someone"}}
+	c.AddDependency(sub)
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, "app|1.0.0|WebApp|1|1|true", manifests["app/templates/cm.yaml"])
+	assert.Equal(t, "sub|2.0.0|Database|0|0|false", manifests["app/charts/sub/templates/cm.yaml"])
+}
+
+func TestFilesList(t *testing.T) {
+	sub := newTestChart("sub", map[string]string{
+		"templates/cm.yaml": `{{ filesList "files/*" | join "," }}`,
+	})
+	sub.Files = []*chart.File{{Name: "files/sub.conf", Data: []byte("sub")}}
+
+	c := newTestChart("app", map[string]string{
+		"templates/cm.yaml": `{{- range filesList "files/*.conf" }}
+{{ . }}: {{ $.Files.Get . }}
+{{- end }}
+{{ filesList "files/**" | join "," }}|{{ filesList "missing/*" | len }}`,
+	})
+	c.Files = []*chart.File{
+		{Name: "files/b.conf", Data: []byte("b")},
+		{Name: "files/a.conf", Data: []byte("a")},
+		{Name: "files/readme.md", Data: []byte("readme")},
+		{Name: "files/nested/c.conf", Data: []byte("c")},
+		{Name: "other/d.conf", Data: []byte("d")},
+	}
+	c.AddDependency(sub)
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, `
+files/a.conf: a
+files/b.conf: b
+files/a.conf,files/b.conf,files/nested/c.conf,files/readme.md|0`, manifests["app/templates/cm.yaml"])
+	assert.Equal(t, "files/sub.conf", manifests["app/charts/sub/templates/cm.yaml"])
+}
+
+func TestToResource(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("resource", map[string]string{
+		"templates/cm.yaml": `{{ toResource (dict
+  "data" (dict "b" "2" "a" "1")
+  "spec" (dict "replicas" 1)
+  "metadata" (dict "name" "cm" "labels" (dict "app" "x"))
+  "kind" "ConfigMap"
+  "apiVersion" "v1") }}`,
+		"templates/missing.yaml": `{{ toResource (dict "apiVersion" "v1" "metadata" (dict "name" "cm")) }}`,
+	})
+
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "toResource: object is missing kind")
+
+	assert.Equal(t, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  labels:
+    app: x
+  name: cm
+spec:
+  replicas: 1
+data:
+  a: "1"
+  b: "2"`, result.Manifests["resource/templates/cm.yaml"])
+}
+
+// newPreparedTestChart returns a chart with a subchart and shared named
+// templates, for the PreparedChart tests and benchmarks.
+func newPreparedTestChart() *chart.Chart {
+	sub := newTestChart("sub", map[string]string{
+		"templates/_helpers.tpl": `{{- define "sub.name" -}}{{ .Release.Name }}-{{ .Values.name }}{{- end -}}`,
+		"templates/cm.yaml":      `name: {{ include "sub.name" . }}`,
+	})
+	sub.Values = map[string]interface{}{"name": "sub"}
+
+	c := newTestChart("app", map[string]string{
+		"templates/_helpers.tpl": `{{- define "app.labels" -}}app: {{ .Values.name }}{{- end -}}`,
+		"templates/cm.yaml": `metadata:
+  labels:
+    {{- include "app.labels" . | nindent 4 }}
+data:
+  greeting: {{ tpl .Values.greeting . }}`,
+	})
+	c.AddDependency(sub)
+	return c
+}
+
+func TestPreparedChart(t *testing.T) {
+	c := newPreparedTestChart()
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	p, err := e.Prepare(c)
+	require.NoError(t, err)
+
+	for _, name := range []string{"one", "two", "three"} {
+		vals := newRenderValues(map[string]interface{}{
+			"name":     name,
+			"greeting": "hello {{ .Values.name }}",
+			"sub":      map[string]interface{}{"name": name},
+		})
+
+		expected, err := e.RenderAllChartTemplates(c, vals)
+		require.NoError(t, err)
+		manifests, err := p.Render(vals)
+		require.NoError(t, err)
+
+		assert.Equal(t, expected, manifests)
+		assert.Equal(t, "name: test-release-"+name, manifests["app/charts/sub/templates/cm.yaml"])
+	}
+
+	// Parse errors are reported by Prepare
+	_, err = e.Prepare(newTestChart("broken", map[string]string{"templates/cm.yaml": `{{ .Values.name`}))
+	assert.Error(t, err)
+}
+
+// newBenchmarkChart returns a chart with enough templates for parsing to be a
+// significant part of rendering it.
+func newBenchmarkChart() *chart.Chart {
+	c := newPreparedTestChart()
+	for i := 0; i < 50; i++ {
+		c.Templates = append(c.Templates, &chart.File{
+			Name: fmt.Sprintf("templates/cm%d.yaml", i),
+			Data: []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}-` + fmt.Sprint(i) + `
+  labels:
+    {{- include "app.labels" . | nindent 4 }}
+data:
+  {{- range $k, $v := .Values }}
+  {{- if kindIs "string" $v }}
+  {{ $k }}: {{ $v | quote }}
+  {{- end }}
+  {{- end }}
+  {{- with .Values.missing }}
+  missing: {{ . | default "none" | upper | quote }}
+  {{- end }}`),
+		})
+	}
+	return c
+}
+
+func BenchmarkRenderAllChartTemplates(b *testing.B) {
+	c := newBenchmarkChart()
+	vals := newRenderValues(map[string]interface{}{"name": "app", "greeting": "hello"})
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := e.RenderAllChartTemplates(c, vals); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPreparedChartRender(b *testing.B) {
+	c := newBenchmarkChart()
+	vals := newRenderValues(map[string]interface{}{"name": "app", "greeting": "hello"})
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(b, err)
+	p, err := e.Prepare(c)
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Render(vals); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// newRecursiveChart returns a chart including a template recursively depth
+// times over.
+func newRecursiveChart(depth int) *chart.Chart {
+	return newTestChart("recursive", map[string]string{
+		"templates/_helpers.tpl": `{{- define "countdown" -}}
+{{- if gt . 0 }}{{ include "countdown" (sub . 1) }}{{ else }}done{{ end -}}
+{{- end -}}`,
+		"templates/cm.yaml": fmt.Sprintf(`{{ include "countdown" %d }}`, depth),
+	})
+}
+
+func TestWithRecursionGuard(t *testing.T) {
+	c := newRecursiveChart(1200)
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	assert.ErrorContains(t, err, "rendering template has a nested reference name: countdown")
+
+	e, err = NewEngine(&mockHostFunctions{}, WithRecursionGuard(false))
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "done", manifests["recursive/templates/cm.yaml"])
+}
+
+func BenchmarkRecursionGuard(b *testing.B) {
+	c := newRecursiveChart(500)
+	vals := newRenderValues(nil)
+	for _, guard := range []bool{true, false} {
+		b.Run(fmt.Sprintf("guard=%t", guard), func(b *testing.B) {
+			e, err := NewEngine(&mockHostFunctions{}, WithRecursionGuard(guard))
+			require.NoError(b, err)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := e.RenderAllChartTemplates(c, vals); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWithOpenAPIValidation(t *testing.T) {
+	schema := []byte(`{
+  "definitions": {
+    "io.k8s.api.apps.v1.Deployment": {
+      "type": "object",
+      "properties": {
+        "apiVersion": {"type": "string"},
+        "kind": {"type": "string"},
+        "metadata": {"$ref": "#/definitions/io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta"},
+        "spec": {"$ref": "#/definitions/io.k8s.api.apps.v1.DeploymentSpec"}
+      },
+      "x-kubernetes-group-version-kind": [{"group": "apps", "version": "v1", "kind": "Deployment"}]
+    },
+    "io.k8s.api.apps.v1.DeploymentSpec": {
+      "type": "object",
+      "properties": {
+        "replicas": {"type": "integer"},
+        "template": {"type": "object"},
+        "strategy": {
+          "type": "object",
+          "properties": {"rollingUpdate": {"type": "object", "properties": {"maxSurge": {"type": "string", "format": "int-or-string"}}}}
+        }
+      }
+    },
+    "io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta": {
+      "type": "object",
+      "properties": {
+        "name": {"type": "string"},
+        "labels": {"type": "object", "additionalProperties": {"type": "string"}}
+      }
+    }
+  }
+}`)
+
+	c := newTestChart("openapi", map[string]string{
+		"templates/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    app: web
+    tier: 1
+spec:
+  replcias: 3
+  replicas: "3"
+  strategy:
+    rollingUpdate:
+      maxSurge: 1
+  template:
+    anything: goes`,
+		"templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unknown-kind
+unknown: field`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithOpenAPIValidation(schema))
+	require.NoError(t, err)
+	_, err = e.Render(context.Background(), c, newRenderValues(nil))
+	require.Error(t, err)
+	assert.Equal(t, `openapi/templates/deployment.yaml: document 0: Deployment apps/v1: metadata.labels.tier: expected string, got integer
+openapi/templates/deployment.yaml: document 0: Deployment apps/v1: spec.replcias: unknown field
+openapi/templates/deployment.yaml: document 0: Deployment apps/v1: spec.replicas: expected integer, got string`, err.Error())
+
+	_, err = NewEngine(&mockHostFunctions{}, WithOpenAPIValidation([]byte(`{}`)))
+	assert.Error(t, err)
+}
+
+func TestJSONPath(t *testing.T) {
+	svc := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{"example.com/owner": "team"},
+		},
+		"status": map[string]interface{}{
+			"loadBalancer": map[string]interface{}{
+				"ingress": []interface{}{
+					map[string]interface{}{"ip": "203.0.113.10"},
+				},
+			},
+		},
+	}
+	e, err := NewEngine(&mockHostFunctions{
+		lookup: func(_, _, _, _ string) (map[string]interface{}, error) {
+			return svc, nil
+		},
+	})
+	require.NoError(t, err)
+
+	c := newTestChart("jsonpath", map[string]string{
+		"templates/cm.yaml": `{{- $svc := lookup "v1" "Service" "default" "web" -}}
+ip: {{ jsonpath "{.status.loadBalancer.ingress[0].ip}" $svc }}
+owner: {{ jsonpath "{.metadata.annotations['example.com/owner']}" $svc }}
+dollar: {{ jsonpath "$.status.loadBalancer.ingress[0].ip" $svc }}
+missing: "{{ jsonpath "{.status.loadBalancer.ingress[1].ip}" $svc }}"`,
+	})
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, `ip: 203.0.113.10
+owner: team
+dollar: 203.0.113.10
+missing: ""`, manifests["jsonpath/templates/cm.yaml"])
+}
+
+func TestKubeVersionAtLeast(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("kubeversion", map[string]string{
+		"templates/cm.yaml": `{{ kubeVersionAtLeast "1.25" }} {{ kubeVersionAtLeast "1.25.3" }} {{ kubeVersionAtLeast "1.26" }}`,
+	})
+
+	for version, expected := range map[string]string{
+		"v1.24.9":         "false false false",
+		"v1.25.0":         "true false false",
+		"v1.25.3-gke.100": "true true false",
+		"1.26.1+k3s1":     "true true true",
+	} {
+		vals := newRenderValues(nil)
+		vals["Capabilities"] = map[string]interface{}{
+			"KubeVersion": map[string]interface{}{"Version": version},
+		}
+		manifests, err := e.RenderAllChartTemplates(c, vals)
+		require.NoError(t, err, version)
+		assert.Equal(t, expected, manifests["kubeversion/templates/cm.yaml"], version)
+	}
+
+	// Without a Kubernetes version there is nothing to compare
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	assert.ErrorContains(t, err, "no Kubernetes version in Capabilities.KubeVersion.Version")
+}
+
+func TestTruncName(t *testing.T) {
+	at := strings.Repeat("a", 59) + "-web"
+	over := strings.Repeat("r", 40) + "-" + strings.Repeat("c", 30) + "-server"
+
+	assert.Equal(t, "release-chart-server", truncName("release", "chart", "", "server"))
+	assert.Equal(t, at, truncName(at))
+	assert.Equal(t, over[:63], truncName(over))
+	// Trailing dashes left by the truncation are trimmed
+	assert.Equal(t, strings.Repeat("a", 62), truncName(strings.Repeat("a", 62), "b"))
+
+	assert.Equal(t, "release-chart-server", truncNameHash("release", "chart", "server"))
+	assert.Equal(t, at, truncNameHash(at))
+	hashed := truncNameHash(over)
+	assert.Len(t, hashed, 63)
+	assert.True(t, strings.HasPrefix(hashed, over[:54]+"-"), hashed)
+	assert.NotEqual(t, hashed, truncNameHash(over+"-2"))
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	c := newTestChart("trunc", map[string]string{
+		"templates/cm.yaml": `name: {{ truncName .Release.Name .Chart.Name "server" }}`,
+	})
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "name: test-release-trunc-server", manifests["trunc/templates/cm.yaml"])
+}
+
+func TestRenderHostCalls(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{}, WithSecrets(true))
+	require.NoError(t, err)
+
+	c := newTestChart("calls", map[string]string{
+		"templates/cm.yaml": `{{- range until 5 }}{{ lookup "v1" "ConfigMap" "default" (print "cm-" .) }}{{ end }}
+{{- resolveSecret "vault:db" }}`,
+		"templates/noop.yaml": `noop: true`,
+	})
+
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"LookupKubernetesResource": 5, "ResolveSecret": 1}, result.HostCalls)
+
+	// Counts are per render
+	result, err = e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, 5, result.HostCalls["LookupKubernetesResource"])
+}
+
+func TestRenderedBytes(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("bytes", map[string]string{
+		"templates/small.yaml": `small: true`,
+		"templates/large.yaml": `large: {{ repeat 100 "x" }}`,
+	})
+
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, len("small: true")+len("large: ")+100, result.RenderedBytes)
+	assert.Equal(t, len("large: ")+100, result.PeakTemplateBytes)
+
+	// Totals are per render
+	result, err = e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, len("small: true")+len("large: ")+100, result.RenderedBytes)
+}
+
+func TestWithDeprecatedFunctions(t *testing.T) {
+	c := newTestChart("deprecated", map[string]string{
+		"templates/cm.yaml": `{{ range until 3 }}{{ trimAll "-" "-a-" }}{{ end }} {{ list 1 2 | len }}`,
+		"templates/ok.yaml": `{{ trim " a " }}`,
+		"templates/if.yaml": `{{ if false }}{{ trimAll "-" "-a-" }}{{ end }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithDeprecatedFunctions([]string{"trimAll", "list"}, false))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "aaa 2", result.Manifests["deprecated/templates/cm.yaml"])
+	assert.ElementsMatch(t, []string{
+		`deprecated/templates/cm.yaml: function "trimAll" is deprecated`,
+		`deprecated/templates/cm.yaml: function "list" is deprecated`,
+	}, result.Warnings)
+
+	e, err = NewEngine(&mockHostFunctions{}, WithDeprecatedFunctions([]string{"trimAll"}, true))
+	require.NoError(t, err)
+	result, err = e.Render(context.Background(), c, newRenderValues(nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `execution error at (deprecated/templates/cm.yaml:1:22): deprecated/templates/cm.yaml: function "trimAll" is deprecated`)
+	assert.Equal(t, "a", result.Manifests["deprecated/templates/ok.yaml"])
+
+	_, err = NewEngine(&mockHostFunctions{}, WithDeprecatedFunctions([]string{"noSuchFunction"}, false))
+	assert.Error(t, err)
+}
+
+func TestWithDeprecatedFunctionsInTpl(t *testing.T) {
+	c := newTestChart("deprecated", map[string]string{
+		"templates/_helpers.tpl": `{{ define "name" }}app{{ end }}`,
+		"templates/config.yaml":  `a: b`,
+		"templates/cm.yaml":      `{{ range until 2 }}{{ tpl "{{ include \"name\" . }} {{ configChecksum \"config.yaml\" | len }}" $ }}{{ end }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithDeprecatedFunctions([]string{"include"}, false))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "app 64app 64", result.Manifests["deprecated/templates/cm.yaml"])
+	assert.Equal(t, []string{`deprecated/templates/cm.yaml: function "include" is deprecated`}, result.Warnings)
+}
+
+func TestWithSubchartValues(t *testing.T) {
+	newSub := func(name string) *chart.Chart {
+		sub := newTestChart(name, map[string]string{
+			"templates/cm.yaml": `{{ .Values.image.repository }}:{{ .Values.image.tag }}`,
+		})
+		sub.Values = map[string]interface{}{
+			"image": map[string]interface{}{"repository": name, "tag": "v1"},
+		}
+		return sub
+	}
+	c := newTestChart("app", nil)
+	c.AddDependency(newSub("web"), newSub("worker"))
+
+	vals := newRenderValues(map[string]interface{}{
+		"web":    map[string]interface{}{"image": map[string]interface{}{"tag": "v2"}},
+		"worker": map[string]interface{}{"image": map[string]interface{}{"tag": "v2"}},
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithSubchartValues(map[string]releasevalues.Values{
+		"app/charts/web": {"image": map[string]interface{}{"tag": "v3"}},
+	}))
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+
+	assert.Equal(t, "web:v3", manifests["app/charts/web/templates/cm.yaml"])
+	assert.Equal(t, "worker:v2", manifests["app/charts/worker/templates/cm.yaml"])
+}
+
+func TestWithLabelValidation(t *testing.T) {
+	long := strings.Repeat("a", 64)
+	c := newTestChart("labels", map[string]string{
+		"templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  labels:
+    app.kubernetes.io/name: web
+    version: ` + long + `
+    bad_key-: x
+    Bad.Prefix/name: x
+  annotations:
+    example.com/description: "any value at all, even ` + long + `"
+    -invalid: x`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithLabelValidation(true))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`labels/templates/cm.yaml: document 0: ConfigMap "config": label "Bad.Prefix/name": key prefix must be a DNS subdomain`,
+		`labels/templates/cm.yaml: document 0: ConfigMap "config": label "bad_key-": key name must consist of alphanumeric characters, '-', '_' or '.', and start and end with an alphanumeric character`,
+		`labels/templates/cm.yaml: document 0: ConfigMap "config": label "version": value must be no more than 63 characters`,
+		`labels/templates/cm.yaml: document 0: ConfigMap "config": annotation "-invalid": key name must consist of alphanumeric characters, '-', '_' or '.', and start and end with an alphanumeric character`,
+	}, result.Warnings)
+}
+
+func TestWithMandatoryLabels(t *testing.T) {
+	c := newTestChart("policy", map[string]string{
+		"templates/compliant.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: compliant
+  labels:
+    cost-center: "1234"
+    team: web`,
+		"templates/missing.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  name: missing
+  labels:
+    team: web
+---
+kind: List
+items: []`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithMandatoryLabels([]string{"cost-center", "team"}, true))
+	require.NoError(t, err)
+	_, err = e.Render(context.Background(), c, newRenderValues(nil))
+	require.Error(t, err)
+	assert.Equal(t, `policy/templates/missing.yaml: document 0: Secret "missing": missing mandatory label(s): cost-center`, err.Error())
+
+	// Common labels count
+	e, err = NewEngine(&mockHostFunctions{},
+		WithMandatoryLabels([]string{"cost-center", "team"}, true),
+		WithCommonLabels(map[string]string{"cost-center": "1234"}))
+	require.NoError(t, err)
+	_, err = e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	// Only warn unless failing
+	e, err = NewEngine(&mockHostFunctions{}, WithMandatoryLabels([]string{"cost-center", "team"}, false))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, []string{`policy/templates/missing.yaml: document 0: Secret "missing": missing mandatory label(s): cost-center`}, result.Warnings)
+}
+
+func TestWithResultCache(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{}, WithResultCache(1))
+	require.NoError(t, err)
+
+	c := newTestChart("cache", map[string]string{
+		"templates/cm.yaml": `{{ lookup "v1" "ConfigMap" "default" "cm" | len }} {{ .Values.name }}`,
+	})
+	lookups := func(result *RenderResult) int { return result.HostCalls["LookupKubernetesResource"] }
+
+	first, err := e.Render(context.Background(), c, newRenderValues(map[string]interface{}{"name": "a"}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, lookups(first))
+
+	// An identical render is served from the cache
+	second, err := e.Render(context.Background(), c, newRenderValues(map[string]interface{}{"name": "a"}))
+	require.NoError(t, err)
+	assert.Equal(t, 0, lookups(second))
+	assert.Equal(t, first.Manifests, second.Manifests)
+
+	// Cached results are copies
+	second.Manifests["cache/templates/cm.yaml"] = "modified"
+	third, err := e.Render(context.Background(), c, newRenderValues(map[string]interface{}{"name": "a"}))
+	require.NoError(t, err)
+	assert.Equal(t, "0 a", third.Manifests["cache/templates/cm.yaml"])
+
+	// Changed values or templates are rendered again
+	result, err := e.Render(context.Background(), c, newRenderValues(map[string]interface{}{"name": "b"}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, lookups(result))
+	assert.Equal(t, "0 b", result.Manifests["cache/templates/cm.yaml"])
+
+	c.Templates[0].Data = []byte(`{{ lookup "v1" "ConfigMap" "default" "cm" | len }} {{ .Values.name }}!`)
+	result, err = e.Render(context.Background(), c, newRenderValues(map[string]interface{}{"name": "b"}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, lookups(result))
+	assert.Equal(t, "0 b!", result.Manifests["cache/templates/cm.yaml"])
+
+	// The least recently used result was evicted
+	result, err = e.Render(context.Background(), c, newRenderValues(map[string]interface{}{"name": "b"}))
+	require.NoError(t, err)
+	assert.Equal(t, 0, lookups(result))
+	c.Templates[0].Data = []byte(`{{ lookup "v1" "ConfigMap" "default" "cm" | len }} {{ .Values.name }}`)
+	result, err = e.Render(context.Background(), c, newRenderValues(map[string]interface{}{"name": "a"}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, lookups(result))
+}
+
+func TestWithResultCacheCopiesResult(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{}, WithResultCache(1), WithGroupByChart(true), WithIncludePartials(true))
+	require.NoError(t, err)
+
+	sub := newTestChart("sub", map[string]string{
+		"templates/sub.yaml": `{{ .Values.name }}`,
+	})
+	c := newTestChart("cache", map[string]string{
+		"templates/_helpers.tpl": `{{ define "name" }}{{ .Values.name }}{{ end }}`,
+		"templates/cm.yaml":      `{{ include "name" . }}`,
+		"templates/empty.yaml":   ` `,
+	})
+	c.AddDependency(sub)
+	vals := newRenderValues(map[string]interface{}{"name": "a", "sub": map[string]interface{}{"name": "b"}})
+
+	first, err := e.Render(context.Background(), c, vals)
+	require.NoError(t, err)
+	require.NotEmpty(t, first.ChartGroups)
+	require.NotZero(t, first.RenderedBytes)
+	require.NotZero(t, first.Stats.Rendered)
+
+	second, err := e.Render(context.Background(), c, vals)
+	require.NoError(t, err)
+	// No host functions are called for a cached result
+	assert.Empty(t, second.HostCalls)
+	second.HostCalls = first.HostCalls
+	assert.Equal(t, first, second)
+
+	// The chart groups of the cached result are copies
+	second.ChartGroups["cache"][0] = "modified"
+	third, err := e.Render(context.Background(), c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, first.ChartGroups, third.ChartGroups)
+}
+
+func TestWithResultCacheBypass(t *testing.T) {
+	c := newTestChart("cache", map[string]string{
+		"templates/cm.yaml": `{{ .Values.replicas }}`,
+	})
+	vals := newRenderValues(map[string]interface{}{})
+
+	// Values looked up from the cluster are not part of the cache key
+	replicas := "1"
+	host := &mockHostFunctions{
+		lookup: func(_, _, _, _ string) (map[string]interface{}, error) {
+			return map[string]interface{}{
+				"data": map[string]interface{}{"values.yaml": "replicas: " + replicas},
+			}, nil
+		},
+	}
+	e, err := NewEngine(host, WithResultCache(1), WithValuesFromLookup("v1", "ConfigMap", "config", "env", "values.yaml"))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "1", result.Manifests["cache/templates/cm.yaml"])
+
+	replicas = "2"
+	result, err = e.Render(context.Background(), c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "2", result.Manifests["cache/templates/cm.yaml"])
+
+	// The values dump and execution trace are written on every render
+	var dump, trace bytes.Buffer
+	e, err = NewEngine(&mockHostFunctions{}, WithResultCache(1), WithValuesDump(&dump), WithExecutionTrace(&trace))
+	require.NoError(t, err)
+	_, err = e.Render(context.Background(), c, vals)
+	require.NoError(t, err)
+	firstDump, firstTrace := dump.String(), trace.String()
+	require.NotEmpty(t, firstDump)
+	require.NotEmpty(t, firstTrace)
+
+	dump.Reset()
+	trace.Reset()
+	_, err = e.Render(context.Background(), c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, firstDump, dump.String())
+	assert.NotEmpty(t, trace.String())
+}
+
+func TestPatchResource(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("patch", map[string]string{
+		"templates/container.yaml": `{{ patchResource .Values.container .Values.patch | toYaml }}
+---
+{{ .Values.container | toYaml }}`,
+	})
+	vals, err := releasevalues.ReadValues([]byte(`
+container:
+  name: app
+  image: app:1.0
+  args: ["--verbose", "--port=80"]
+  resources:
+    requests:
+      cpu: 100m
+      memory: 128Mi
+    limits:
+      cpu: 500m
+patch:
+  args: ["--port=8080"]
+  resources:
+    limits:
+      cpu: "1"
+      memory: 512Mi
+`))
+	require.NoError(t, err)
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(vals))
+	require.NoError(t, err)
+	assert.Equal(t, `args:
+- --port=8080
+image: app:1.0
+name: app
+resources:
+  limits:
+    cpu: "1"
+    memory: 512Mi
+  requests:
+    cpu: 100m
+    memory: 128Mi
+---
+args:
+- --verbose
+- --port=80
+image: app:1.0
+name: app
+resources:
+  limits:
+    cpu: 500m
+  requests:
+    cpu: 100m
+    memory: 128Mi`, manifests["patch/templates/container.yaml"])
+}
+
+func TestCoalesceWithClear(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("coalesce", map[string]string{
+		"templates/cm.yaml": `{{ coalesceWithClear .Values.defaults .Values.overrides | toYaml }}
+---
+{{ .Values.defaults | toYaml }}`,
+	})
+	vals, err := releasevalues.ReadValues([]byte(`
+defaults:
+  replicas: 1
+  nodeSelector:
+    disktype: ssd
+  resources:
+    limits:
+      cpu: 500m
+      memory: 128Mi
+  tolerations: [a, b]
+overrides:
+  nodeSelector: null
+  resources:
+    limits:
+      memory: null
+      cpu: "1"
+  tolerations: [c]
+  extra:
+    keep: true
+    drop: null
+`))
+	require.NoError(t, err)
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(vals))
+	require.NoError(t, err)
+	// Absent keys keep their default, explicit nulls remove it
+	assert.Equal(t, `extra:
+  keep: true
+replicas: 1
+resources:
+  limits:
+    cpu: "1"
+tolerations:
+- c
+---
+nodeSelector:
+  disktype: ssd
+replicas: 1
+resources:
+  limits:
+    cpu: 500m
+    memory: 128Mi
+tolerations:
+- a
+- b`, manifests["coalesce/templates/cm.yaml"])
+}
+
+func TestPickPaths(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("pick", map[string]string{
+		"templates/cm.yaml": `{{ pickPaths .Values.deployment (list "metadata.annotations" "spec.template.spec.serviceAccountName" "spec.missing") | toYaml }}`,
+	})
+	vals, err := releasevalues.ReadValues([]byte(`
+deployment:
+  metadata:
+    name: web
+    annotations:
+      example.com/owner: team-a
+  spec:
+    replicas: 3
+    template:
+      spec:
+        serviceAccountName: web
+        containers:
+        - name: web
+`))
+	require.NoError(t, err)
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(vals))
+	require.NoError(t, err)
+	assert.Equal(t, `metadata:
+  annotations:
+    example.com/owner: team-a
+spec:
+  template:
+    spec:
+      serviceAccountName: web`, manifests["pick/templates/cm.yaml"])
+}
+
+func TestValuesChecksum(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("checksum", map[string]string{
+		"templates/cm.yaml": `{{ valuesChecksum .Values }}`,
+	})
+
+	first, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"a": 1, "b": "x"}))
+	require.NoError(t, err)
+	second, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"b": "x", "a": 1.0}))
+	require.NoError(t, err)
+	changed, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"a": 2, "b": "x"}))
+	require.NoError(t, err)
+
+	sum, err := releasevalues.Values{"a": 1, "b": "x"}.Checksum()
+	require.NoError(t, err)
+	assert.Equal(t, sum, first["checksum/templates/cm.yaml"])
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, changed)
+}
+
+func TestMergeEnv(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("env", map[string]string{
+		"templates/env.yaml":   `{{ mergeEnv .Values.env .Values.extraEnv | toYaml }}`,
+		"templates/empty.yaml": `{{ mergeEnv .Values.env .Values.missing | len }}`,
+	})
+	vals, err := releasevalues.ReadValues([]byte(`
+env:
+  - name: LOG_LEVEL
+    value: info
+  - name: PASSWORD
+    value: changeme
+  - name: APP
+    value: web
+extraEnv:
+  - name: PASSWORD
+    valueFrom:
+      secretKeyRef:
+        name: db
+        key: password
+  - name: LOG_LEVEL
+    value: debug
+`))
+	require.NoError(t, err)
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(vals))
+	require.NoError(t, err)
+	assert.Equal(t, `- name: APP
+  value: web
+- name: LOG_LEVEL
+  value: debug
+- name: PASSWORD
+  valueFrom:
+    secretKeyRef:
+      key: password
+      name: db`, manifests["env/templates/env.yaml"])
+	assert.Equal(t, "3", manifests["env/templates/empty.yaml"])
+
+	_, err = mergeEnv([]interface{}{map[string]interface{}{"value": "x"}}, nil)
+	assert.EqualError(t, err, "mergeEnv: env entry has no name: map[value:x]")
+}
+
+func TestTemplateNamePerTemplate(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	// Each template keeps its context in the shared values, and prints the
+	// name of the other template from the context it kept, if any.
+	c := newTestChart("names", map[string]string{
+		"templates/a.yaml": `{{- $_ := set .Values "a" $ -}}{{ .Template.Name }} {{ with .Values.b }}{{ .Template.Name }}{{ end }}`,
+		"templates/b.yaml": `{{- $_ := set .Values "b" $ -}}{{ .Template.Name }} {{ with .Values.a }}{{ .Template.Name }}{{ end }}`,
+	})
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	a, b := manifests["names/templates/a.yaml"], manifests["names/templates/b.yaml"]
+	// Whichever rendered second sees the other's own Template
+	if a == "names/templates/a.yaml " {
+		assert.Equal(t, "names/templates/b.yaml names/templates/a.yaml", b)
+	} else {
+		assert.Equal(t, "names/templates/a.yaml names/templates/b.yaml", a)
+		assert.Equal(t, "names/templates/b.yaml ", b)
+	}
+}
+
+func TestIncludeIfPresent(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("present", map[string]string{
+		"templates/_helpers.tpl": `{{- define "present.annotations" }}
+{{ with .Values.annotations }}{{ toYaml . }}{{ end }}
+{{ end -}}`,
+		"templates/cm.yaml": `metadata:
+  name: cm
+{{- with includeIfPresent "present.annotations" . }}
+  annotations:
+    {{- . | trim | nindent 4 }}
+{{- end }}`,
+	})
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "metadata:\n  name: cm", manifests["present/templates/cm.yaml"])
+
+	manifests, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{
+		"annotations": map[string]interface{}{"owner": "team"},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "metadata:\n  name: cm\n  annotations:\n    owner: team", manifests["present/templates/cm.yaml"])
+}
+
+func TestIncludeYaml(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("yaml", map[string]string{
+		"templates/_helpers.tpl": `{{- define "yaml.broken" }}key: [unclosed{{ end -}}`,
+		"templates/pod.yaml": `kind: Pod
+spec:
+  containers:
+  {{- range .Values.containers }}
+  - name: {{ . }}
+  {{- end }}`,
+		"templates/cm.yaml": `{{- $pod := includeYaml "yaml/templates/pod.yaml" . -}}
+containers: {{ len $pod.spec.containers }}
+first: {{ (index $pod.spec.containers 0).name }}`,
+	})
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{
+		"containers": []interface{}{"app", "sidecar"},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "containers: 2\nfirst: app", manifests["yaml/templates/cm.yaml"])
+
+	c.Templates = append(c.Templates, &chart.File{Name: "templates/broken.yaml", Data: []byte(`{{ includeYaml "yaml.broken" . }}`)})
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{
+		"containers": []interface{}{"app"},
+	}))
+	assert.ErrorContains(t, err, `includeYaml: output of template "yaml.broken" is not valid YAML`)
+}
+
+func TestWithCommonLabels(t *testing.T) {
+	c := newTestChart("labels", map[string]string{
+		"templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: plain
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: labelled
+  labels:
+    app.kubernetes.io/managed-by: Operator
+    tier: web`,
+		"templates/list.yaml": `- not
+- a resource`,
+		"templates/NOTES.txt": `Thank you`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithCommonLabels(map[string]string{
+		"app.kubernetes.io/managed-by": "Helm",
+		"app.kubernetes.io/instance":   "test-release",
+	}))
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  labels:
+    app.kubernetes.io/instance: test-release
+    app.kubernetes.io/managed-by: Helm
+  name: plain
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  labels:
+    app.kubernetes.io/instance: test-release
+    app.kubernetes.io/managed-by: Operator
+    tier: web
+  name: labelled
+`, manifests["labels/templates/cm.yaml"])
+	assert.Equal(t, "- not\n- a resource", manifests["labels/templates/list.yaml"])
+	assert.Equal(t, "Thank you", manifests["labels/templates/NOTES.txt"])
+
+	// The checks and conversions after the labels are added see them
+	e, err = NewEngine(&mockHostFunctions{},
+		WithCommonLabels(map[string]string{"team": "platform"}),
+		WithMandatoryLabels([]string{"team"}, true),
+		WithOutputJSON(true))
+	require.NoError(t, err)
+	manifests, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Contains(t, manifests["labels/templates/cm.yaml"], `"team": "platform"`)
+	assert.Equal(t, "[\n  \"not\",\n  \"a resource\"\n]", manifests["labels/templates/list.yaml"])
+}
+
+func TestIsLintMode(t *testing.T) {
+	c := newTestChart("lint", map[string]string{
+		"templates/cm.yaml": `always{{ if not isLintMode }} guarded{{ end }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithLintMode(true))
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "always", manifests["lint/templates/cm.yaml"])
+
+	e, err = NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	manifests, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "always guarded", manifests["lint/templates/cm.yaml"])
+}
+
+func TestImageDigest(t *testing.T) {
+	host := &mockHostFunctions{
+		resolveImageDigest: func(ref string) (string, error) {
+			if ref == "nginx:1.27" {
+				return "nginx@sha256:0123abcd", nil
+			}
+			return "", errors.New("manifest unknown")
+		},
+	}
+	c := newTestChart("images", map[string]string{
+		"templates/pod.yaml": `image: {{ imageDigest .Values.image }}`,
+	})
+
+	e, err := NewEngine(host, WithImageResolution(true))
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"image": "nginx:1.27"}))
+	require.NoError(t, err)
+	assert.Equal(t, "image: nginx@sha256:0123abcd", manifests["images/templates/pod.yaml"])
+
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"image": "nginx:missing"}))
+	assert.ErrorContains(t, err, `failed to resolve digest of image "nginx:missing": manifest unknown`)
+
+	// Disabled by default
+	e, err = NewEngine(host)
+	require.NoError(t, err)
+	manifests, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"image": "nginx:1.27"}))
+	require.NoError(t, err)
+	assert.Equal(t, "image: nginx:1.27", manifests["images/templates/pod.yaml"])
+}
+
+func TestWithLookupRetry(t *testing.T) {
+	calls := 0
+	host := &mockHostFunctions{
+		lookup: func(_, _, _, name string) (map[string]interface{}, error) {
+			calls++
+			if name == "missing" {
+				return nil, errors.New("not found")
+			}
+			if calls <= 2 {
+				return nil, &RetryableError{Err: errors.New("too many requests")}
+			}
+			return map[string]interface{}{"metadata": map[string]interface{}{"name": name}}, nil
+		},
+	}
+	c := newTestChart("retry", map[string]string{
+		"templates/cm.yaml": `{{ (lookup "v1" "ConfigMap" "default" .Values.name).metadata.name }}`,
+	})
+
+	e, err := NewEngine(host, WithLookupRetry(3, time.Millisecond))
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"name": "app"}))
+	require.NoError(t, err)
+	assert.Equal(t, "app", manifests["retry/templates/cm.yaml"])
+	assert.Equal(t, 3, calls)
+
+	// Errors not marked retryable are returned on the first attempt
+	calls = 0
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"name": "missing"}))
+	assert.ErrorContains(t, err, "not found")
+	assert.Equal(t, 1, calls)
+
+	// Without retries the first transient error fails the render
+	calls = 0
+	e, err = NewEngine(host)
+	require.NoError(t, err)
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"name": "app"}))
+	assert.ErrorContains(t, err, "too many requests")
+	assert.Equal(t, 1, calls)
+
+	// Cancelling the render stops waiting for the next attempt
+	ctx, cancel := context.WithCancel(context.Background())
+	host = &mockHostFunctions{
+		lookup: func(_, _, _, _ string) (map[string]interface{}, error) {
+			cancel()
+			return nil, &RetryableError{Err: errors.New("too many requests")}
+		},
+	}
+	e, err = NewEngine(host, WithLookupRetry(3, time.Hour))
+	require.NoError(t, err)
+	_, err = e.RenderAllChartTemplatesContext(ctx, c, newRenderValues(map[string]interface{}{"name": "app"}))
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = NewEngine(host, WithLookupRetry(0, time.Millisecond))
+	assert.Error(t, err)
+}
+
+func TestWithRemoteDependencies(t *testing.T) {
+	sub := newTestChart("db", map[string]string{
+		"templates/statefulset.yaml": `kind: StatefulSet
+name: {{ .Chart.Name }}-{{ .Values.size }}`,
+	})
+	sub.Values = map[string]interface{}{"size": "small"}
+	archivePath, err := chartutil.Save(sub, t.TempDir())
+	require.NoError(t, err)
+	archive, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+
+	newUmbrella := func() *chart.Chart {
+		c := newTestChart("app", map[string]string{
+			"templates/deployment.yaml": `kind: Deployment`,
+		})
+		c.Metadata.Dependencies = []*chart.Dependency{{
+			Name:       "db",
+			Version:    "~0.1.0",
+			Repository: "https://charts.example.com",
+		}}
+		return c
+	}
+
+	var fetched []string
+	host := &mockHostFunctions{
+		fetchDependency: func(name, version, repository string) ([]byte, error) {
+			fetched = append(fetched, fmt.Sprintf("%s %s %s", name, version, repository))
+			return archive, nil
+		},
+	}
+	vals := newRenderValues(map[string]interface{}{"db": map[string]interface{}{"size": "large"}})
+
+	e, err := NewEngine(host, WithRemoteDependencies(true))
+	require.NoError(t, err)
+	c := newUmbrella()
+	require.NoError(t, e.ProcessDependencies(c, vals))
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"db ~0.1.0 https://charts.example.com"}, fetched)
+	assert.Equal(t, "kind: StatefulSet\nname: db-large", manifests["app/charts/db/templates/statefulset.yaml"])
+
+	// Without remote dependencies, the missing dependency is left out
+	fetched = nil
+	e, err = NewEngine(host)
+	require.NoError(t, err)
+	c = newUmbrella()
+	require.NoError(t, e.ProcessDependencies(c, vals))
+	manifests, err = e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+
+	assert.Empty(t, fetched)
+	assert.Equal(t, map[string]string{"app/templates/deployment.yaml": "kind: Deployment"}, manifests)
+
+	// Fetch errors are returned
+	e, err = NewEngine(&mockHostFunctions{}, WithRemoteDependencies(true))
+	require.NoError(t, err)
+	err = e.ProcessDependencies(newUmbrella(), vals)
+	assert.ErrorContains(t, err, `failed to fetch dependency "db" of chart "app": chart db-~0.1.0 not found in https://charts.example.com`)
+
+	// Disabled dependencies are not fetched
+	e, err = NewEngine(&mockHostFunctions{}, WithRemoteDependencies(true))
+	require.NoError(t, err)
+	c = newUmbrella()
+	c.Metadata.Dependencies[0].Condition = "db.enabled"
+	c.Values = map[string]interface{}{"db": map[string]interface{}{"enabled": false}}
+	require.NoError(t, e.ProcessDependencies(c, vals))
+	assert.Empty(t, c.Dependencies())
+
+	// A vendored dependency of another version is replaced
+	fetched = nil
+	e, err = NewEngine(host, WithRemoteDependencies(true))
+	require.NoError(t, err)
+	stale := newTestChart("db", map[string]string{
+		"templates/statefulset.yaml": `stale`,
+	})
+	stale.Metadata.Version = "0.0.1"
+	c = newUmbrella()
+	c.AddDependency(stale)
+	require.NoError(t, e.ProcessDependencies(c, vals))
+
+	assert.Equal(t, []string{"db ~0.1.0 https://charts.example.com"}, fetched)
+	require.Len(t, c.Dependencies(), 1)
+	assert.Equal(t, "0.1.0", c.Dependencies()[0].Metadata.Version)
+}
+
+func TestConcatUnique(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("origins", map[string]string{
+		"templates/cm.yaml": `origins: {{ concatUnique .Values.defaultOrigins .Values.extraOrigins .Values.missing (list "https://c.example.com") | toJson }}`,
+	})
+	vals := newRenderValues(map[string]interface{}{
+		"defaultOrigins": []interface{}{"https://b.example.com", "https://a.example.com"},
+		"extraOrigins":   []interface{}{"https://c.example.com", "https://a.example.com", "https://b.example.com", "https://d.example.com"},
+	})
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, `origins: ["https://b.example.com","https://a.example.com","https://c.example.com","https://d.example.com"]`, manifests["origins/templates/cm.yaml"])
+
+	vals = newRenderValues(map[string]interface{}{"defaultOrigins": "https://a.example.com"})
+	_, err = e.RenderAllChartTemplates(c, vals)
+	assert.ErrorContains(t, err, "concatUnique: https://a.example.com is not a list")
+
+	vals = newRenderValues(map[string]interface{}{"defaultOrigins": []interface{}{8080}})
+	_, err = e.RenderAllChartTemplates(c, vals)
+	assert.ErrorContains(t, err, "concatUnique: 8080 is not a string")
+}
+
+func TestWithMissingKeySentinel(t *testing.T) {
+	c := newTestChart("typo", map[string]string{
+		"templates/cm.yaml": `image: {{ .Values.imgae }}
+tag: {{ .Values.tag }}
+command: {{ tpl "{{ .Values.comand }}" . }}`,
+	})
+	vals := newRenderValues(map[string]interface{}{"image": "nginx", "tag": "1.27"})
+
+	e, err := NewEngine(&mockHostFunctions{}, WithMissingKeySentinel("__MISSING__"))
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "image: __MISSING__\ntag: 1.27\ncommand: __MISSING__", manifests["typo/templates/cm.yaml"])
+
+	// Without a sentinel missing values render as nothing
+	e, err = NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	manifests, err = e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, "image: \ntag: 1.27\ncommand: ", manifests["typo/templates/cm.yaml"])
+
+	// Strict mode still fails
+	e, err = NewEngine(&mockHostFunctions{}, WithStrict(true), WithMissingKeySentinel("__MISSING__"))
+	require.NoError(t, err)
+	_, err = e.RenderAllChartTemplates(c, vals)
+	assert.ErrorContains(t, err, `map has no entry for key "imgae"`)
+}
+
+func TestNormalizeName(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("names", map[string]string{
+		"templates/cm.yaml": `name: {{ normalizeName .Values.name }}`,
+	})
+	for input, expected := range map[string]string{
+		"Frontend":                        "frontend",
+		"team_a.web server!":              "team-a-web-server",
+		"--My.App--":                      "my-app",
+		strings.Repeat("a", 70):           strings.Repeat("a", 63),
+		strings.Repeat("ab", 31) + "-x-y": strings.Repeat("ab", 31),
+	} {
+		manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"name": input}))
+		require.NoError(t, err)
+		assert.Equal(t, "name: "+expected, manifests["names/templates/cm.yaml"], input)
+	}
+}
+
+func TestMustName(t *testing.T) {
+	c := newTestChart("names", map[string]string{
+		"templates/cm.yaml": `name: {{ mustName .Values.name }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"name": "web-1"}))
+	require.NoError(t, err)
+	assert.Equal(t, "name: web-1", manifests["names/templates/cm.yaml"])
+
+	for name, msg := range map[string]string{
+		"Web":                   `name "Web" is not a valid DNS-1123 label`,
+		"web_1":                 `name "web_1" is not a valid DNS-1123 label`,
+		"-web":                  `name "-web" is not a valid DNS-1123 label`,
+		"":                      `name "" is not a valid DNS-1123 label`,
+		strings.Repeat("a", 64): "is longer than 63 characters",
+	} {
+		_, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"name": name}))
+		assert.ErrorContains(t, err, msg)
+	}
+
+	// Linting only warns
+	e, err = NewEngine(&mockHostFunctions{}, WithLintMode(true))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(map[string]interface{}{"name": "Web"}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{`name "Web" is not a valid DNS-1123 label`}, result.Warnings)
+}
+
+func TestResourcePreset(t *testing.T) {
+	c := newTestChart("sized", map[string]string{
+		"templates/deployment.yaml": `resources: {{ resourcePreset .Values.size | toJson }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"size": "small"}))
+	require.NoError(t, err)
+	assert.Equal(t, `resources: {"limits":{"cpu":"250m","memory":"256Mi"},"requests":{"cpu":"100m","memory":"128Mi"}}`, manifests["sized/templates/deployment.yaml"])
+
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"size": "huge"}))
+	assert.ErrorContains(t, err, `unknown resource preset "huge", expected one of large, medium, small`)
+
+	// Custom presets replace the defaults
+	e, err = NewEngine(&mockHostFunctions{}, WithResourcePresets(map[string]map[string]interface{}{
+		"huge": {
+			"requests": map[string]interface{}{"cpu": "8", "memory": "32Gi"},
+			"limits":   map[string]interface{}{"memory": "32Gi"},
+		},
+	}))
+	require.NoError(t, err)
+	manifests, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"size": "huge"}))
+	require.NoError(t, err)
+	assert.Equal(t, `resources: {"limits":{"memory":"32Gi"},"requests":{"cpu":"8","memory":"32Gi"}}`, manifests["sized/templates/deployment.yaml"])
+
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"size": "small"}))
+	assert.ErrorContains(t, err, `unknown resource preset "small", expected one of huge`)
+}
+
+func TestAnnotationsAndLabels(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("meta", map[string]string{
+		"templates/deployment.yaml": `metadata:
+  {{- with labels "app" .Values.app "tier" .Values.tier "version" .Values.version }}
+  labels:
+    {{- . | nindent 4 }}
+  {{- end }}
+  {{- with annotations "example.com/owner" .Values.owner "example.com/oncall" .Values.oncall "example.com/scrape" .Values.scrape }}
+  annotations:
+    {{- . | nindent 4 }}
+  {{- end }}`,
+	})
+
+	vals := newRenderValues(map[string]interface{}{
+		"app":     "web",
+		"tier":    "",
+		"version": json.Number("2"),
+		"owner":   "team-a",
+		"scrape":  true,
+	})
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, `metadata:
+  labels:
+    app: web
+    version: "2"
+  annotations:
+    example.com/owner: team-a
+    example.com/scrape: "true"`, manifests["meta/templates/deployment.yaml"])
+
+	// No values set omits the keys
+	manifests, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "metadata:", manifests["meta/templates/deployment.yaml"])
+
+	c = newTestChart("meta", map[string]string{
+		"templates/cm.yaml": `{{ labels "app" }}`,
+	})
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	assert.ErrorContains(t, err, "labels: expected alternating keys and values, got 1 arguments")
+}
+
+func TestWithExecutionTrace(t *testing.T) {
+	c := newTestChart("traced", map[string]string{
+		"templates/_helpers.tpl": `{{ define "traced.port" }}port: {{ . }}{{ end }}
+{{ define "traced.ports" }}{{ range . }}{{ include "traced.port" . }}
+{{ end }}{{ end }}`,
+		"templates/svc.yaml": `{{ include "traced.ports" .Values.ports }}{{ tpl "name: {{ .Release.Name }}" . }}`,
+	})
+	vals := newRenderValues(map[string]interface{}{"ports": []interface{}{80, 443, 8080, 8443, 9090}})
+
+	var trace bytes.Buffer
+	e, err := NewEngine(&mockHostFunctions{}, WithExecutionTrace(&trace))
+	require.NoError(t, err)
+
+	callCount := func(name string) string {
+		m := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(name) + ` +(\d+) +\S+ +\S+$`).FindStringSubmatch(trace.String())
+		if m == nil {
+			return ""
+		}
+		return m[1]
+	}
+
+	// Counters are reset per render
+	for i := 0; i < 2; i++ {
+		trace.Reset()
+		_, err = e.RenderAllChartTemplates(c, vals)
+		require.NoError(t, err)
+
+		assert.True(t, strings.HasPrefix(trace.String(), "TEMPLATE"), trace.String())
+		assert.Equal(t, "5", callCount("traced.port"), trace.String())
+		assert.Equal(t, "1", callCount("traced.ports"), trace.String())
+		assert.Equal(t, "1", callCount("tpl"), trace.String())
+		assert.Equal(t, "1", callCount("traced/templates/svc.yaml"), trace.String())
+	}
+}
+
+func TestMustEnum(t *testing.T) {
+	c := newTestChart("enum", map[string]string{
+		"templates/deployment.yaml": `strategy: {{ mustEnum .Values.strategy "RollingUpdate" "Recreate" }}`,
+	})
+
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"strategy": "Recreate"}))
+	require.NoError(t, err)
+	assert.Equal(t, "strategy: Recreate", manifests["enum/templates/deployment.yaml"])
+
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(map[string]interface{}{"strategy": "BlueGreen"}))
+	assert.ErrorContains(t, err, `value "BlueGreen" is not one of RollingUpdate, Recreate`)
+
+	_, err = e.RenderAllChartTemplates(c, newRenderValues(nil))
+	assert.ErrorContains(t, err, `value "" is not one of RollingUpdate, Recreate`)
+
+	// Linting only warns
+	e, err = NewEngine(&mockHostFunctions{}, WithLintMode(true))
+	require.NoError(t, err)
+	result, err := e.Render(context.Background(), c, newRenderValues(map[string]interface{}{"strategy": "BlueGreen"}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{`value "BlueGreen" is not one of RollingUpdate, Recreate`}, result.Warnings)
+	assert.Equal(t, "strategy: BlueGreen", result.Manifests["enum/templates/deployment.yaml"])
+}
+
+func TestEnvValue(t *testing.T) {
+	e, err := NewEngine(&mockHostFunctions{})
+	require.NoError(t, err)
+
+	c := newTestChart("envs", map[string]string{
+		"templates/_helpers.tpl": `{{ define "envs.memory" }}{{ envValue "prod" "resources.memory" }}{{ end }}`,
+		"templates/deployment.yaml": `replicas: {{ envValue .Values.env "replicas" }}
+image: {{ envValue .Values.env "image" }}
+memory: {{ include "envs.memory" "ignored" }}
+missing: {{ envValue .Values.env "missing" | default "none" }}`,
+	})
+	vals, err := releasevalues.ReadValues([]byte(`
+env: prod
+replicas: 1
+image: nginx
+resources:
+  memory: 128Mi
+environments:
+  prod:
+    replicas: 5
+    resources:
+      memory: 1Gi
+`))
+	require.NoError(t, err)
+
+	manifests, err := e.RenderAllChartTemplates(c, newRenderValues(vals))
+	require.NoError(t, err)
+	assert.Equal(t, "replicas: 5\nimage: nginx\nmemory: 1Gi\nmissing: none", manifests["envs/templates/deployment.yaml"])
+
+	// An environment without overrides falls back to the base values
+	vals["env"] = "dev"
+	manifests, err = e.RenderAllChartTemplates(c, newRenderValues(vals))
+	require.NoError(t, err)
+	assert.Equal(t, "replicas: 1\nimage: nginx\nmemory: 1Gi\nmissing: none", manifests["envs/templates/deployment.yaml"])
+}
+
+func TestWithPruneEmpty(t *testing.T) {
+	c := newTestChart("pruned", map[string]string{
+		"templates/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  annotations:
+    example.com/owner: {{ .Values.owner }}
+  labels:
+    app: web
+spec:
+  replicas: null
+  template:
+    spec:
+      nodeSelector: {}
+      tolerations: []
+      containers:
+        - name: web
+          image: nginx
+          args: []
+          env:
+            - name: EMPTY
+              value: ""
+          ports:
+            - {}
+      volumes:
+        - name: cache
+          emptyDir: {}`,
+		"templates/cm.yaml": `# Kept as is
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  enabled: "false"`,
+	})
+	vals := newRenderValues(nil)
+
+	e, err := NewEngine(&mockHostFunctions{}, WithPruneEmpty(true))
+	require.NoError(t, err)
+	manifests, err := e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Equal(t, `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app: web
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - env:
+        - name: EMPTY
+        image: nginx
+        name: web
+        ports:
+        - {}
+      volumes:
+      - emptyDir: {}
+        name: cache
+`, manifests["pruned/templates/deployment.yaml"])
+	assert.True(t, strings.HasPrefix(manifests["pruned/templates/cm.yaml"], "# Kept as is\n"))
+
+	// Without any fields to keep, every empty field is pruned
+	e, err = NewEngine(&mockHostFunctions{}, WithPruneEmpty(true), WithPruneKeep())
+	require.NoError(t, err)
+	manifests, err = e.RenderAllChartTemplates(c, vals)
+	require.NoError(t, err)
+	assert.Contains(t, manifests["pruned/templates/deployment.yaml"], "      volumes:\n      - name: cache\n")
+}
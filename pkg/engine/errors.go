@@ -0,0 +1,157 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	chart "helm.sh/helm/v4/pkg/chart/v2"
+)
+
+// RenderError is an error parsing or executing a template, located within the
+// template's source.
+type RenderError struct {
+	// Template is the full path of the template the error occurred in.
+	Template string
+	// Line and Column locate the error within the template, starting at 1.
+	// They are 0 when unknown.
+	Line   int
+	Column int
+
+	msg string
+	err error
+}
+
+func (e *RenderError) Error() string { return e.msg }
+
+func (e *RenderError) Unwrap() error { return e.err }
+
+// newRenderError returns a RenderError for a location of the form
+// "template:line" or "template:line:column", as reported by text/template.
+func newRenderError(location string, msg string, err error) *RenderError {
+	re := &RenderError{Template: location, msg: msg, err: err}
+
+	// Take the line and column from the end, as the template name may contain
+	// colons itself.
+	var numbers []int
+	name := location
+	for len(numbers) < 2 {
+		i := strings.LastIndex(name, ":")
+		if i < 0 {
+			break
+		}
+		n, err := strconv.Atoi(name[i+1:])
+		if err != nil {
+			break
+		}
+		numbers = append([]int{n}, numbers...)
+		name = name[:i]
+	}
+	if len(numbers) > 0 {
+		re.Template = name
+		re.Line = numbers[0]
+	}
+	if len(numbers) > 1 {
+		re.Column = numbers[1]
+	}
+	return re
+}
+
+// errorContextLines is the number of lines shown before and after the line of
+// an error by FormatError.
+const errorContextLines = 2
+
+// FormatError formats a render error with the lines of template source around
+// where it occurred, and a caret under its column:
+//
+//	execution error at (app/templates/cm.yaml:2:4): name is required
+//	  1 | kind: ConfigMap
+//	> 2 | {{ required "name is required" .Values.name }}
+//	    |    ^
+//
+// Each error joined in err is formatted in turn. Errors without a location
+// within the chart's templates are formatted as their message alone.
+func FormatError(err error, chrt *chart.Chart) string {
+	if err == nil {
+		return ""
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var parts []string
+		for _, e := range joined.Unwrap() {
+			if e != nil {
+				parts = append(parts, FormatError(e, chrt))
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+
+	var re *RenderError
+	if !errors.As(err, &re) || re.Line == 0 {
+		return err.Error()
+	}
+	source, ok := templateSource(chrt, re.Template)
+	if !ok {
+		return err.Error()
+	}
+	lines := strings.Split(source, "\n")
+	if re.Line > len(lines) {
+		return err.Error()
+	}
+
+	first := max(re.Line-errorContextLines, 1)
+	last := min(re.Line+errorContextLines, len(lines))
+	width := len(strconv.Itoa(last))
+
+	var b strings.Builder
+	b.WriteString(err.Error())
+	for n := first; n <= last; n++ {
+		marker := " "
+		if n == re.Line {
+			marker = ">"
+		}
+		fmt.Fprintf(&b, "\n%s %*d | %s", marker, width, n, lines[n-1])
+		if n == re.Line && re.Column > 0 {
+			fmt.Fprintf(&b, "\n  %*s | %s^", width, "", strings.Repeat(" ", re.Column-1))
+		}
+	}
+	return b.String()
+}
+
+// templateSource returns the source of the template with the given full path
+// in a chart or its dependencies. The path may be prefixed by the namespace set
+// with WithTemplateNamespace.
+func templateSource(c *chart.Chart, name string) (string, bool) {
+	for _, t := range c.Templates {
+		if t == nil {
+			continue
+		}
+		full := path.Join(c.ChartFullPath(), t.Name)
+		if name == full || strings.HasSuffix(name, "/"+full) {
+			return string(t.Data), true
+		}
+	}
+	for _, child := range c.Dependencies() {
+		if source, ok := templateSource(child, name); ok {
+			return source, true
+		}
+	}
+	return "", false
+}
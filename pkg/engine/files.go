@@ -19,6 +19,7 @@ package engine
 import (
 	"encoding/base64"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/gobwas/glob"
@@ -31,14 +32,22 @@ type files map[string][]byte
 
 // NewFiles creates a new files from chart files.
 // Given an []*chart.File (the format for files in a chart.Chart), extract a map of files.
+// Each chart scope gets the files of its own chart only, keyed by their path
+// relative to the chart root.
 func newFiles(from []*chart.File) files {
 	files := make(map[string][]byte)
 	for _, f := range from {
-		files[f.Name] = f.Data
+		files[cleanFilePath(f.Name)] = f.Data
 	}
 	return files
 }
 
+// cleanFilePath returns a file path relative to the chart root, so that
+// "files/a.txt", "./files/a.txt" and "/files/a.txt" all name the same file.
+func cleanFilePath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
 // GetBytes gets a file by path.
 //
 // The returned data is raw. In a template context, this is identical to calling
@@ -47,7 +56,7 @@ func newFiles(from []*chart.File) files {
 // This is intended to be accessed from within a template, so a missed key returns
 // an empty []byte.
 func (f files) GetBytes(name string) []byte {
-	if v, ok := f[name]; ok {
+	if v, ok := f[cleanFilePath(name)]; ok {
 		return v
 	}
 	return []byte{}
@@ -87,6 +96,20 @@ func (f files) Glob(pattern string) files {
 	return nf
 }
 
+// Names returns the sorted paths of the files.
+//
+// This is designed to be called from a template.
+//
+// {{ range (.Files.Glob "files/*.conf").Names }}{{ . }}{{ end }}
+func (f files) Names() []string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // AsConfig turns a Files group and flattens it to a YAML map suitable for
 // including in the 'data' section of a Kubernetes ConfigMap definition.
 // Duplicate keys will be overwritten, so be aware that your file names
@@ -154,10 +177,11 @@ func (f files) AsSecrets() string {
 // {{ range .Files.Lines "foo/bar.html" }}
 // {{ . }}{{ end }}
 func (f files) Lines(path string) []string {
-	if f == nil || f[path] == nil {
+	data := f.GetBytes(path)
+	if len(data) == 0 {
 		return []string{}
 	}
-	s := string(f[path])
+	s := string(data)
 	if s[len(s)-1] == '\n' {
 		s = s[:len(s)-1]
 	}
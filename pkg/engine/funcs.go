@@ -18,14 +18,24 @@ package engine
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/Masterminds/sprig/v3"
 	"sigs.k8s.io/yaml"
 	goYaml "sigs.k8s.io/yaml/goyaml.v3"
+
+	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/releasevalues"
 )
 
 // funcMap returns a mapping of all of the functions that Engine has.
@@ -37,9 +47,29 @@ import (
 // Known late-bound functions:
 //
 //   - "include"
+//   - "includeB64"
+//   - "includeIfPresent"
+//   - "includeYaml"
 //   - "tpl"
+//   - "configChecksum"
+//   - "subchartNames"
+//   - "filesList"
+//   - "envValue"
+//   - "required"
+//   - "requireAPIVersion"
+//   - "kubeVersionAtLeast"
+//   - "isLintMode"
+//   - "mustPort"
+//   - "mutuallyExclusive"
+//   - "revisionSuffix"
+//   - "mustName"
+//   - "resourcePreset"
+//   - "mustEnum"
+//   - "lookupSecretData"
+//   - "resolveSecret"
+//   - "imageDigest"
 //
-// These are late-bound in Engine.Render().  The
+// These are late-bound in Engine.initFunMap().  The
 // version included in the FuncMap is a placeholder.
 func funcMap() template.FuncMap {
 	f := sprig.TxtFuncMap()
@@ -48,27 +78,70 @@ func funcMap() template.FuncMap {
 
 	// Add some extra functionality
 	extra := template.FuncMap{
-		"toToml":        toTOML,
-		"fromToml":      fromTOML,
-		"toYaml":        toYAML,
-		"toYamlPretty":  toYAMLPretty,
-		"fromYaml":      fromYAML,
-		"fromYamlArray": fromYAMLArray,
-		"toJson":        toJSON,
-		"fromJson":      fromJSON,
-		"fromJsonArray": fromJSONArray,
+		"toToml":            toTOML,
+		"fromToml":          fromTOML,
+		"toYaml":            toYAML,
+		"toYamlPretty":      toYAMLPretty,
+		"toYamlCanonical":   toYAMLCanonical,
+		"toYamlBlock":       toYAMLBlock,
+		"toResource":        toResource,
+		"fromYaml":          fromYAML,
+		"fromYamlArray":     fromYAMLArray,
+		"toJson":            toJSON,
+		"fromJson":          fromJSON,
+		"fromJsonArray":     fromJSONArray,
+		"mergeCopy":         mergeCopy,
+		"mustMergeCopy":     mustMergeCopy,
+		"jsonpath":          jsonPath,
+		"truncName":         truncName,
+		"truncNameHash":     truncNameHash,
+		"normalizeName":     normalizeName,
+		"mergeEnv":          mergeEnv,
+		"patchResource":     patchResource,
+		"coalesceWithClear": coalesceWithClear,
+		"pickPaths":         pickPaths,
+		"toSeconds":         toSeconds,
+		"concatUnique":      concatUnique,
+		"annotations":       metadataMapFun("annotations"),
+		"labels":            metadataMapFun("labels"),
+		"valuesChecksum":    valuesChecksum,
 
 		// This is a placeholder for the "include" function, which is
 		// late-bound to a template. By declaring it here, we preserve the
 		// integrity of the linter.
-		"include":  func(string, interface{}) string { return "not implemented" },
-		"tpl":      func(string, interface{}) interface{} { return "not implemented" },
-		"required": func(string, interface{}) (interface{}, error) { return "not implemented", nil },
+		"include":            func(string, interface{}) string { return "not implemented" },
+		"includeB64":         func(string, interface{}) string { return "not implemented" },
+		"includeIfPresent":   func(string, interface{}) string { return "not implemented" },
+		"includeYaml":        func(string, interface{}) interface{} { return "not implemented" },
+		"tpl":                func(string, interface{}) interface{} { return "not implemented" },
+		"configChecksum":     func(string) (string, error) { return "not implemented", nil },
+		"subchartNames":      func() []string { return nil },
+		"filesList":          func(string) []string { return nil },
+		"envValue":           func(string, string) interface{} { return nil },
+		"required":           func(string, interface{}) (interface{}, error) { return "not implemented", nil },
+		"requireAPIVersion":  func(string) (string, error) { return "", nil },
+		"kubeVersionAtLeast": func(string) (bool, error) { return false, nil },
+		"isLintMode":         func() bool { return false },
+		"mustPort":           func(interface{}) (int, error) { return 0, nil },
+		"mutuallyExclusive":  func(string, ...interface{}) (interface{}, error) { return nil, nil },
+		"revisionSuffix":     func() string { return "" },
+		"mustName":           func(string) (string, error) { return "", nil },
+		"resourcePreset":     func(string) (map[string]interface{}, error) { return nil, nil },
+		"mustEnum":           func(interface{}, ...string) (interface{}, error) { return nil, nil },
 		// Provide a placeholder for the "lookup" function, which requires a kubernetes
 		// connection.
 		"lookup": func(string, string, string, string) (map[string]interface{}, error) {
 			return map[string]interface{}{}, nil
 		},
+		"lookupSecretData": func(string, string, string, string, string) (string, error) {
+			return "", nil
+		},
+		// Provide a placeholder for the "resolveSecret" function, which requires
+		// the host.
+		"resolveSecret": func(string) (string, error) { return "", nil },
+		// Provide a placeholder for the "imageDigest" function, which requires
+		// the host.
+		"imageDigest": func(ref string) (string, error) { return ref, nil },
 	}
 
 	for k, v := range extra {
@@ -104,6 +177,500 @@ func toYAMLPretty(v interface{}) string {
 	return strings.TrimSuffix(data.String(), "\n")
 }
 
+// toYAMLCanonical takes an interface, marshals it to yaml with the keys of
+// every map sorted, and returns a string. Numbers decoded as json.Number are
+// written as plain YAML numbers. Identical input always produces byte-identical
+// output. It will always return a string, even on marshal error (empty string).
+//
+// This is designed to be called from a template.
+func toYAMLCanonical(v interface{}) string {
+	node, err := canonicalYAMLNode(reflect.ValueOf(v))
+	if err != nil {
+		// Swallow errors inside of a template.
+		return ""
+	}
+
+	var data bytes.Buffer
+	encoder := goYaml.NewEncoder(&data)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		// Swallow errors inside of a template.
+		return ""
+	}
+	return strings.TrimSuffix(data.String(), "\n")
+}
+
+// toYAMLBlock marshals v to yaml like toYAMLCanonical, but writes every
+// multiline string as a literal block scalar ("|", "|-" or "|+") instead of a
+// quoted string, so scripts and config files stay readable in the manifest.
+// It will always return a string, even on marshal error (empty string).
+//
+// This is designed to be called from a template.
+func toYAMLBlock(v interface{}) string {
+	node, err := canonicalYAMLNode(reflect.ValueOf(v))
+	if err != nil {
+		// Swallow errors inside of a template.
+		return ""
+	}
+	literalBlockScalars(node)
+
+	var data bytes.Buffer
+	encoder := goYaml.NewEncoder(&data)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		// Swallow errors inside of a template.
+		return ""
+	}
+	return strings.TrimSuffix(data.String(), "\n")
+}
+
+// literalBlockScalars sets the literal style on every multiline string of node.
+func literalBlockScalars(node *goYaml.Node) {
+	if node.Kind == goYaml.ScalarNode && node.Tag == "!!str" && strings.Contains(node.Value, "\n") {
+		node.Style = goYaml.LiteralStyle
+	}
+	for _, child := range node.Content {
+		literalBlockScalars(child)
+	}
+}
+
+// canonicalYAMLNode builds the YAML node for v, sorting map keys at every depth.
+func canonicalYAMLNode(v reflect.Value) (*goYaml.Node, error) {
+	for v.IsValid() && (v.Kind() == reflect.Interface || v.Kind() == reflect.Pointer) {
+		if v.IsNil() {
+			return &goYaml.Node{Kind: goYaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return &goYaml.Node{Kind: goYaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	}
+
+	if n, ok := v.Interface().(json.Number); ok {
+		tag := "!!float"
+		if _, err := n.Int64(); err == nil {
+			tag = "!!int"
+		}
+		return &goYaml.Node{Kind: goYaml.ScalarNode, Tag: tag, Value: n.String()}, nil
+	}
+
+	switch {
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+		node := &goYaml.Node{Kind: goYaml.MappingNode, Tag: "!!map"}
+		for _, k := range keys {
+			value, err := canonicalYAMLNode(v.MapIndex(k))
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content,
+				&goYaml.Node{Kind: goYaml.ScalarNode, Tag: "!!str", Value: k.String()},
+				value,
+			)
+		}
+		return node, nil
+	case (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Type().Elem().Kind() != reflect.Uint8:
+		node := &goYaml.Node{Kind: goYaml.SequenceNode, Tag: "!!seq"}
+		for i := 0; i < v.Len(); i++ {
+			item, err := canonicalYAMLNode(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, item)
+		}
+		return node, nil
+	}
+
+	node := &goYaml.Node{}
+	if err := node.Encode(v.Interface()); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// resourceKeyOrder is the conventional order of the top-level keys of a
+// Kubernetes object. Other keys follow, sorted.
+var resourceKeyOrder = []string{"apiVersion", "kind", "metadata", "spec"}
+
+// toResource marshals a Kubernetes object to canonical YAML (see
+// toYAMLCanonical), with its top-level keys in the conventional order:
+// apiVersion, kind, metadata and spec first. It returns an error if any of
+// apiVersion, kind or metadata is missing.
+//
+// This is designed to be called from a template.
+func toResource(obj map[string]interface{}) (string, error) {
+	for _, key := range resourceKeyOrder[:3] {
+		if obj[key] == nil {
+			return "", fmt.Errorf("toResource: object is missing %s", key)
+		}
+	}
+
+	node, err := canonicalYAMLNode(reflect.ValueOf(obj))
+	if err != nil {
+		return "", fmt.Errorf("toResource: %w", err)
+	}
+
+	// Move the conventional keys to the front, keeping the rest sorted
+	rank := func(key string) int {
+		for i, k := range resourceKeyOrder {
+			if k == key {
+				return i
+			}
+		}
+		return len(resourceKeyOrder)
+	}
+	pairs := make([][2]*goYaml.Node, 0, len(node.Content)/2)
+	for i := 0; i < len(node.Content); i += 2 {
+		pairs = append(pairs, [2]*goYaml.Node{node.Content[i], node.Content[i+1]})
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return rank(pairs[i][0].Value) < rank(pairs[j][0].Value) })
+	node.Content = node.Content[:0]
+	for _, p := range pairs {
+		node.Content = append(node.Content, p[0], p[1])
+	}
+
+	var data bytes.Buffer
+	encoder := goYaml.NewEncoder(&data)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return "", fmt.Errorf("toResource: %w", err)
+	}
+	return strings.TrimSuffix(data.String(), "\n"), nil
+}
+
+// jsonPath evaluates a JSONPath expression against obj, e.g. a lookup result,
+// and returns the matched value:
+//
+//	{{ jsonpath "{.status.loadBalancer.ingress[0].ip}" $svc }}
+//
+// Only the common subset of JSONPath is supported: child fields by dot or
+// bracket (.a, ['a.b'] or ["a.b"]) and list indices ([0]). The braces and
+// leading $ are optional. It returns an empty string if nothing matches.
+//
+// This is designed to be called from a template.
+func jsonPath(expr string, obj interface{}) interface{} {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "{") && strings.HasSuffix(expr, "}") {
+		expr = expr[1 : len(expr)-1]
+	}
+	expr = strings.TrimPrefix(expr, "$")
+	expr = strings.TrimPrefix(expr, ".")
+	if expr == "" {
+		return obj
+	}
+	// Values paths quote keys in brackets with double quotes only
+	expr = strings.NewReplacer("['", `["`, "']", `"]`).Replace(expr)
+
+	root, ok := obj.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if v := releasevalues.Values(root).Get(expr, nil); v != nil {
+		return v
+	}
+	return ""
+}
+
+// maxNameLength is the maximum length of Kubernetes names and label values.
+const maxNameLength = 63
+
+// truncName joins the non-empty parts with "-" into a resource name,
+// truncated to 63 characters with any trailing dashes trimmed, like the
+// fullname helper of `helm create`:
+//
+//	{{ truncName .Release.Name .Chart.Name "server" }}
+//
+// This is designed to be called from a template.
+func truncName(parts ...string) string {
+	name := joinNameParts(parts)
+	if len(name) > maxNameLength {
+		name = name[:maxNameLength]
+	}
+	return strings.TrimRight(name, "-")
+}
+
+// truncNameHash is like truncName, but when the name is truncated it ends in a
+// hash of the full name instead, so that names differing only in their
+// truncated part stay unique.
+//
+// This is designed to be called from a template.
+func truncNameHash(parts ...string) string {
+	name := joinNameParts(parts)
+	if len(name) <= maxNameLength {
+		return strings.TrimRight(name, "-")
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:8]
+	return strings.TrimRight(name[:maxNameLength-len(hash)-1], "-") + "-" + hash
+}
+
+func joinNameParts(parts []string) string {
+	nonEmpty := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	return strings.Join(nonEmpty, "-")
+}
+
+// defaultResourcePresets are the presets of the 'resourcePreset' function
+// unless WithResourcePresets replaces them.
+var defaultResourcePresets = map[string]releasevalues.Values{
+	"small": {
+		"requests": map[string]interface{}{"cpu": "100m", "memory": "128Mi"},
+		"limits":   map[string]interface{}{"cpu": "250m", "memory": "256Mi"},
+	},
+	"medium": {
+		"requests": map[string]interface{}{"cpu": "250m", "memory": "512Mi"},
+		"limits":   map[string]interface{}{"cpu": "500m", "memory": "1Gi"},
+	},
+	"large": {
+		"requests": map[string]interface{}{"cpu": "1", "memory": "2Gi"},
+		"limits":   map[string]interface{}{"cpu": "2", "memory": "4Gi"},
+	},
+}
+
+// normalizeName turns value into a valid DNS-1123 label, as required for most
+// Kubernetes resource names: it is lowercased, every character other than a
+// letter, digit or "-" is replaced by "-", and the result is truncated to 63
+// characters with leading and trailing dashes trimmed.
+//
+//	name: {{ normalizeName .Values.tenant }}
+//
+// This is designed to be called from a template.
+func normalizeName(value string) string {
+	name := []byte(strings.ToLower(value))
+	for i, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			name[i] = '-'
+		}
+	}
+	normalized := strings.TrimLeft(string(name), "-")
+	if len(normalized) > maxNameLength {
+		normalized = normalized[:maxNameLength]
+	}
+	return strings.TrimRight(normalized, "-")
+}
+
+// checkName returns an error unless name is a valid DNS-1123 label.
+func checkName(name string) error {
+	if len(name) > maxNameLength {
+		return fmt.Errorf("name %q is longer than %d characters", name, maxNameLength)
+	}
+	if !dnsLabelRegex.MatchString(name) {
+		return fmt.Errorf("name %q is not a valid DNS-1123 label", name)
+	}
+	return nil
+}
+
+// mergeEnv merges two lists of container environment variables by name,
+// returning the combined list sorted by name. An entry of extra replaces the
+// entry of base with the same name as a whole, so that e.g. a valueFrom entry
+// never ends up with a value as well. Neither list is modified.
+//
+//	env: {{ mergeEnv .Values.env .Values.extraEnv | toYaml | nindent 2 }}
+//
+// This is designed to be called from a template.
+func mergeEnv(base, extra interface{}) ([]interface{}, error) {
+	byName := map[string]interface{}{}
+	for _, list := range []interface{}{base, extra} {
+		if list == nil {
+			// A list missing from the values
+			continue
+		}
+		entries, ok := list.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("mergeEnv: env is not a list: %v", list)
+		}
+		for _, entry := range entries {
+			m, ok := entry.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("mergeEnv: env entry is not a map: %v", entry)
+			}
+			name, _ := m["name"].(string)
+			if name == "" {
+				return nil, fmt.Errorf("mergeEnv: env entry has no name: %v", entry)
+			}
+			byName[name] = map[string]interface{}(releasevalues.Values(m).DeepCopy())
+		}
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	merged := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		merged = append(merged, byName[name])
+	}
+	return merged, nil
+}
+
+// mergeCopy deep-merges the source maps into a copy of dst, in the manner of
+// sprig's merge: values already in dst, or in an earlier source, take
+// precedence. Tables are merged recursively as by Values.Merge, so any other
+// value, including nil or an empty one, is kept rather than filled from the
+// sources. Unlike sprig's merge, neither dst nor the sources are modified, so
+// the result can safely be modified or reused, e.g. across range iterations.
+// It will always return a map, even on error (empty map).
+//
+// This is designed to be called from a template.
+func mergeCopy(dst map[string]interface{}, srcs ...map[string]interface{}) map[string]interface{} {
+	out, err := mustMergeCopy(dst, srcs...)
+	if err != nil {
+		// Swallow errors inside of a template.
+		return map[string]interface{}{}
+	}
+	return out
+}
+
+// mustMergeCopy is like mergeCopy, but returns an error if the maps cannot be
+// copied.
+func mustMergeCopy(dst map[string]interface{}, srcs ...map[string]interface{}) (out map[string]interface{}, err error) {
+	defer func() {
+		// Values.DeepCopy panics on values it cannot copy
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot merge: %v", r)
+		}
+	}()
+
+	merged := releasevalues.Values(dst).DeepCopy()
+	for _, src := range srcs {
+		// Each source is merged under what has been merged so far
+		merged = releasevalues.Values(src).Merge(merged)
+	}
+	if merged == nil {
+		merged = releasevalues.Values{}
+	}
+	return map[string]interface{}(merged), nil
+}
+
+// coalesceWithClear deep-merges overrides into a copy of defaults like Helm
+// coalesces values: a key absent from overrides keeps its default, while a key
+// explicitly set to null in overrides removes the default. Neither map is
+// modified.
+//
+//	{{ coalesceWithClear .Values.defaultAnnotations .Values.annotations | toYaml }}
+//
+// This is designed to be called from a template.
+func coalesceWithClear(defaults, overrides map[string]interface{}) (out map[string]interface{}, err error) {
+	defer func() {
+		// Values.DeepCopy panics on values it cannot copy
+		if r := recover(); r != nil {
+			err = fmt.Errorf("coalesceWithClear: cannot merge: %v", r)
+		}
+	}()
+
+	out = releasevalues.Values(defaults).DeepCopy()
+	if out == nil {
+		out = map[string]interface{}{}
+	}
+	coalesceInto(out, releasevalues.Values(overrides).DeepCopy())
+	return out, nil
+}
+
+// coalesceInto merges src into dst, removing the keys set to nil in src.
+func coalesceInto(dst, src map[string]interface{}) {
+	for key, val := range src {
+		if val == nil {
+			delete(dst, key)
+			continue
+		}
+		if srcTable, ok := asMap(val); ok {
+			dstTable, ok := asMap(dst[key])
+			if !ok {
+				dstTable = map[string]interface{}{}
+			}
+			coalesceInto(dstTable, srcTable)
+			dst[key] = dstTable
+			continue
+		}
+		dst[key] = val
+	}
+}
+
+// asMap returns v as a map if it is a table.
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		return vv, true
+	case releasevalues.Values:
+		return vv, true
+	}
+	return nil, false
+}
+
+// pickPaths returns a copy of the values of obj at the given dotted paths
+// (e.g. "metadata.annotations"), nested as they are in obj. Paths missing from
+// obj are ignored. Unlike sprig's pick, paths reach into nested maps:
+//
+//	{{ pickPaths $deployment (list "metadata.labels" "spec.replicas") | toYaml }}
+//
+// This is designed to be called from a template.
+func pickPaths(obj map[string]interface{}, paths []interface{}) (map[string]interface{}, error) {
+	src := releasevalues.Values(obj)
+	out := releasevalues.Values{}
+	for _, p := range paths {
+		key, ok := p.(string)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("pickPaths: path %v is not a non-empty string", p)
+		}
+
+		v, err := src.PathValue(key)
+		if err != nil {
+			// PathValue does not return tables
+			t, tableErr := src.Table(key)
+			if tableErr != nil {
+				continue
+			}
+			v = map[string]interface{}(t)
+		}
+		// Copy lists and tables, so that the result shares nothing with obj
+		v = releasevalues.Values{"v": v}.DeepCopy()["v"]
+		if err := out.SetPath(key, v); err != nil {
+			return nil, fmt.Errorf("pickPaths: %w", err)
+		}
+	}
+	return out, nil
+}
+
+// valuesChecksum returns a checksum of values that only changes when the
+// values change logically, regardless of key order or number formatting, e.g.
+// to roll out a Deployment on any change of its values:
+//
+//	checksum/values: {{ valuesChecksum .Values }}
+//
+// This is designed to be called from a template.
+func valuesChecksum(vals map[string]interface{}) (string, error) {
+	sum, err := releasevalues.Values(vals).Checksum()
+	if err != nil {
+		return "", fmt.Errorf("valuesChecksum: %w", err)
+	}
+	return sum, nil
+}
+
+// patchResource deep-merges patch into a copy of base, in the manner of a
+// merge patch: maps are merged recursively, while all other values of patch,
+// including lists, replace those of base. Neither map is modified.
+//
+//	{{ patchResource $container (dict "resources" .Values.resources) | toYaml }}
+//
+// This is designed to be called from a template.
+func patchResource(base, patch map[string]interface{}) (out map[string]interface{}, err error) {
+	defer func() {
+		// Values.Merge panics on values it cannot copy
+		if r := recover(); r != nil {
+			err = fmt.Errorf("patchResource: cannot merge: %v", r)
+		}
+	}()
+
+	return releasevalues.Values(base).Merge(patch), nil
+}
+
 // fromYAML converts a YAML document into a map[string]interface{}.
 //
 // This is not a general-purpose YAML parser, and will not parse all valid
@@ -205,3 +772,207 @@ func fromJSONArray(str string) []interface{} {
 	}
 	return a
 }
+
+// lookupSecretData returns a template function that looks up a resource, such
+// as a Secret, and returns the base64 decoded value of a key in its data.
+//
+// An empty string is returned if the resource or key does not exist.
+//
+//	{{ lookupSecretData "v1" "Secret" .Release.Namespace "db" "password" }}
+func lookupSecretData(lookup func(string, string, string, string) (map[string]interface{}, error)) func(string, string, string, string, string) (string, error) {
+	return func(apiVersion string, kind string, namespace string, name string, key string) (string, error) {
+		obj, err := lookup(apiVersion, kind, namespace, name)
+		if err != nil {
+			return "", err
+		}
+
+		data, ok := obj["data"].(map[string]interface{})
+		if !ok {
+			return "", nil
+		}
+		encoded, ok := data[key].(string)
+		if !ok {
+			return "", nil
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode key %q of %s %s/%s: %w", key, kind, namespace, name, err)
+		}
+		return string(decoded), nil
+	}
+}
+
+// clusterScopedKinds are the built-in Kubernetes kinds that are not namespaced.
+var clusterScopedKinds = map[string]bool{
+	"APIService":                       true,
+	"CertificateSigningRequest":        true,
+	"ClusterRole":                      true,
+	"ClusterRoleBinding":               true,
+	"CSIDriver":                        true,
+	"CSINode":                          true,
+	"CustomResourceDefinition":         true,
+	"IngressClass":                     true,
+	"MutatingWebhookConfiguration":     true,
+	"Namespace":                        true,
+	"Node":                             true,
+	"PersistentVolume":                 true,
+	"PriorityClass":                    true,
+	"RuntimeClass":                     true,
+	"StorageClass":                     true,
+	"ValidatingAdmissionPolicy":        true,
+	"ValidatingAdmissionPolicyBinding": true,
+	"ValidatingWebhookConfiguration":   true,
+	"VolumeAttachment":                 true,
+}
+
+// isClusterScoped returns true if kind is a well-known cluster-scoped kind.
+func isClusterScoped(kind string) bool {
+	return clusterScopedKinds[kind]
+}
+
+// parsePort returns v as a port number, accepting integers and strings
+// holding one, and failing unless it is within 1-65535.
+func parsePort(v interface{}) (int, error) {
+	var port int64
+	switch vv := v.(type) {
+	case int:
+		port = int64(vv)
+	case int64:
+		port = vv
+	case float64:
+		if vv != math.Trunc(vv) {
+			return 0, fmt.Errorf("port %v is not an integer", vv)
+		}
+		port = int64(vv)
+	case json.Number:
+		n, err := vv.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("port %q is not an integer", vv)
+		}
+		port = n
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(vv), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("port %q is not a number", vv)
+		}
+		port = n
+	default:
+		return 0, fmt.Errorf("port %v is not a number", v)
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d is out of range 1-65535", port)
+	}
+	return int(port), nil
+}
+
+// toSeconds returns a duration as a whole number of seconds, e.g. for
+// terminationGracePeriodSeconds. Strings are parsed as Go durations ("30s",
+// "1h30m"), while integers, and strings holding one, are taken as seconds
+// already. Fractions of a second are truncated.
+//
+//	terminationGracePeriodSeconds: {{ toSeconds .Values.gracePeriod }}
+//
+// This is designed to be called from a template.
+func toSeconds(v interface{}) (int64, error) {
+	switch vv := v.(type) {
+	case int:
+		return int64(vv), nil
+	case int64:
+		return vv, nil
+	case float64:
+		if vv != math.Trunc(vv) {
+			return 0, fmt.Errorf("toSeconds: %v is not a whole number of seconds", vv)
+		}
+		return int64(vv), nil
+	case json.Number:
+		n, err := vv.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("toSeconds: %q is not a whole number of seconds", vv)
+		}
+		return n, nil
+	case string:
+		s := strings.TrimSpace(vv)
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("toSeconds: %q is not a duration", vv)
+		}
+		return int64(d / time.Second), nil
+	default:
+		return 0, fmt.Errorf("toSeconds: %v is not a duration", v)
+	}
+}
+
+// concatUnique concatenates lists of strings, dropping repeated strings but
+// keeping the order in which they are first seen. Nil lists are skipped:
+//
+//	{{ concatUnique .Values.defaultOrigins .Values.extraOrigins | toYaml }}
+//
+// This is designed to be called from a template.
+func concatUnique(lists ...interface{}) ([]string, error) {
+	out := []string{}
+	seen := map[string]bool{}
+	add := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	for _, list := range lists {
+		switch l := list.(type) {
+		case nil:
+		case []string:
+			for _, s := range l {
+				add(s)
+			}
+		case []interface{}:
+			for _, item := range l {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("concatUnique: %v is not a string", item)
+				}
+				add(s)
+			}
+		default:
+			return nil, fmt.Errorf("concatUnique: %v is not a list", list)
+		}
+	}
+	return out, nil
+}
+
+// metadataMapFun returns a function building a map of labels or annotations
+// from alternating keys and values, skipping keys whose value is empty, and
+// returning it as YAML. The output is empty if no value is set, so that the
+// caller can omit the enclosing key:
+//
+//	{{- with annotations "example.com/owner" .Values.owner "example.com/oncall" .Values.oncall }}
+//	annotations:
+//	  {{- . | nindent 2 }}
+//	{{- end }}
+//
+// Values are written as strings, as Kubernetes requires.
+func metadataMapFun(name string) func(...interface{}) (string, error) {
+	return func(pairs ...interface{}) (string, error) {
+		if len(pairs)%2 != 0 {
+			return "", fmt.Errorf("%s: expected alternating keys and values, got %d arguments", name, len(pairs))
+		}
+		m := map[string]string{}
+		for i := 0; i < len(pairs); i += 2 {
+			key, ok := pairs[i].(string)
+			if !ok || key == "" {
+				return "", fmt.Errorf("%s: key %v is not a non-empty string", name, pairs[i])
+			}
+			if isEmptyValue(pairs[i+1]) {
+				continue
+			}
+			m[key] = fmt.Sprint(pairs[i+1])
+		}
+		if len(m) == 0 {
+			return "", nil
+		}
+		return toYAML(m), nil
+	}
+}
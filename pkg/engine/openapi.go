@@ -0,0 +1,218 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// openAPISchema is an OpenAPI v2 document, as served by the Kubernetes API
+// server at /openapi/v2, reduced to what is needed to validate resources.
+type openAPISchema struct {
+	Definitions map[string]*schemaObject `json:"definitions"`
+
+	// kinds maps "group/version/kind" to the name of its definition.
+	kinds map[string]string
+}
+
+// schemaObject is an OpenAPI v2 schema object.
+type schemaObject struct {
+	Ref                  string                   `json:"$ref"`
+	Type                 string                   `json:"type"`
+	Format               string                   `json:"format"`
+	Properties           map[string]*schemaObject `json:"properties"`
+	AdditionalProperties json.RawMessage          `json:"additionalProperties"`
+	Items                *schemaObject            `json:"items"`
+
+	PreserveUnknownFields bool `json:"x-kubernetes-preserve-unknown-fields"`
+	IntOrString           bool `json:"x-kubernetes-int-or-string"`
+
+	GroupVersionKinds []struct {
+		Group   string `json:"group"`
+		Version string `json:"version"`
+		Kind    string `json:"kind"`
+	} `json:"x-kubernetes-group-version-kind"`
+}
+
+// parseOpenAPISchema parses an OpenAPI v2 document.
+func parseOpenAPISchema(data []byte) (*openAPISchema, error) {
+	s := &openAPISchema{kinds: map[string]string{}}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI schema: %w", err)
+	}
+	if len(s.Definitions) == 0 {
+		return nil, errors.New("invalid OpenAPI schema: no definitions")
+	}
+	for name, def := range s.Definitions {
+		for _, gvk := range def.GroupVersionKinds {
+			s.kinds[gvk.Group+"/"+gvk.Version+"/"+gvk.Kind] = name
+		}
+	}
+	return s, nil
+}
+
+// definitionFor returns the name of the definition of a kind, if any.
+func (s *openAPISchema) definitionFor(apiVersion, kind string) (string, bool) {
+	group, version, found := strings.Cut(apiVersion, "/")
+	if !found {
+		group, version = "", apiVersion
+	}
+	name, ok := s.kinds[group+"/"+version+"/"+kind]
+	return name, ok
+}
+
+// checkOpenAPISchema returns an error for every field of the rendered
+// documents which is unknown to, or of a different type than, the schema of
+// the document's kind. Documents of kinds not in the schema are skipped.
+func checkOpenAPISchema(docs []document, schema *openAPISchema) error {
+	var errs []error
+	for _, doc := range docs {
+		if doc.err != nil {
+			continue
+		}
+		apiVersion, _ := doc.object["apiVersion"].(string)
+		kind, _ := doc.object["kind"].(string)
+		name, ok := schema.definitionFor(apiVersion, kind)
+		if !ok {
+			continue
+		}
+
+		var problems []string
+		schema.validate(&problems, "", name, schema.Definitions[name], doc.object)
+		sort.Strings(problems)
+		for _, p := range problems {
+			errs = append(errs, fmt.Errorf("%s: document %d: %s %s: %s", doc.filename, doc.index, kind, apiVersion, p))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validate appends the problems of value at path against the schema obj,
+// defined by the definition named def.
+func (s *openAPISchema) validate(problems *[]string, path string, def string, obj *schemaObject, value interface{}) {
+	if obj == nil || value == nil {
+		// Unspecified schemas accept anything, and null unsets any field.
+		return
+	}
+	if ref, ok := strings.CutPrefix(obj.Ref, "#/definitions/"); ok {
+		s.validate(problems, path, ref, s.Definitions[ref], value)
+		return
+	}
+
+	field := path
+	if field == "" {
+		field = "(root)"
+	}
+	mismatch := func(expected string) {
+		*problems = append(*problems, fmt.Sprintf("%s: expected %s, got %s", field, expected, jsonType(value)))
+	}
+
+	switch {
+	case obj.IntOrString || obj.Format == "int-or-string" || strings.HasSuffix(def, ".Quantity"):
+		// Quantities are strings in the schema, but may be given as numbers.
+		switch value.(type) {
+		case string, json.Number:
+		default:
+			mismatch("integer or string")
+		}
+	case obj.Type == "object" || (obj.Type == "" && obj.Properties != nil):
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			mismatch("object")
+			return
+		}
+		var additional *schemaObject
+		allowAdditional := obj.PreserveUnknownFields || obj.Properties == nil
+		if len(obj.AdditionalProperties) > 0 {
+			var b bool
+			if err := json.Unmarshal(obj.AdditionalProperties, &b); err == nil {
+				allowAdditional = b
+			} else if err := json.Unmarshal(obj.AdditionalProperties, &additional); err == nil {
+				allowAdditional = true
+			}
+		}
+		for k, v := range m {
+			child := joinField(path, k)
+			if p, ok := obj.Properties[k]; ok {
+				s.validate(problems, child, "", p, v)
+			} else if additional != nil {
+				s.validate(problems, child, "", additional, v)
+			} else if !allowAdditional {
+				*problems = append(*problems, fmt.Sprintf("%s: unknown field", child))
+			}
+		}
+	case obj.Type == "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			mismatch("array")
+			return
+		}
+		for i, item := range items {
+			s.validate(problems, fmt.Sprintf("%s[%d]", path, i), "", obj.Items, item)
+		}
+	case obj.Type == "string":
+		if _, ok := value.(string); !ok {
+			mismatch("string")
+		}
+	case obj.Type == "integer":
+		if n, ok := value.(json.Number); !ok {
+			mismatch("integer")
+		} else if _, err := n.Int64(); err != nil {
+			mismatch("integer")
+		}
+	case obj.Type == "number":
+		if _, ok := value.(json.Number); !ok {
+			mismatch("number")
+		}
+	case obj.Type == "boolean":
+		if _, ok := value.(bool); !ok {
+			mismatch("boolean")
+		}
+	}
+}
+
+// joinField appends a field name to a dotted field path.
+func joinField(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// jsonType returns the JSON type name of a decoded value.
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,598 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/releaseutil"
+)
+
+// document is a single YAML document of a rendered manifest.
+type document struct {
+	// filename is the full path of the template that rendered the document.
+	filename string
+	// index is the position of the document within its file.
+	index int
+	// value is the parsed document, usually a map, but lists and scalars are
+	// valid YAML documents too. It is nil if parsing failed.
+	value interface{}
+	// object is the parsed document if it is a map, and nil otherwise.
+	object map[string]interface{}
+	// err is the error from parsing the document, or errNotMap.
+	err error
+}
+
+// errNotMap is the error of a document which is valid YAML, but not a map.
+var errNotMap = errors.New("document is not a YAML map")
+
+// documents splits the rendered manifests into their YAML documents, ordered by
+// filename and position within the file. Partials, NOTES.txt and empty
+// documents are skipped.
+func documents(manifests map[string]string) []document {
+	filenames := make([]string, 0, len(manifests))
+	for filename := range manifests {
+		base := path.Base(filename)
+		if strings.HasPrefix(base, "_") || base == releaseutil.NotesFileName {
+			continue
+		}
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	var docs []document
+	for _, filename := range filenames {
+		entries := releaseutil.SplitManifests(manifests[filename])
+		keys := make([]string, 0, len(entries))
+		for k := range entries {
+			keys = append(keys, k)
+		}
+		sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+
+		index := 0
+		for _, k := range keys {
+			doc := document{filename: filename, index: index}
+			// SplitManifests trims the documents. Restore the final line
+			// break, which a block scalar ending the document keeps ("|").
+			doc.err = yaml.Unmarshal([]byte(entries[k]+"\n"), &doc.value, func(d *json.Decoder) *json.Decoder {
+				d.UseNumber()
+				return d
+			})
+			if doc.err == nil {
+				if doc.value == nil {
+					// Only comments, or an explicit null document
+					continue
+				}
+				object, ok := doc.value.(map[string]interface{})
+				if !ok {
+					doc.err = errNotMap
+				} else if len(object) == 0 {
+					continue
+				}
+				doc.object = object
+			}
+			docs = append(docs, doc)
+			index++
+		}
+	}
+	return docs
+}
+
+// postRender runs the enabled checks over the rendered manifests, whose root
+// chart's templates are in the directory root. The manifests are parsed once,
+// and their documents passed to each check.
+func (e *Engine) postRender(manifests map[string]string, root string) error {
+	docs := documents(manifests)
+
+	// Changes to the manifests run first, so that the checks below see them
+	if e.options.PruneEmpty {
+		keep := e.options.PruneKeep
+		if keep == nil {
+			keep = defaultPruneKeep
+		}
+		if err := pruneEmpty(manifests, docs, keep); err != nil {
+			return err
+		}
+	}
+	if len(e.options.CommonLabels) > 0 {
+		if err := addCommonLabels(manifests, docs, e.options.CommonLabels); err != nil {
+			return err
+		}
+	}
+	if e.options.ManifestLint {
+		e.lintManifests(docs)
+	}
+	if e.options.LabelValidation {
+		e.validateLabels(docs)
+	}
+	if len(e.options.MandatoryLabels) > 0 {
+		if err := e.checkMandatoryLabels(docs); err != nil {
+			return err
+		}
+	}
+	if len(e.options.AllowedRegistries) > 0 {
+		if err := checkImageRegistries(docs, e.options.AllowedRegistries); err != nil {
+			return err
+		}
+	}
+	if e.options.OpenAPISchema != nil {
+		if err := checkOpenAPISchema(docs, e.options.OpenAPISchema); err != nil {
+			return err
+		}
+	}
+	if e.options.Kustomization {
+		var err error
+		if e.kustomization, err = kustomization(docs, root); err != nil {
+			return err
+		}
+	}
+	// Conversions run last, as the checks above expect YAML
+	if e.options.OutputJSON {
+		if err := convertToJSON(manifests, docs, e.options.Kustomization); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unparsedFiles returns the files holding a document which failed to parse or
+// is not a YAML map (such as a raw list). They cannot be re-encoded, so their
+// documents are left as they are by the changes to the manifests.
+func unparsedFiles(docs []document) map[string]bool {
+	unparsed := map[string]bool{}
+	for _, doc := range docs {
+		if doc.err != nil {
+			unparsed[doc.filename] = true
+		}
+	}
+	return unparsed
+}
+
+// addCommonLabels adds the labels to the metadata.labels of every rendered
+// resource which does not already set them. Documents without metadata are
+// left as they are, as are the unparsed files (see unparsedFiles). The
+// documents are changed in place, and the files of changed documents are
+// re-encoded.
+func addCommonLabels(manifests map[string]string, docs []document, labels map[string]string) error {
+	changed := map[string]bool{}
+	unparsed := unparsedFiles(docs)
+	objects := map[string][]map[string]interface{}{}
+	for _, doc := range docs {
+		if unparsed[doc.filename] {
+			continue
+		}
+		objects[doc.filename] = append(objects[doc.filename], doc.object)
+
+		metadata, ok := doc.object["metadata"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		existing, _ := metadata["labels"].(map[string]interface{})
+		for k, v := range labels {
+			if _, ok := existing[k]; !ok {
+				if existing == nil {
+					existing = map[string]interface{}{}
+					metadata["labels"] = existing
+				}
+				existing[k] = v
+				changed[doc.filename] = true
+			}
+		}
+	}
+
+	for filename := range changed {
+		if err := encodeDocuments(manifests, filename, objects[filename]); err != nil {
+			return fmt.Errorf("%s: cannot add labels: %w", filename, err)
+		}
+	}
+	return nil
+}
+
+// encodeDocuments replaces the file of the manifests with the YAML documents
+// of objects.
+func encodeDocuments(manifests map[string]string, filename string, objects []map[string]interface{}) error {
+	parts := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, string(data))
+	}
+	manifests[filename] = strings.Join(parts, "---\n")
+	return nil
+}
+
+// defaultPruneKeep are the fields pruneEmpty keeps unless WithPruneKeep
+// replaces them: an empty emptyDir still declares a volume, and an empty
+// podSelector or namespaceSelector selects everything.
+var defaultPruneKeep = []string{"emptyDir", "podSelector", "namespaceSelector"}
+
+// pruneEmpty removes the empty fields of every rendered resource, except the
+// fields named in keep. The unparsed files are left as they are, as in
+// addCommonLabels. The documents are changed in place, and the files of
+// changed documents are re-encoded.
+func pruneEmpty(manifests map[string]string, docs []document, keep []string) error {
+	keepFields := make(map[string]bool, len(keep))
+	for _, k := range keep {
+		keepFields[k] = true
+	}
+
+	changed := map[string]bool{}
+	unparsed := unparsedFiles(docs)
+	objects := map[string][]map[string]interface{}{}
+	for _, doc := range docs {
+		if unparsed[doc.filename] {
+			continue
+		}
+		objects[doc.filename] = append(objects[doc.filename], doc.object)
+		if pruneMap(doc.object, keepFields) {
+			changed[doc.filename] = true
+		}
+	}
+
+	for filename := range changed {
+		if err := encodeDocuments(manifests, filename, objects[filename]); err != nil {
+			return fmt.Errorf("%s: cannot prune empty fields: %w", filename, err)
+		}
+	}
+	return nil
+}
+
+// pruneMap removes the empty fields of m, depth first, and reports whether it
+// removed any.
+func pruneMap(m map[string]interface{}, keep map[string]bool) bool {
+	pruned := false
+	for k, v := range m {
+		if pruneValue(v, keep) {
+			pruned = true
+		}
+		if !keep[k] && isEmptyValue(m[k]) {
+			delete(m, k)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+// pruneValue removes the empty fields of the maps within v, and reports
+// whether it removed any. The items of lists are kept even if empty, as
+// removing them would shift the others.
+func pruneValue(v interface{}, keep map[string]bool) bool {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		return pruneMap(vv, keep)
+	case []interface{}:
+		pruned := false
+		for _, item := range vv {
+			if pruneValue(item, keep) {
+				pruned = true
+			}
+		}
+		return pruned
+	}
+	return false
+}
+
+// lintManifests warns about documents missing the fields every Kubernetes
+// resource requires.
+func (e *Engine) lintManifests(docs []document) {
+	for _, doc := range docs {
+		if doc.err != nil {
+			e.warn("%s: document %d: invalid YAML: %s", doc.filename, doc.index, doc.err)
+			continue
+		}
+
+		var missing []string
+		if s, _ := doc.object["apiVersion"].(string); s == "" {
+			missing = append(missing, "apiVersion")
+		}
+		if s, _ := doc.object["kind"].(string); s == "" {
+			missing = append(missing, "kind")
+		}
+		metadata, _ := doc.object["metadata"].(map[string]interface{})
+		if s, _ := metadata["name"].(string); s == "" {
+			missing = append(missing, "metadata.name")
+		}
+
+		if len(missing) > 0 {
+			e.warn("%s: document %d: missing required field(s): %s", doc.filename, doc.index, strings.Join(missing, ", "))
+		}
+	}
+}
+
+// maxLabelLength is the maximum length of a label value, and of the name part
+// of label and annotation keys.
+const maxLabelLength = 63
+
+// maxPrefixLength is the maximum length of the prefix of label and annotation
+// keys.
+const maxPrefixLength = 253
+
+var (
+	labelNameRegex = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	dnsLabelRegex  = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+)
+
+// validateLabels warns about label and annotation keys, and label values, of
+// the rendered resources which Kubernetes would reject.
+func (e *Engine) validateLabels(docs []document) {
+	for _, doc := range docs {
+		if doc.err != nil {
+			continue
+		}
+		metadata, _ := doc.object["metadata"].(map[string]interface{})
+		kind, _ := doc.object["kind"].(string)
+		name, _ := metadata["name"].(string)
+
+		for _, field := range []string{"labels", "annotations"} {
+			entries, _ := metadata[field].(map[string]interface{})
+			keys := make([]string, 0, len(entries))
+			for k := range entries {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			for _, k := range keys {
+				problem := validateLabelKey(k)
+				if problem == "" && field == "labels" {
+					problem = validateLabelValue(fmt.Sprint(entries[k]))
+				}
+				if problem != "" {
+					e.warn("%s: document %d: %s %q: %s %q: %s", doc.filename, doc.index, kind, name, strings.TrimSuffix(field, "s"), k, problem)
+				}
+			}
+		}
+	}
+}
+
+// checkMandatoryLabels reports the rendered resources missing any of the
+// mandatory labels, as warnings or, with FailOnMissingLabels, as errors.
+func (e *Engine) checkMandatoryLabels(docs []document) error {
+	var errs []error
+	for _, doc := range docs {
+		if doc.err != nil {
+			continue
+		}
+		metadata, ok := doc.object["metadata"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		labels, _ := metadata["labels"].(map[string]interface{})
+
+		var missing []string
+		for _, k := range e.options.MandatoryLabels {
+			if _, ok := labels[k]; !ok {
+				missing = append(missing, k)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		kind, _ := doc.object["kind"].(string)
+		name, _ := metadata["name"].(string)
+		msg := fmt.Sprintf("%s: document %d: %s %q: missing mandatory label(s): %s", doc.filename, doc.index, kind, name, strings.Join(missing, ", "))
+		if e.options.FailOnMissingLabels {
+			errs = append(errs, errors.New(msg))
+		} else {
+			e.warn("%s", msg)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateLabelKey returns why a label or annotation key is invalid, or an
+// empty string if it is valid.
+func validateLabelKey(key string) string {
+	name := key
+	if prefix, n, found := strings.Cut(key, "/"); found {
+		name = n
+		if len(prefix) > maxPrefixLength {
+			return fmt.Sprintf("key prefix must be no more than %d characters", maxPrefixLength)
+		}
+		for _, part := range strings.Split(prefix, ".") {
+			if !dnsLabelRegex.MatchString(part) {
+				return "key prefix must be a DNS subdomain"
+			}
+		}
+	}
+	if len(name) > maxLabelLength {
+		return fmt.Sprintf("key name must be no more than %d characters", maxLabelLength)
+	}
+	if !labelNameRegex.MatchString(name) {
+		return "key name must consist of alphanumeric characters, '-', '_' or '.', and start and end with an alphanumeric character"
+	}
+	return ""
+}
+
+// validateLabelValue returns why a label value is invalid, or an empty string
+// if it is valid.
+func validateLabelValue(value string) string {
+	if len(value) > maxLabelLength {
+		return fmt.Sprintf("value must be no more than %d characters", maxLabelLength)
+	}
+	if value != "" && !labelNameRegex.MatchString(value) {
+		return "value must consist of alphanumeric characters, '-', '_' or '.', and start and end with an alphanumeric character"
+	}
+	return ""
+}
+
+// defaultRegistry is the registry of images that do not name one.
+const defaultRegistry = "docker.io"
+
+// containerListKeys are the pod spec fields holding containers.
+var containerListKeys = []string{"containers", "initContainers", "ephemeralContainers"}
+
+// checkImageRegistries returns an error naming every container image in the
+// rendered documents that is not from one of the allowed registries.
+func checkImageRegistries(docs []document, allowed []string) error {
+	var errs []error
+	for _, doc := range docs {
+		if doc.err != nil {
+			continue
+		}
+		for _, image := range containerImages(doc.object) {
+			if !imageAllowed(image, allowed) {
+				errs = append(errs, fmt.Errorf("%s: document %d: image %q is not from an allowed registry", doc.filename, doc.index, image))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// containerImages returns the images of all containers found in obj, at any
+// depth, so that the pod templates of workloads are included.
+func containerImages(obj interface{}) []string {
+	var images []string
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		for _, key := range containerListKeys {
+			containers, _ := v[key].([]interface{})
+			for _, c := range containers {
+				container, _ := c.(map[string]interface{})
+				if image, ok := container["image"].(string); ok {
+					images = append(images, image)
+				}
+			}
+		}
+		for k, value := range v {
+			if slices.Contains(containerListKeys, k) {
+				continue
+			}
+			images = append(images, containerImages(value)...)
+		}
+	case []interface{}:
+		for _, value := range v {
+			images = append(images, containerImages(value)...)
+		}
+	}
+	return images
+}
+
+// imageAllowed returns true if image is from one of the allowed registries.
+// An allowed entry may also include a repository path prefix.
+func imageAllowed(image string, allowed []string) bool {
+	name := qualifiedImageName(image)
+	for _, a := range allowed {
+		a = strings.TrimSuffix(a, "/")
+		if name == a || strings.HasPrefix(name, a+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// qualifiedImageName returns the image name, without tag or digest, prefixed
+// with its registry.
+func qualifiedImageName(image string) string {
+	name, _, _ := strings.Cut(image, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+
+	// Following docker, the first component is only a registry if it looks
+	// like a hostname.
+	first, _, found := strings.Cut(name, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return name
+	}
+	if !found {
+		name = "library/" + name
+	}
+	return defaultRegistry + "/" + name
+}
+
+// convertToJSON replaces each rendered manifest with its documents as indented
+// JSON. Files with several documents become a JSON array, or with asList a v1
+// List, and files without any documents, e.g. only comments, an empty array.
+// Documents need not be objects, lists and scalars are converted as they are.
+func convertToJSON(manifests map[string]string, docs []document, asList bool) error {
+	values := map[string][]interface{}{}
+	for _, doc := range docs {
+		if doc.value == nil {
+			return fmt.Errorf("%s: document %d: cannot convert to JSON: %w", doc.filename, doc.index, doc.err)
+		}
+		values[doc.filename] = append(values[doc.filename], doc.value)
+	}
+
+	for filename := range manifests {
+		base := path.Base(filename)
+		if strings.HasPrefix(base, "_") || base == releaseutil.NotesFileName {
+			continue
+		}
+
+		objs := values[filename]
+		var v interface{} = objs
+		switch {
+		case len(objs) == 0:
+			v = []interface{}{}
+		case len(objs) == 1:
+			v = objs[0]
+		case asList:
+			v = map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "List",
+				"items":      objs,
+			}
+		}
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return fmt.Errorf("%s: cannot convert to JSON: %w", filename, err)
+		}
+		manifests[filename] = string(data)
+	}
+	return nil
+}
+
+// kustomizationFileName is the name of the file generated by WithKustomization.
+const kustomizationFileName = "kustomization.yaml"
+
+// kustomization returns a kustomization.yaml for the directory dir, listing the
+// files holding at least one of the documents as its resources.
+func kustomization(docs []document, dir string) (string, error) {
+	resources := []string{}
+	for _, doc := range docs {
+		if doc.index > 0 {
+			continue
+		}
+		rel := strings.TrimPrefix(doc.filename, dir+"/")
+		if rel == doc.filename {
+			return "", fmt.Errorf("%s: cannot list in %s: outside of %s", doc.filename, kustomizationFileName, dir)
+		}
+		resources = append(resources, rel)
+	}
+
+	data, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": "kustomize.config.k8s.io/v1beta1",
+		"kind":       "Kustomization",
+		"resources":  resources,
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot encode %s: %w", kustomizationFileName, err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,88 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"text/template"
+
+	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/releasevalues"
+	chart "helm.sh/helm/v4/pkg/chart/v2"
+)
+
+// PreparedChart is a chart whose templates have been parsed once, to be
+// rendered repeatedly against different values, e.g. for a live preview.
+//
+// A PreparedChart is safe for concurrent use, provided the HostFunctions of
+// the engine that prepared it are.
+type PreparedChart struct {
+	engine *Engine
+	chart  *chart.Chart
+	// templates holds the parsed templates. It is never executed itself, only
+	// clones of it are.
+	templates *template.Template
+}
+
+// Prepare parses the templates of a chart and its dependencies, returning a
+// PreparedChart that renders them without parsing them again. The chart must
+// not be modified afterwards.
+func (e *Engine) Prepare(chrt *chart.Chart) (*PreparedChart, error) {
+	r := e.newRender(context.Background())
+
+	tpls := map[string]renderable{}
+	e.collectTemplateSources(chrt, tpls)
+	if err := r.parseTemplates(sortTemplates(tpls), tpls); err != nil {
+		return nil, err
+	}
+
+	return &PreparedChart{engine: e, chart: chrt, templates: r.goTemplate}, nil
+}
+
+// Render renders the prepared chart like Engine.RenderAllChartTemplates.
+func (p *PreparedChart) Render(values releasevalues.Values) (map[string]string, error) {
+	// Cloning shares the parse trees of the templates, while giving the
+	// render its own template functions, and so its own include state.
+	t, err := p.templates.Clone()
+	if err != nil {
+		return map[string]string{}, fmt.Errorf("failed to clone prepared templates: %w", err)
+	}
+	ctx := context.Background()
+	r := p.engine.newRenderOn(ctx, t)
+	r.prepared = true
+
+	result, err := r.render(ctx, p.chart, values)
+	return result.Manifests, err
+}
+
+// collectTemplateSources adds the templates of a chart and its dependencies
+// which recAllTpls renders, keyed by their full path.
+func (e *Engine) collectTemplateSources(c *chart.Chart, tpls map[string]renderable) {
+	if !e.options.RootChartOnly {
+		for _, child := range c.Dependencies() {
+			e.collectTemplateSources(child, tpls)
+		}
+	}
+
+	for _, t := range c.Templates {
+		if t == nil || len(t.Data) == 0 || !isTemplateValid(c, t.Name) {
+			continue
+		}
+		tpls[path.Join(e.templatePath(c), t.Name)] = renderable{tpl: string(t.Data)}
+	}
+}
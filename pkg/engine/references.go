@@ -0,0 +1,198 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"path"
+	"sort"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/releasevalues"
+	chart "helm.sh/helm/v4/pkg/chart/v2"
+)
+
+// ReferencedValuePaths returns the sorted, deduplicated list of value paths
+// referenced as .Values field chains by the templates of a chart and its
+// dependencies.
+//
+// The templates are parsed but not executed, so only statically visible
+// references are found. References made relative to the dot of a `with` block
+// are resolved; the dot of a `range` block is not. Paths referenced by a
+// dependency are reported relative to the root chart's values (e.g. "sub.port"
+// for .Values.port in subchart "sub"), except for globals.
+func (e *Engine) ReferencedValuePaths(chrt *chart.Chart) ([]string, error) {
+	refs := make(map[string]struct{})
+	if err := recReferencedValuePaths(chrt, nil, refs); err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(refs))
+	for p := range refs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func recReferencedValuePaths(c *chart.Chart, scope []string, refs map[string]struct{}) error {
+	for _, child := range c.Dependencies() {
+		childScope := append(append([]string{}, scope...), child.Name())
+		if err := recReferencedValuePaths(child, childScope, refs); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range c.Templates {
+		if f == nil {
+			continue
+		}
+		filename := path.Join(c.ChartFullPath(), f.Name)
+		if err := collectValueReferences(filename, f.Data, scope, refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectValueReferences parses a template and adds the value paths it
+// references to refs, prefixed with scope.
+func collectValueReferences(filename string, data []byte, scope []string, refs map[string]struct{}) error {
+	t, err := template.New(filename).Funcs(funcMap()).Parse(string(data))
+	if err != nil {
+		return cleanupParseError(filename, err)
+	}
+	for _, tt := range t.Templates() {
+		if tt.Tree == nil {
+			continue
+		}
+		w := referenceWalker{
+			scope: scope,
+			refs:  refs,
+			vars:  map[string][]string{"$": {}},
+		}
+		// Named templates are almost always included with the root context.
+		w.walk(tt.Tree.Root, []string{})
+	}
+	return nil
+}
+
+// referenceWalker walks a template parse tree collecting .Values references.
+//
+// Field chains are tracked as paths from the root render context, e.g.
+// {"Values", "image", "tag"}. A nil path means the value is not statically
+// known.
+type referenceWalker struct {
+	scope []string
+	refs  map[string]struct{}
+	vars  map[string][]string
+}
+
+func (w *referenceWalker) record(p []string) {
+	if len(p) < 2 || p[0] != "Values" {
+		return
+	}
+	valuesPath := p[1:]
+	if valuesPath[0] != "global" {
+		valuesPath = append(append([]string{}, w.scope...), valuesPath...)
+	}
+	w.refs[releasevalues.JoinPath(valuesPath...)] = struct{}{}
+}
+
+func (w *referenceWalker) walk(node parse.Node, dot []string) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			w.walk(child, dot)
+		}
+	case *parse.ActionNode:
+		w.pipe(n.Pipe, dot)
+	case *parse.TemplateNode:
+		w.pipe(n.Pipe, dot)
+	case *parse.IfNode:
+		w.pipe(n.Pipe, dot)
+		w.walk(n.List, dot)
+		w.walk(n.ElseList, dot)
+	case *parse.WithNode:
+		w.walk(n.List, w.pipe(n.Pipe, dot))
+		w.walk(n.ElseList, dot)
+	case *parse.RangeNode:
+		w.pipe(n.Pipe, dot)
+		// Range variables hold the elements, not the ranged over value.
+		for _, v := range n.Pipe.Decl {
+			w.vars[v.Ident[0]] = nil
+		}
+		w.walk(n.List, nil)
+		w.walk(n.ElseList, dot)
+	}
+}
+
+// pipe records the references within a pipeline and returns the path of its
+// result, when statically known.
+func (w *referenceWalker) pipe(p *parse.PipeNode, dot []string) []string {
+	if p == nil {
+		return nil
+	}
+	var result []string
+	for i, cmd := range p.Cmds {
+		for _, arg := range cmd.Args {
+			r := w.resolve(arg, dot)
+			if i == 0 && len(cmd.Args) == 1 {
+				result = r
+			}
+		}
+	}
+	if len(p.Cmds) != 1 {
+		result = nil
+	}
+	for _, v := range p.Decl {
+		w.vars[v.Ident[0]] = result
+	}
+	return result
+}
+
+// resolve records the references within a node and returns its path, when
+// statically known.
+func (w *referenceWalker) resolve(node parse.Node, dot []string) []string {
+	switch n := node.(type) {
+	case *parse.DotNode:
+		return dot
+	case *parse.FieldNode:
+		return w.extend(dot, n.Ident)
+	case *parse.VariableNode:
+		return w.extend(w.vars[n.Ident[0]], n.Ident[1:])
+	case *parse.ChainNode:
+		return w.extend(w.resolve(n.Node, dot), n.Field)
+	case *parse.PipeNode:
+		return w.pipe(n, dot)
+	}
+	return nil
+}
+
+func (w *referenceWalker) extend(base []string, fields []string) []string {
+	if base == nil {
+		return nil
+	}
+	p := append(append([]string{}, base...), fields...)
+	if len(fields) > 0 {
+		w.record(p)
+	}
+	return p
+}
@@ -0,0 +1,115 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/releasevalues"
+)
+
+// Release is the release information available to templates as .Release.
+type Release struct {
+	Name      string
+	Namespace string
+	Revision  int
+	IsInstall bool
+	IsUpgrade bool
+	Service   string
+}
+
+// releaseFromValues converts release information decoded from the render
+// values (e.g. from JSON) to a Release, coercing each field to its type.
+func releaseFromValues(v interface{}) Release {
+	var m map[string]interface{}
+	switch vv := v.(type) {
+	case Release:
+		return vv
+	case *Release:
+		if vv != nil {
+			return *vv
+		}
+	case map[string]interface{}:
+		m = vv
+	case releasevalues.Values:
+		m = vv
+	}
+
+	return Release{
+		Name:      toString(m["Name"]),
+		Namespace: toString(m["Namespace"]),
+		Revision:  toInt(m["Revision"]),
+		IsInstall: toBool(m["IsInstall"]),
+		IsUpgrade: toBool(m["IsUpgrade"]),
+		Service:   toString(m["Service"]),
+	}
+}
+
+func toString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func toInt(v interface{}) int {
+	switch vv := v.(type) {
+	case int:
+		return vv
+	case int64:
+		return int(vv)
+	case float64:
+		return int(vv)
+	case json.Number:
+		i, _ := vv.Int64()
+		return int(i)
+	case string:
+		i, _ := strconv.Atoi(vv)
+		return i
+	}
+	return 0
+}
+
+func toBool(v interface{}) bool {
+	switch vv := v.(type) {
+	case bool:
+		return vv
+	case string:
+		b, _ := strconv.ParseBool(vv)
+		return b
+	}
+	return false
+}
+
+// prepareRelease returns a shallow copy of the render values whose Release is
+// a Release, so that e.g. .Release.IsUpgrade is a bool. The release set with
+// WithReleaseStruct takes precedence over the one in the values.
+func (e *Engine) prepareRelease(vals releasevalues.Values) releasevalues.Values {
+	release := releaseFromValues(vals["Release"])
+	if e.options.Release != nil {
+		release = *e.options.Release
+	}
+
+	out := make(releasevalues.Values, len(vals))
+	for k, v := range vals {
+		out[k] = v
+	}
+	out["Release"] = release
+	return out
+}
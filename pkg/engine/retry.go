@@ -0,0 +1,67 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// RetryableError marks an error returned by HostFunctions as transient (e.g.
+// the API server throttling requests), so that a lookup failing with it is
+// retried when WithLookupRetry is set. Other errors, like a resource not being
+// found, are returned as is.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string { return e.Err.Error() }
+
+func (e *RetryableError) Unwrap() error { return e.Err }
+
+// isRetryable reports whether err is marked as transient by the host.
+func isRetryable(err error) bool {
+	var re *RetryableError
+	return errors.As(err, &re)
+}
+
+// retryingHostFunctions retries the Kubernetes lookups of HostFunctions that
+// fail with a RetryableError, doubling the delay between attempts. Waiting
+// for the next attempt stops once ctx, the context of the render, is done.
+type retryingHostFunctions struct {
+	HostFunctions
+	ctx      context.Context
+	attempts int
+	backoff  time.Duration
+}
+
+func (r *retryingHostFunctions) LookupKubernetesResource(apiversion string, kind string, namespace string, name string) (map[string]interface{}, error) {
+	delay := r.backoff
+	for attempt := 1; ; attempt++ {
+		obj, err := r.HostFunctions.LookupKubernetesResource(apiversion, kind, namespace, name)
+		if err == nil || attempt >= r.attempts || !isRetryable(err) {
+			return obj, err
+		}
+		select {
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
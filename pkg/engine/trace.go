@@ -0,0 +1,79 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// templateTrace counts the executions of a template and their total duration.
+type templateTrace struct {
+	calls    int
+	duration time.Duration
+}
+
+// executionTrace records the template executions of a render, keyed by
+// template name, see WithExecutionTrace.
+type executionTrace map[string]*templateTrace
+
+// record adds an execution of the named template which began at start.
+func (t executionTrace) record(name string, start time.Time) {
+	tt, ok := t[name]
+	if !ok {
+		tt = &templateTrace{}
+		t[name] = tt
+	}
+	tt.calls++
+	tt.duration += time.Since(start)
+}
+
+// traceInclude wraps an 'include' function to record the executions of the
+// templates it includes.
+func (t executionTrace) traceInclude(include func(string, interface{}) (string, error)) func(string, interface{}) (string, error) {
+	return func(name string, data interface{}) (string, error) {
+		defer t.record(name, time.Now())
+		return include(name, data)
+	}
+}
+
+// write writes the trace as a table to w, with the templates taking the most
+// time in total first.
+func (t executionTrace) write(w io.Writer) error {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := t[names[i]], t[names[j]]
+		if a.duration != b.duration {
+			return a.duration > b.duration
+		}
+		return names[i] < names[j]
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TEMPLATE\tCALLS\tTOTAL\tAVERAGE")
+	for _, name := range names {
+		tt := t[name]
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", name, tt.calls, tt.duration, tt.duration/time.Duration(tt.calls))
+	}
+	return tw.Flush()
+}
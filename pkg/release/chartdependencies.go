@@ -16,6 +16,8 @@ limitations under the License.
 package release
 
 import (
+	"bytes"
+	"fmt"
 	"log"
 	"strings"
 
@@ -23,16 +25,110 @@ import (
 
 	"github.com/helm/helm-plugin-gotemplate-renderer/pkg/releasevalues"
 	chart "helm.sh/helm/v4/pkg/chart/v2"
+	chartloader "helm.sh/helm/v4/pkg/chart/v2/loader"
 )
 
+// FetchDependencyFunc returns the packaged chart (.tgz) of a dependency, as
+// declared in Chart.yaml.
+type FetchDependencyFunc func(name, version, repository string) ([]byte, error)
+
+// DependencyOption configures ProcessDependencies.
+type DependencyOption func(*dependencyOptions)
+
+type dependencyOptions struct {
+	fetch FetchDependencyFunc
+	// fetched caches the archives fetched, by name, version and repository
+	fetched map[string][]byte
+}
+
+// WithDependencyFetcher fetches the dependencies declared in Chart.yaml that
+// are missing from the charts/ directory with fetch, rather than leaving them
+// out. Each dependency is fetched once.
+func WithDependencyFetcher(fetch FetchDependencyFunc) DependencyOption {
+	return func(o *dependencyOptions) {
+		o.fetch = fetch
+	}
+}
+
 // ProcessDependencies checks through this chart's dependencies, processing accordingly.
-func ProcessDependencies(c *chart.Chart, v releasevalues.Values) error {
-	if err := processDependencyEnabled(c, v, ""); err != nil {
+func ProcessDependencies(c *chart.Chart, v releasevalues.Values, options ...DependencyOption) error {
+	opts := &dependencyOptions{fetched: map[string][]byte{}}
+	for _, o := range options {
+		o(opts)
+	}
+	if err := processDependencyEnabled(c, v, "", opts); err != nil {
 		return err
 	}
 	return processDependencyImportValues(c, true)
 }
 
+// fetchMissingDependencies adds the enabled dependencies of c declared in
+// Chart.yaml but missing from its charts, fetched with opts.fetch. A vendored
+// chart of a version that no dependency accepts is replaced by the fetched
+// one.
+//
+// The values of the missing dependencies are not known yet, so
+// processDependencyEnabled evaluates the conditions and tags again once they
+// are fetched.
+func fetchMissingDependencies(c *chart.Chart, v map[string]interface{}, path string, opts *dependencyOptions) error {
+	for _, req := range c.Metadata.Dependencies {
+		req.Enabled = true
+	}
+	cvals, err := CoalesceValues(c, v)
+	if err != nil {
+		return err
+	}
+	processDependencyTags(c.Metadata.Dependencies, cvals)
+	processDependencyConditions(c.Metadata.Dependencies, cvals, path)
+
+Loop:
+	for _, req := range c.Metadata.Dependencies {
+		if req == nil || !req.Enabled {
+			continue
+		}
+		for _, existing := range c.Dependencies() {
+			if existing.Name() == req.Name && IsCompatibleRange(req.Version, existing.Metadata.Version) {
+				continue Loop
+			}
+		}
+
+		key := req.Name + "\x00" + req.Version + "\x00" + req.Repository
+		data, ok := opts.fetched[key]
+		if !ok {
+			var err error
+			if data, err = opts.fetch(req.Name, req.Version, req.Repository); err != nil {
+				return fmt.Errorf("failed to fetch dependency %q of chart %q: %w", req.Name, c.Name(), err)
+			}
+			opts.fetched[key] = data
+		}
+		// A chart has a single parent, so each dependent loads its own copy
+		dep, err := chartloader.LoadArchive(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to load dependency %q of chart %q: %w", req.Name, c.Name(), err)
+		}
+
+		var deps []*chart.Chart
+		for _, existing := range c.Dependencies() {
+			if existing.Name() != req.Name || isRequiredVersion(c.Metadata.Dependencies, existing) {
+				deps = append(deps, existing)
+			}
+		}
+		c.SetDependencies(append(deps, dep)...)
+	}
+	return nil
+}
+
+// isRequiredVersion reports whether a dependency in reqs accepts the version of
+// the chart ch.
+func isRequiredVersion(reqs []*chart.Dependency, ch *chart.Chart) bool {
+	for _, req := range reqs {
+		if req != nil && req.Name == ch.Name() && IsCompatibleRange(req.Version, ch.Metadata.Version) {
+			return true
+		}
+	}
+	return false
+}
+
 // processDependencyConditions disables charts based on condition path value in values
 func processDependencyConditions(reqs []*chart.Dependency, cvals releasevalues.Values, cpath string) {
 	if reqs == nil {
@@ -117,10 +213,15 @@ func getAliasDependency(charts []*chart.Chart, dep *chart.Dependency) *chart.Cha
 }
 
 // processDependencyEnabled removes disabled charts from dependencies
-func processDependencyEnabled(c *chart.Chart, v map[string]interface{}, path string) error {
+func processDependencyEnabled(c *chart.Chart, v map[string]interface{}, path string, opts *dependencyOptions) error {
 	if c.Metadata.Dependencies == nil {
 		return nil
 	}
+	if opts.fetch != nil {
+		if err := fetchMissingDependencies(c, v, path, opts); err != nil {
+			return err
+		}
+	}
 
 	var chartDependencies []*chart.Chart
 	// If any dependency is not a part of Chart.yaml
@@ -190,7 +291,7 @@ Loop:
 	// recursively call self to process sub dependencies
 	for _, t := range cd {
 		subpath := path + t.Metadata.Name + "."
-		if err := processDependencyEnabled(t, cvals, subpath); err != nil {
+		if err := processDependencyEnabled(t, cvals, subpath, opts); err != nil {
 			return err
 		}
 	}
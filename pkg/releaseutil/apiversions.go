@@ -0,0 +1,68 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package releaseutil
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// GroupVersionKind is the apiVersion and kind of a rendered resource.
+type GroupVersionKind struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+}
+
+// RenderedAPIVersions returns the distinct apiVersion/kind pairs of the
+// documents of the rendered files, sorted by apiVersion and kind, e.g. to check
+// that a chart only uses APIs the target cluster serves.
+//
+// Partials, NOTES.txt, documents which are not valid YAML and documents
+// without an apiVersion or kind are skipped.
+func RenderedAPIVersions(files map[string]string) []GroupVersionKind {
+	seen := map[GroupVersionKind]bool{}
+	for filePath, content := range files {
+		if strings.HasPrefix(path.Base(filePath), "_") || path.Base(filePath) == NotesFileName {
+			continue
+		}
+		for _, m := range SplitManifests(content) {
+			var head SimpleHead
+			if err := yaml.Unmarshal([]byte(m), &head); err != nil {
+				continue
+			}
+			if head.Version == "" || head.Kind == "" {
+				continue
+			}
+			seen[GroupVersionKind{APIVersion: head.Version, Kind: head.Kind}] = true
+		}
+	}
+
+	gvks := make([]GroupVersionKind, 0, len(seen))
+	for gvk := range seen {
+		gvks = append(gvks, gvk)
+	}
+	sort.Slice(gvks, func(i, j int) bool {
+		if gvks[i].APIVersion != gvks[j].APIVersion {
+			return gvks[i].APIVersion < gvks[j].APIVersion
+		}
+		return gvks[i].Kind < gvks[j].Kind
+	})
+	return gvks
+}
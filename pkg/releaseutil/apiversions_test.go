@@ -0,0 +1,67 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package releaseutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderedAPIVersions(t *testing.T) {
+	files := map[string]string{
+		"chart/templates/workload.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+# Only a comment
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: worker
+`,
+		"chart/templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`,
+		"chart/charts/db/templates/sts.yaml": `apiVersion: apps/v1
+kind: StatefulSet
+`,
+		"chart/templates/broken.yaml": `apiVersion: v1
+kind: [`,
+		"chart/templates/_helpers.tpl": `apiVersion: v1
+kind: Secret`,
+		"chart/templates/NOTES.txt": `kind: Notes`,
+	}
+
+	assert.Equal(t, []GroupVersionKind{
+		{APIVersion: "apps/v1", Kind: "Deployment"},
+		{APIVersion: "apps/v1", Kind: "StatefulSet"},
+		{APIVersion: "v1", Kind: "ConfigMap"},
+		{APIVersion: "v1", Kind: "Service"},
+	}, RenderedAPIVersions(files))
+
+	assert.Empty(t, RenderedAPIVersions(nil))
+}
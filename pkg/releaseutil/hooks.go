@@ -0,0 +1,72 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package releaseutil
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HookWeightAnnotation is the annotation ordering hooks of the same phase.
+const HookWeightAnnotation = "helm.sh/hook-weight"
+
+// HookPhases returns the lifecycle phases (e.g. pre-install, post-upgrade) the
+// manifest is a hook for.
+func (m Manifest) HookPhases() []string {
+	if !m.IsHook() {
+		return nil
+	}
+	var phases []string
+	for _, phase := range strings.Split(m.Head.Metadata.Annotations[HookAnnotation], ",") {
+		if phase = strings.TrimSpace(phase); phase != "" {
+			phases = append(phases, phase)
+		}
+	}
+	return phases
+}
+
+// HookWeight returns the weight of a hook. Like Helm, a missing or invalid
+// weight is 0.
+func (m Manifest) HookWeight() int {
+	if m.Head == nil || m.Head.Metadata == nil {
+		return 0
+	}
+	weight, err := strconv.Atoi(strings.TrimSpace(m.Head.Metadata.Annotations[HookWeightAnnotation]))
+	if err != nil {
+		return 0
+	}
+	return weight
+}
+
+// HooksByPhase groups hooks by lifecycle phase, ordered by weight within each
+// phase. A hook for several phases is included in each of them. Hooks of equal
+// weight keep their relative order.
+func HooksByPhase(hooks []Manifest) map[string][]Manifest {
+	phases := map[string][]Manifest{}
+	for _, h := range hooks {
+		for _, phase := range h.HookPhases() {
+			phases[phase] = append(phases[phase], h)
+		}
+	}
+	for _, manifests := range phases {
+		sort.SliceStable(manifests, func(i, j int) bool {
+			return manifests[i].HookWeight() < manifests[j].HookWeight()
+		})
+	}
+	return phases
+}
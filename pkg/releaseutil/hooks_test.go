@@ -0,0 +1,74 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package releaseutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHooksByPhase(t *testing.T) {
+	files := map[string]string{
+		"chart/templates/hooks.yaml": `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  annotations:
+    helm.sh/hook: pre-install, pre-upgrade
+    helm.sh/hook-weight: "5"
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: seed
+  annotations:
+    helm.sh/hook: pre-install
+    helm.sh/hook-weight: "-1"
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: smoke-test
+  annotations:
+    helm.sh/hook: post-upgrade
+`,
+		"chart/templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`,
+	}
+
+	hooks, generic, err := SortManifests(files, InstallOrder)
+	require.NoError(t, err)
+	require.Len(t, generic, 1)
+
+	names := map[string][]string{}
+	for phase, manifests := range HooksByPhase(hooks) {
+		for _, m := range manifests {
+			names[phase] = append(names[phase], m.Head.Metadata.Name)
+		}
+	}
+
+	assert.Equal(t, map[string][]string{
+		"pre-install":  {"seed", "migrate"},
+		"pre-upgrade":  {"migrate"},
+		"post-upgrade": {"smoke-test"},
+	}, names)
+}
@@ -0,0 +1,153 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package releaseutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// HookAnnotation is the annotation marking a resource as a Helm hook.
+const HookAnnotation = "helm.sh/hook"
+
+// NotesFileName is the name of the chart template rendered as release notes.
+const NotesFileName = "NOTES.txt"
+
+// Manifest represents a manifest file, which has a name and some content.
+type Manifest struct {
+	Name    string
+	Content string
+	Head    *SimpleHead
+}
+
+// IsHook returns true if the manifest is annotated as a Helm hook.
+func (m Manifest) IsHook() bool {
+	if m.Head == nil || m.Head.Metadata == nil {
+		return false
+	}
+	_, ok := m.Head.Metadata.Annotations[HookAnnotation]
+	return ok
+}
+
+// SortManifests takes a map of filename/YAML contents, splits the file
+// by manifest entries, and sorts the entries by 'ordering'.
+//
+// Hooks are separated from the other (generic) manifests and returned first.
+//
+// Partials, NOTES.txt and empty files are skipped.
+func SortManifests(files map[string]string, ordering KindSortOrder) ([]Manifest, []Manifest, error) {
+	var hooks, generic []Manifest
+
+	var sortedFilePaths []string
+	for filePath := range files {
+		sortedFilePaths = append(sortedFilePaths, filePath)
+	}
+	sort.Strings(sortedFilePaths)
+
+	for _, filePath := range sortedFilePaths {
+		content := files[filePath]
+
+		if strings.HasPrefix(path.Base(filePath), "_") {
+			continue
+		}
+		// NOTES.txt is displayed to the user rather than applied.
+		if path.Base(filePath) == NotesFileName {
+			continue
+		}
+		if strings.TrimSpace(content) == "" {
+			continue
+		}
+
+		entries := SplitManifests(content)
+
+		// Go through manifests in order found in file (function `SplitManifests` creates integer-sortable keys)
+		var sortedEntryKeys []string
+		for entryKey := range entries {
+			sortedEntryKeys = append(sortedEntryKeys, entryKey)
+		}
+		sort.Sort(BySplitManifestsOrder(sortedEntryKeys))
+
+		for _, entryKey := range sortedEntryKeys {
+			m := entries[entryKey]
+
+			var entry SimpleHead
+			if err := yaml.Unmarshal([]byte(m), &entry); err != nil {
+				return nil, nil, fmt.Errorf("YAML parse error on %s: %w", filePath, err)
+			}
+
+			manifest := Manifest{
+				Name:    filePath,
+				Content: m,
+				Head:    &entry,
+			}
+			if manifest.IsHook() {
+				hooks = append(hooks, manifest)
+			} else {
+				generic = append(generic, manifest)
+			}
+		}
+	}
+
+	return sortManifestsByKind(hooks, ordering), sortManifestsByKind(generic, ordering), nil
+}
+
+// Stream concatenates manifests into a single YAML stream, as produced by
+// `helm template`. Each document is preceded by a comment naming its source
+// file.
+func Stream(manifests []Manifest) string {
+	var b strings.Builder
+	for _, m := range manifests {
+		fmt.Fprintf(&b, "---\n# Source: %s\n%s\n", m.Name, m.Content)
+	}
+	return b.String()
+}
+
+// List wraps the resources of the manifests, in order, in a single v1/List
+// object and returns it as YAML, as ingested by some GitOps tools. Documents
+// without content, e.g. only comments, are skipped.
+func List(manifests []Manifest) (string, error) {
+	items := make([]interface{}, 0, len(manifests))
+	for _, m := range manifests {
+		var item map[string]interface{}
+		err := yaml.Unmarshal([]byte(m.Content), &item, func(d *json.Decoder) *json.Decoder {
+			d.UseNumber()
+			return d
+		})
+		if err != nil {
+			return "", fmt.Errorf("YAML parse error on %s: %w", m.Name, err)
+		}
+		if len(item) == 0 {
+			continue
+		}
+		items = append(items, item)
+	}
+
+	data, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"items":      items,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
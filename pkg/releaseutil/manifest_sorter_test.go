@@ -0,0 +1,58 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package releaseutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestList(t *testing.T) {
+	manifests := []Manifest{
+		{Name: "chart/templates/cm.yaml", Content: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config\ndata:\n  replicas: \"3\""},
+		{Name: "chart/templates/empty.yaml", Content: "# only a comment"},
+		{Name: "chart/templates/deployment.yaml", Content: "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\nspec:\n  replicas: 3"},
+	}
+
+	list, err := List(manifests)
+	require.NoError(t, err)
+	assert.Equal(t, `apiVersion: v1
+items:
+- apiVersion: v1
+  data:
+    replicas: "3"
+  kind: ConfigMap
+  metadata:
+    name: config
+- apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+  spec:
+    replicas: 3
+kind: List
+`, list)
+
+	list, err = List(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "apiVersion: v1\nitems: []\nkind: List\n", list)
+
+	_, err = List([]Manifest{{Name: "chart/templates/broken.yaml", Content: "kind: ["}})
+	assert.ErrorContains(t, err, "YAML parse error on chart/templates/broken.yaml")
+}
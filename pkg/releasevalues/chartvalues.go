@@ -17,14 +17,23 @@ limitations under the License.
 package releasevalues
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"os"
+	"strconv"
 
+	"github.com/mitchellh/copystructure"
 	"sigs.k8s.io/yaml"
 )
 
+// RedactedValue replaces values removed by Values.Redact.
+const RedactedValue = "***REDACTED***"
+
 type Values map[string]any
 
 // YAML encodes the Values into a YAML string.
@@ -67,6 +76,117 @@ func (v Values) AsMap() map[string]interface{} {
 	return v
 }
 
+// DeepCopy returns a copy of the Values that shares no maps or slices with the
+// original.
+func (v Values) DeepCopy() Values {
+	if v == nil {
+		return nil
+	}
+	c, err := copystructure.Copy(v)
+	if err != nil {
+		// Values decoded from YAML or JSON only hold copyable types.
+		panic(err)
+	}
+	return c.(Values)
+}
+
+// Redact returns a deep copy of the Values with the values at the given paths
+// replaced by RedactedValue. The structure of the Values is left intact: when
+// a path resolves to a table, each value within it is redacted.
+//
+// A path may end in a wildcard to redact every value in a table:
+//
+//	secrets.*
+//
+// Paths that do not exist are ignored.
+func (v Values) Redact(paths []string) Values {
+	out := v.DeepCopy()
+	for _, p := range paths {
+		out.redact(ParsePath(p))
+	}
+	return out
+}
+
+func (v Values) redact(path []string) {
+	key, parent := path[len(path)-1], path[:len(path)-1]
+
+	table := v
+	if len(parent) > 0 {
+		t, err := v.Table(JoinPath(parent...))
+		if err != nil {
+			return
+		}
+		table = t
+	}
+
+	if key == "*" {
+		for k, val := range table {
+			table[k] = redactValue(val)
+		}
+		return
+	}
+	if val, ok := table[key]; ok {
+		table[key] = redactValue(val)
+	}
+}
+
+func redactValue(val interface{}) interface{} {
+	switch vv := val.(type) {
+	case map[string]interface{}:
+		for k, child := range vv {
+			vv[k] = redactValue(child)
+		}
+		return vv
+	case Values:
+		for k, child := range vv {
+			vv[k] = redactValue(child)
+		}
+		return vv
+	case []interface{}:
+		for i, child := range vv {
+			vv[i] = redactValue(child)
+		}
+		return vv
+	default:
+		return RedactedValue
+	}
+}
+
+// Merge returns a deep copy of the Values with other merged over it. Tables
+// are merged recursively, while all other values in other, including nil,
+// replace those in v. Neither v nor other is modified.
+func (v Values) Merge(other Values) Values {
+	out := v.DeepCopy()
+	if out == nil {
+		out = Values{}
+	}
+	mergeInto(out, other.DeepCopy())
+	return out
+}
+
+func mergeInto(dst, src map[string]interface{}) {
+	for key, val := range src {
+		if srcTable, ok := asTable(val); ok {
+			if dstTable, ok := asTable(dst[key]); ok {
+				mergeInto(dstTable, srcTable)
+				continue
+			}
+		}
+		dst[key] = val
+	}
+}
+
+// asTable returns v as a map if it is a table.
+func asTable(v interface{}) (map[string]interface{}, bool) {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		return vv, true
+	case Values:
+		return vv, true
+	}
+	return nil, false
+}
+
 // Encode writes serialized Values information to the given io.Writer.
 func (v Values) Encode(w io.Writer) error {
 	out, err := yaml.Marshal(v)
@@ -97,6 +217,10 @@ func tableLookup(v Values, simple string) (Values, error) {
 }
 
 // ReadValues will parse YAML byte data into a Values.
+//
+// YAML anchors and aliases, including merge keys (<<), are resolved: every
+// alias becomes an independent copy of the anchored value, sharing no maps or
+// slices with it.
 func ReadValues(data []byte) (vals Values, err error) {
 	err = yaml.Unmarshal(data, &vals, func(d *json.Decoder) *json.Decoder {
 		d.UseNumber()
@@ -123,6 +247,193 @@ func IsTable(v interface{}) bool {
 	return ok
 }
 
+// Get returns the value at the given path, or fallback if the path does not
+// exist or its value is nil.
+//
+// Unlike PathValue, Get never errors, the path may resolve to a table, and
+// list elements may be addressed by index:
+//
+//	v.Get("containers[0].image", "nginx")
+func (v Values) Get(path string, fallback interface{}) interface{} {
+	if val, ok := v.lookup(path); ok && val != nil {
+		return val
+	}
+	return fallback
+}
+
+// lookup returns the value at the given path like Get, reporting whether the
+// path exists. A path set to null exists, with a nil value.
+func (v Values) lookup(path string) (interface{}, bool) {
+	var cur interface{} = v
+	for _, key := range ParsePath(path) {
+		var ok bool
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			cur, ok = c[key]
+		case Values:
+			cur, ok = c[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if ok = err == nil && i >= 0 && i < len(c); ok {
+				cur = c[i]
+			}
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// Flatten returns the scalar values of the tree keyed by their path, in the
+// form understood by ParsePath and SetPath, e.g. "image.tag" or "hosts[0]".
+// Scalars are formatted with fmt.Sprint, and null values become empty strings.
+// Empty maps and slices have no entries.
+func (v Values) Flatten() map[string]string {
+	flat := map[string]string{}
+	flatten(flat, "", map[string]interface{}(v))
+	return flat
+}
+
+func flatten(flat map[string]string, path string, val interface{}) {
+	switch vv := val.(type) {
+	case map[string]interface{}:
+		for k, e := range vv {
+			flatten(flat, joinKey(path, k), e)
+		}
+	case Values:
+		flatten(flat, path, map[string]interface{}(vv))
+	case []interface{}:
+		for i, e := range vv {
+			flatten(flat, joinIndex(path, i), e)
+		}
+	case nil:
+		flat[path] = ""
+	default:
+		flat[path] = fmt.Sprint(vv)
+	}
+}
+
+// Checksum returns the hex encoded sha256 of the Values in a canonical form,
+// so that logically equal Values have the same checksum: map keys are sorted,
+// and numbers are compared by value, so that e.g. 1 and 1.0 are equal.
+// Integers are compared exactly, however large. An error is returned for
+// values that cannot be encoded as JSON, such as NaN or maps with non-string
+// keys.
+func (v Values) Checksum() (string, error) {
+	data, err := json.Marshal(canonicalValue(map[string]interface{}(v)))
+	if err != nil {
+		return "", fmt.Errorf("cannot checksum values: %w", err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+// canonicalValue returns val with its numbers replaced by their canonical
+// json.Number. encoding/json already sorts the keys of maps.
+func canonicalValue(val interface{}) interface{} {
+	switch vv := val.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(vv))
+		for k, e := range vv {
+			out[k] = canonicalValue(e)
+		}
+		return out
+	case Values:
+		return canonicalValue(map[string]interface{}(vv))
+	case []interface{}:
+		out := make([]interface{}, len(vv))
+		for i, e := range vv {
+			out[i] = canonicalValue(e)
+		}
+		return out
+	case int:
+		return json.Number(strconv.FormatInt(int64(vv), 10))
+	case int64:
+		return json.Number(strconv.FormatInt(vv, 10))
+	case float64:
+		if vv == math.Trunc(vv) && !math.IsInf(vv, 0) {
+			i, _ := big.NewFloat(vv).Int(nil)
+			return json.Number(i.String())
+		}
+		return json.Number(strconv.FormatFloat(vv, 'g', -1, 64))
+	case json.Number:
+		// Integers are normalized as such, as not every integer is exactly
+		// representable as a float64.
+		if i, ok := new(big.Int).SetString(string(vv), 10); ok {
+			return json.Number(i.String())
+		}
+		if f, err := vv.Float64(); err == nil {
+			return canonicalValue(f)
+		}
+		return vv
+	default:
+		return vv
+	}
+}
+
+// SetPath sets the value at path, as understood by ParsePath, creating any
+// missing tables along the way. Indexes (hosts[0]) create missing slices and
+// extend short ones with nulls, so that the paths of Flatten rebuild the tree.
+func (v Values) SetPath(path string, value interface{}) error {
+	if path == "" {
+		return errors.New("YAML path cannot be empty")
+	}
+	if _, err := setPath(map[string]interface{}(v), parsePathKeys(path), value); err != nil {
+		return fmt.Errorf("cannot set %q: %w", path, err)
+	}
+	return nil
+}
+
+// setPath sets the value at keys within cur, returning cur, or the value to
+// replace it with if it is not a table or slice, or is a slice that grew.
+func setPath(cur interface{}, keys []pathKey, value interface{}) (interface{}, error) {
+	key, rest := keys[0], keys[1:]
+	if _, ok := asTable(cur); !ok && !isSlice(cur) {
+		if key.index {
+			cur = []interface{}{}
+		} else {
+			cur = map[string]interface{}{}
+		}
+	}
+
+	if table, ok := asTable(cur); ok {
+		if len(rest) == 0 {
+			table[key.name] = value
+			return cur, nil
+		}
+		next, err := setPath(table[key.name], rest, value)
+		if err != nil {
+			return cur, err
+		}
+		table[key.name] = next
+		return cur, nil
+	}
+
+	list := cur.([]interface{})
+	idx, err := strconv.Atoi(key.name)
+	if err != nil || idx < 0 {
+		return cur, fmt.Errorf("index %q out of range", key.name)
+	}
+	for len(list) <= idx {
+		list = append(list, nil)
+	}
+	if len(rest) == 0 {
+		list[idx] = value
+		return list, nil
+	}
+	next, err := setPath(list[idx], rest, value)
+	if err != nil {
+		return list, err
+	}
+	list[idx] = next
+	return list, nil
+}
+
+func isSlice(v interface{}) bool {
+	_, ok := v.([]interface{})
+	return ok
+}
+
 // PathValue takes a path that traverses a YAML structure and returns the value at the end of that path.
 // The path starts at the root of the YAML structure and is comprised of YAML keys separated by periods.
 // Given the following YAML data the value at path "chapter.one.title" is "Loomings".
@@ -0,0 +1,499 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package releasevalues
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedact(t *testing.T) {
+	vals, err := ReadValues([]byte(`
+database:
+  host: db.example.com
+  password: hunter2
+secrets:
+  apiKey: abc123
+  tls:
+    cert: CERT
+    key: KEY
+`))
+	require.NoError(t, err)
+
+	redacted := vals.Redact([]string{"database.password", "secrets.*", "does.not.exist"})
+
+	expected := Values{
+		"database": map[string]interface{}{
+			"host":     "db.example.com",
+			"password": RedactedValue,
+		},
+		"secrets": map[string]interface{}{
+			"apiKey": RedactedValue,
+			"tls": map[string]interface{}{
+				"cert": RedactedValue,
+				"key":  RedactedValue,
+			},
+		},
+	}
+	assert.Equal(t, expected, redacted)
+
+	// The original values are left untouched.
+	password, err := vals.PathValue("database.password")
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", password)
+	key, err := vals.PathValue("secrets.tls.key")
+	require.NoError(t, err)
+	assert.Equal(t, "KEY", key)
+}
+
+func TestMerge(t *testing.T) {
+	base := Values{
+		"image": map[string]interface{}{
+			"repository": "nginx",
+			"tag":        "v1",
+		},
+		"replicas": 1,
+	}
+	override := Values{
+		"image": map[string]interface{}{
+			"tag": "v2",
+		},
+		"replicas": nil,
+	}
+
+	merged := base.Merge(override)
+
+	assert.Equal(t, Values{
+		"image": map[string]interface{}{
+			"repository": "nginx",
+			"tag":        "v2",
+		},
+		"replicas": nil,
+	}, merged)
+	assert.Equal(t, "v1", base["image"].(map[string]interface{})["tag"])
+	assert.Equal(t, 1, base["replicas"])
+}
+
+func TestChecksum(t *testing.T) {
+	a, err := ReadValues([]byte(`
+image:
+  repository: nginx
+  tag: "1.27"
+replicas: 3
+ports: [80, 443]
+`))
+	require.NoError(t, err)
+	b, err := ReadValues([]byte(`{"ports": [80, 443], "replicas": 3.0,
+  "image": {"tag": "1.27",   "repository": "nginx"}}`))
+	require.NoError(t, err)
+
+	c := Values{}
+	c["replicas"] = 3
+	c["ports"] = []interface{}{80, int64(443)}
+	c["image"] = map[string]interface{}{"tag": "1.27", "repository": "nginx"}
+
+	checksum := func(v Values) string {
+		t.Helper()
+		sum, err := v.Checksum()
+		require.NoError(t, err)
+		return sum
+	}
+
+	assert.Len(t, checksum(a), 64)
+	assert.Equal(t, checksum(a), checksum(b))
+	assert.Equal(t, checksum(a), checksum(c))
+
+	c["replicas"] = 3.5
+	assert.NotEqual(t, checksum(a), checksum(c))
+	b["ports"] = []interface{}{443, 80}
+	assert.NotEqual(t, checksum(a), checksum(b))
+
+	// Large integers are compared exactly
+	big1, err := ReadValues([]byte(`{"id": 9007199254740993}`))
+	require.NoError(t, err)
+	big2, err := ReadValues([]byte(`{"id": 9007199254740992}`))
+	require.NoError(t, err)
+	assert.NotEqual(t, checksum(big1), checksum(big2))
+	assert.Equal(t, checksum(big1), checksum(Values{"id": int64(9007199254740993)}))
+	assert.Equal(t, checksum(big2), checksum(Values{"id": float64(9007199254740992)}))
+	assert.NotEqual(t,
+		checksum(Values{"id": json.Number("123456789012345678901234567890")}),
+		checksum(Values{"id": json.Number("123456789012345678901234567891")}))
+	assert.Equal(t, checksum(Values{"ratio": 0.5}), checksum(Values{"ratio": json.Number("5e-1")}))
+
+	// Values that cannot be encoded fail
+	_, err = Values{"ratio": math.NaN()}.Checksum()
+	assert.Error(t, err)
+	_, err = Values{"keys": map[bool]interface{}{true: "a"}}.Checksum()
+	assert.Error(t, err)
+}
+
+func TestParseSet(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		assignments []string
+		expected    Values
+	}{
+		{
+			name:        "nested keys",
+			assignments: []string{"image.tag=v2", "image.pullPolicy=Always"},
+			expected: Values{
+				"image": map[string]interface{}{"tag": "v2", "pullPolicy": "Always"},
+			},
+		},
+		{
+			name:        "type inference",
+			assignments: []string{"enabled=true", "replicas=3", "name=web"},
+			expected:    Values{"enabled": true, "replicas": int64(3), "name": "web"},
+		},
+		{
+			name:        "list indices",
+			assignments: []string{"args[0]=--verbose", "args[1]=--debug"},
+			expected:    Values{"args": []interface{}{"--verbose", "--debug"}},
+		},
+		{
+			name:        "null",
+			assignments: []string{"resources=null"},
+			expected:    Values{"resources": nil},
+		},
+		{
+			name:        "escaped separators",
+			assignments: []string{`hosts=a\,b`, `annotations.example\.com/owner=team`},
+			expected: Values{
+				"hosts":       "a,b",
+				"annotations": map[string]interface{}{"example.com/owner": "team"},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			vals, err := ParseSet(tt.assignments)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, vals)
+		})
+	}
+
+	_, err := ParseSet([]string{"novalue"})
+	assert.Error(t, err)
+}
+
+func TestParsePath(t *testing.T) {
+	for path, expected := range map[string][]string{
+		"":                                {""},
+		"image.tag":                       {"image", "tag"},
+		`podAnnotations["example.com/a"]`: {"podAnnotations", "example.com/a"},
+		`["a.b"].c`:                       {"a.b", "c"},
+		"containers[0].image":             {"containers", "0", "image"},
+		`a["b.c"]["d"][1]`:                {"a", "b.c", "d", "1"},
+		"unterminated[0":                  {"unterminated[0"},
+		"a..b":                            {"a", "", "b"},
+	} {
+		assert.Equal(t, expected, ParsePath(path), path)
+		assert.Equal(t, expected, ParsePath(JoinPath(expected...)), path)
+	}
+}
+
+func TestGet(t *testing.T) {
+	vals, err := ReadValues([]byte(`
+image:
+  repository: nginx
+  tag: null
+podAnnotations:
+  example.com/owner: team
+containers:
+  - name: app
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, "nginx", vals.Get("image.repository", "busybox"))
+	assert.Equal(t, map[string]interface{}{"repository": "nginx", "tag": nil}, vals.Get("image", nil))
+	assert.Equal(t, "team", vals.Get(`podAnnotations["example.com/owner"]`, ""))
+	assert.Equal(t, "app", vals.Get("containers[0].name", ""))
+
+	// Missing paths
+	assert.Equal(t, "fallback", vals.Get("image.pullPolicy", "fallback"))
+	assert.Equal(t, "fallback", vals.Get("missing.table.key", "fallback"))
+	assert.Equal(t, "fallback", vals.Get("image.repository.nested", "fallback"))
+	assert.Equal(t, "fallback", vals.Get("containers[1].name", "fallback"))
+
+	// Explicit null
+	assert.Equal(t, "latest", vals.Get("image.tag", "latest"))
+}
+
+func TestFlatten(t *testing.T) {
+	vals, err := ReadValues([]byte(`
+replicas: 3
+enabled: true
+ratio: 0.5
+tag: null
+image:
+  repository: nginx
+podAnnotations:
+  example.com/owner: team
+hosts:
+  - a.example.com
+  - name: b
+    ports: [80, 443]
+empty: {}
+`))
+	require.NoError(t, err)
+
+	flat := vals.Flatten()
+	assert.Equal(t, map[string]string{
+		"replicas":                            "3",
+		"enabled":                             "true",
+		"ratio":                               "0.5",
+		"tag":                                 "",
+		"image.repository":                    "nginx",
+		`podAnnotations["example.com/owner"]`: "team",
+		"hosts[0]":                            "a.example.com",
+		"hosts[1].name":                       "b",
+		"hosts[1].ports[0]":                   "80",
+		"hosts[1].ports[1]":                   "443",
+	}, flat)
+
+	// Every flattened key addresses its value
+	for path, value := range flat {
+		if value == "" {
+			continue
+		}
+		assert.Equal(t, value, fmt.Sprint(vals.Get(path, nil)), path)
+	}
+
+	// Setting the flattened values rebuilds a tree of strings
+	tree := Values{
+		"image": map[string]interface{}{"repository": "nginx"},
+		"a.b":   map[string]interface{}{"c": "d"},
+		"hosts": []interface{}{
+			"a.example.com",
+			map[string]interface{}{"name": "b", "ports": []interface{}{"80", "443"}},
+		},
+		"matrix": []interface{}{[]interface{}{"0", "1"}, []interface{}{"2"}},
+		"labels": map[string]interface{}{"0": "zero"},
+	}
+	rebuilt := Values{}
+	for path, value := range tree.Flatten() {
+		require.NoError(t, rebuilt.SetPath(path, value))
+	}
+	assert.Equal(t, tree, rebuilt)
+}
+
+func TestSetPath(t *testing.T) {
+	vals := Values{"hosts": []interface{}{"a", map[string]interface{}{"name": "b"}}}
+
+	require.NoError(t, vals.SetPath("image.tag", "v1"))
+	require.NoError(t, vals.SetPath("hosts[0]", "c"))
+	require.NoError(t, vals.SetPath("hosts[1].name", "d"))
+	require.NoError(t, vals.SetPath(`annotations["example.com/owner"]`, "team"))
+
+	assert.Equal(t, Values{
+		"image":       map[string]interface{}{"tag": "v1"},
+		"hosts":       []interface{}{"c", map[string]interface{}{"name": "d"}},
+		"annotations": map[string]interface{}{"example.com/owner": "team"},
+	}, vals)
+
+	// Indexes extend slices and create missing ones
+	require.NoError(t, vals.SetPath("hosts[3]", "e"))
+	require.NoError(t, vals.SetPath("ports[0].containerPort", 80))
+	assert.Equal(t, []interface{}{"c", map[string]interface{}{"name": "d"}, nil, "e"}, vals["hosts"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"containerPort": 80}}, vals["ports"])
+
+	assert.Error(t, vals.SetPath("hosts.name", "e"))
+	assert.Error(t, vals.SetPath("", "e"))
+}
+
+func TestInterpolateValues(t *testing.T) {
+	vals, err := ReadValues([]byte(`
+global:
+  domain: example.com
+  port: 443
+ingress:
+  host: app.${global.domain}
+  url: https://${ingress.host}:${global.port}/
+  port: ${global.port}
+hosts:
+  - ${global.domain}
+`))
+	require.NoError(t, err)
+
+	out, err := InterpolateValues(vals)
+	require.NoError(t, err)
+
+	assert.Equal(t, "app.example.com", out.Get("ingress.host", nil))
+	assert.Equal(t, "https://app.example.com:443/", out.Get("ingress.url", nil))
+	assert.Equal(t, json.Number("443"), out.Get("ingress.port", nil))
+	assert.Equal(t, "example.com", out.Get("hosts[0]", nil))
+
+	// The input is not modified
+	assert.Equal(t, "app.${global.domain}", vals.Get("ingress.host", nil))
+}
+
+func TestInterpolateValuesEscapes(t *testing.T) {
+	out, err := InterpolateValues(Values{
+		"name":     "app",
+		"literal":  "$${name}",
+		"embedded": "$${name}.${name}.example.com",
+		"dollar":   "$$$${name}",
+		"nested":   "${literal}",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "${name}", out.Get("literal", nil))
+	assert.Equal(t, "${name}.app.example.com", out.Get("embedded", nil))
+	assert.Equal(t, "$$${name}", out.Get("dollar", nil))
+	// Escapes are not resolved again when referenced
+	assert.Equal(t, "${name}", out.Get("nested", nil))
+}
+
+func TestInterpolateValuesNull(t *testing.T) {
+	out, err := InterpolateValues(Values{
+		"tag":   nil,
+		"value": "${tag}",
+		"image": "nginx:${tag}",
+	})
+	require.NoError(t, err)
+
+	v, ok := out["value"]
+	assert.True(t, ok)
+	assert.Nil(t, v)
+	assert.Equal(t, "nginx:", out.Get("image", nil))
+}
+
+func TestInterpolateValuesErrors(t *testing.T) {
+	_, err := InterpolateValues(Values{"host": "app.${global.domain}"})
+	assert.EqualError(t, err, "unresolvable value reference ${global.domain}")
+
+	_, err = InterpolateValues(Values{
+		"a": "${b}",
+		"b": "x-${c}",
+		"c": "${a}",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cyclic value reference")
+
+	// Tables and lists cannot be formatted into strings
+	_, err = InterpolateValues(Values{
+		"image": map[string]interface{}{"repository": "nginx"},
+		"ref":   "image: ${image}",
+	})
+	assert.EqualError(t, err, `value reference ${image} within "image: ${image}" is not a scalar`)
+
+	_, err = InterpolateValues(Values{
+		"hosts": []interface{}{"a", "b"},
+		"ref":   "hosts: ${hosts}",
+	})
+	assert.EqualError(t, err, `value reference ${hosts} within "hosts: ${hosts}" is not a scalar`)
+
+	// A table or list is kept as the whole value
+	out, err := InterpolateValues(Values{
+		"hosts": []interface{}{"a", "b"},
+		"ref":   "${hosts}",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"a", "b"}, out["ref"])
+}
+
+func TestSetNodePath(t *testing.T) {
+	node, err := ReadValuesNode([]byte(`# Default values
+image:
+  # The image repository
+  repository: nginx
+  tag: v1 # pinned
+hosts:
+  - a.example.com
+`))
+	require.NoError(t, err)
+
+	require.NoError(t, SetNodePath(node, "image.tag", "v2"))
+	require.NoError(t, SetNodePath(node, "hosts[0]", "b.example.com"))
+	require.NoError(t, SetNodePath(node, "resources.limits.cpu", 1))
+	assert.Error(t, SetNodePath(node, "hosts[1]", "c.example.com"))
+
+	out, err := EncodeNode(node)
+	require.NoError(t, err)
+	assert.Equal(t, `# Default values
+image:
+  # The image repository
+  repository: nginx
+  tag: v2 # pinned
+hosts:
+  - b.example.com
+resources:
+  limits:
+    cpu: 1
+`, string(out))
+
+	// The result reads back with the changed values
+	vals, err := ReadValues(out)
+	require.NoError(t, err)
+	assert.Equal(t, "v2", vals.Get("image.tag", nil))
+}
+
+func TestReadValuesAnchors(t *testing.T) {
+	vals, err := ReadValues([]byte(`
+defaults: &defaults
+  resources:
+    limits:
+      cpu: 100m
+  tags: [a, b]
+web: *defaults
+worker:
+  <<: *defaults
+  replicas: 2
+`))
+	require.NoError(t, err)
+
+	expected := map[string]interface{}{
+		"resources": map[string]interface{}{
+			"limits": map[string]interface{}{"cpu": "100m"},
+		},
+		"tags": []interface{}{"a", "b"},
+	}
+	assert.Equal(t, expected, vals.Get("web", nil))
+	assert.Equal(t, "100m", vals.Get("worker.resources.limits.cpu", nil))
+	assert.Equal(t, json.Number("2"), vals.Get("worker.replicas", nil))
+
+	// Every alias is an independent copy of the anchored value
+	require.NoError(t, vals.SetPath("web.resources.limits.cpu", "1"))
+	require.NoError(t, vals.SetPath("web.tags[0]", "c"))
+	assert.Equal(t, "100m", vals.Get("defaults.resources.limits.cpu", nil))
+	assert.Equal(t, "100m", vals.Get("worker.resources.limits.cpu", nil))
+	assert.Equal(t, "a", vals.Get("defaults.tags[0]", nil))
+	assert.Equal(t, "a", vals.Get("worker.tags[0]", nil))
+}
+
+func TestSetNodePathAlias(t *testing.T) {
+	node, err := ReadValuesNode([]byte(`defaults: &defaults
+  cpu: 100m
+web: *defaults
+`))
+	require.NoError(t, err)
+
+	require.NoError(t, SetNodePath(node, "web.cpu", "1"))
+
+	out, err := EncodeNode(node)
+	require.NoError(t, err)
+	assert.Equal(t, `defaults: &defaults
+  cpu: 100m
+web:
+  cpu: "1"
+`, string(out))
+}
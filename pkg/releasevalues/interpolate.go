@@ -0,0 +1,150 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package releasevalues
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// referenceRegex matches ${path} references, and $${path} escapes of them.
+var referenceRegex = regexp.MustCompile(`\$?\$\{([^}]+)\}`)
+
+// InterpolateValues returns a copy of v in which references of the form
+// ${path} within string values are replaced by the value at path (as
+// understood by ParsePath) in v. A string consisting of a single reference is
+// replaced by the referenced value itself, keeping its type; otherwise the
+// referenced value is formatted into the string, with null formatted as an
+// empty string. References may refer to values containing references
+// themselves. $${path} is an escape, replaced by a literal ${path}.
+//
+//	global:
+//	  domain: example.com
+//	host: app.${global.domain}
+//	template: $${name}.example.com
+//
+// An error is returned for references to missing values, for cyclic
+// references, and for references to tables or lists within a larger string.
+func InterpolateValues(v Values) (Values, error) {
+	i := interpolator{root: v}
+	out, err := i.interpolate(map[string]interface{}(v))
+	if err != nil {
+		return nil, err
+	}
+	return Values(out.(map[string]interface{})), nil
+}
+
+type interpolator struct {
+	root Values
+	// resolving is the chain of references being resolved
+	resolving []string
+}
+
+// interpolate returns a copy of val with all references resolved.
+func (i *interpolator) interpolate(val interface{}) (interface{}, error) {
+	switch vv := val.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(vv))
+		for k, e := range vv {
+			r, err := i.interpolate(e)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	case Values:
+		return i.interpolate(map[string]interface{}(vv))
+	case []interface{}:
+		out := make([]interface{}, len(vv))
+		for idx, e := range vv {
+			r, err := i.interpolate(e)
+			if err != nil {
+				return nil, err
+			}
+			out[idx] = r
+		}
+		return out, nil
+	case string:
+		return i.interpolateString(vv)
+	}
+	return val, nil
+}
+
+func (i *interpolator) interpolateString(s string) (interface{}, error) {
+	matches := referenceRegex.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s, nil
+	}
+
+	// A single reference keeps the type of the referenced value
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(s) && !isEscape(s, matches[0]) {
+		return i.resolve(s[matches[0][2]:matches[0][3]])
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		b.WriteString(s[last:m[0]])
+		last = m[1]
+		if isEscape(s, m) {
+			b.WriteString(s[m[0]+1 : m[1]])
+			continue
+		}
+		path := s[m[2]:m[3]]
+		r, err := i.resolve(path)
+		if err != nil {
+			return nil, err
+		}
+		switch r.(type) {
+		case nil:
+		case map[string]interface{}, Values, []interface{}:
+			return nil, fmt.Errorf("value reference ${%s} within %q is not a scalar", strings.TrimSpace(path), s)
+		default:
+			fmt.Fprint(&b, r)
+		}
+	}
+	b.WriteString(s[last:])
+	return b.String(), nil
+}
+
+// resolve returns the interpolated value at path.
+func (i *interpolator) resolve(path string) (interface{}, error) {
+	path = strings.TrimSpace(path)
+	for idx, p := range i.resolving {
+		if p == path {
+			chain := append(slices.Clone(i.resolving[idx:]), path)
+			return nil, fmt.Errorf("cyclic value reference: ${%s}", strings.Join(chain, "} -> ${"))
+		}
+	}
+
+	val, ok := i.root.lookup(path)
+	if !ok {
+		return nil, fmt.Errorf("unresolvable value reference ${%s}", path)
+	}
+
+	i.resolving = append(i.resolving, path)
+	defer func() { i.resolving = i.resolving[:len(i.resolving)-1] }()
+	return i.interpolate(val)
+}
+
+// isEscape reports whether the reference match m of s is a $${path} escape.
+func isEscape(s string, m []int) bool {
+	return strings.HasPrefix(s[m[0]:], "$$")
+}
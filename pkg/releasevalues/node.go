@@ -0,0 +1,151 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package releasevalues
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	goYaml "sigs.k8s.io/yaml/goyaml.v3"
+)
+
+// ReadValuesNode parses YAML data into a node tree which, unlike ReadValues,
+// keeps the comments and key order of the document, so that values can be
+// edited with SetNodePath and written back with EncodeNode without losing
+// them.
+func ReadValuesNode(data []byte) (*goYaml.Node, error) {
+	var node goYaml.Node
+	if err := goYaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	if node.Kind == 0 {
+		// Empty document
+		node = goYaml.Node{
+			Kind:    goYaml.DocumentNode,
+			Content: []*goYaml.Node{{Kind: goYaml.MappingNode, Tag: "!!map"}},
+		}
+	}
+	return &node, nil
+}
+
+// SetNodePath sets the value at path, as understood by ParsePath, in a node
+// tree read by ReadValuesNode, creating any missing tables along the way.
+// Numeric keys index into existing sequences. The comments of a replaced
+// value are kept. Aliases along the path are replaced by copies of the values
+// they refer to, so that setting a value never changes an anchored value.
+func SetNodePath(node *goYaml.Node, path string, value interface{}) error {
+	if path == "" {
+		return errors.New("YAML path cannot be empty")
+	}
+	if node.Kind == goYaml.DocumentNode {
+		if len(node.Content) == 0 {
+			node.Content = []*goYaml.Node{{Kind: goYaml.MappingNode, Tag: "!!map"}}
+		}
+		node = node.Content[0]
+	}
+
+	var replacement goYaml.Node
+	if err := replacement.Encode(value); err != nil {
+		return fmt.Errorf("cannot set %q: %w", path, err)
+	}
+
+	cur := node
+	keys := ParsePath(path)
+	for i, key := range keys {
+		last := i == len(keys)-1
+
+		var next *goYaml.Node
+		switch cur.Kind {
+		case goYaml.MappingNode:
+			for j := 0; j+1 < len(cur.Content); j += 2 {
+				if cur.Content[j].Value == key {
+					next = cur.Content[j+1]
+					break
+				}
+			}
+			if next == nil {
+				next = &goYaml.Node{}
+				cur.Content = append(cur.Content, &goYaml.Node{Kind: goYaml.ScalarNode, Tag: "!!str", Value: key}, next)
+			}
+		case goYaml.SequenceNode:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(cur.Content) {
+				return fmt.Errorf("cannot set %q: index %q out of range", path, key)
+			}
+			next = cur.Content[idx]
+		default:
+			return fmt.Errorf("cannot set %q: %q is not a table", path, key)
+		}
+
+		if next.Kind == goYaml.AliasNode {
+			// Setting through an alias would change the anchored value, and
+			// with it every other alias of it.
+			*next = *unaliasNode(next.Alias)
+		}
+
+		if !last && next.Kind != goYaml.MappingNode && next.Kind != goYaml.SequenceNode {
+			// Replace the scalar with a table, keeping its comments
+			*next = goYaml.Node{
+				Kind:        goYaml.MappingNode,
+				Tag:         "!!map",
+				HeadComment: next.HeadComment,
+				LineComment: next.LineComment,
+				FootComment: next.FootComment,
+			}
+		}
+		if last {
+			replacement.HeadComment = next.HeadComment
+			replacement.LineComment = next.LineComment
+			replacement.FootComment = next.FootComment
+			*next = replacement
+		}
+		cur = next
+	}
+	return nil
+}
+
+// unaliasNode returns a deep copy of a node tree, with its aliases replaced by
+// copies of the values they refer to.
+func unaliasNode(n *goYaml.Node) *goYaml.Node {
+	if n.Kind == goYaml.AliasNode {
+		return unaliasNode(n.Alias)
+	}
+	c := *n
+	c.Anchor = ""
+	c.Content = make([]*goYaml.Node, len(n.Content))
+	for i, child := range n.Content {
+		c.Content[i] = unaliasNode(child)
+	}
+	return &c
+}
+
+// EncodeNode writes a node tree read by ReadValuesNode back to YAML, with its
+// comments.
+func EncodeNode(node *goYaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := goYaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -16,8 +16,128 @@ limitations under the License.
 
 package releasevalues
 
-import "strings"
+import (
+	"strconv"
+	"strings"
+)
 
-func ParsePath(key string) []string { return strings.Split(key, ".") }
+// ParsePath splits a dotted path into its keys:
+//
+//	image.tag
+//
+// Keys containing dots may be quoted within brackets, and list elements may be
+// addressed by index:
+//
+//	podAnnotations["example.com/owner"]
+//	containers[0].image
+func ParsePath(key string) []string {
+	keys := parsePathKeys(key)
+	path := make([]string, len(keys))
+	for i, k := range keys {
+		path[i] = k.name
+	}
+	return path
+}
 
-func JoinPath(path ...string) string { return strings.Join(path, ".") }
+// pathKey is a key of a path, noting whether it is a bare bracketed index
+// (hosts[0]) rather than a map key (hosts.0 or hosts["0"]).
+type pathKey struct {
+	name  string
+	index bool
+}
+
+// parsePathKeys splits a path as ParsePath does.
+func parsePathKeys(key string) []pathKey {
+	var path []pathKey
+	var cur strings.Builder
+	// closed is set after a bracketed key, whose terminating dot (if any)
+	// must not add an empty key
+	closed := false
+
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; c {
+		case '.':
+			if !closed {
+				path = append(path, pathKey{name: cur.String()})
+			}
+			cur.Reset()
+			closed = false
+		case '[':
+			end, k, quoted, ok := parseBracket(key[i:])
+			if !ok {
+				cur.WriteByte(c)
+				continue
+			}
+			if cur.Len() > 0 || (!closed && i > 0 && key[i-1] != '.') {
+				path = append(path, pathKey{name: cur.String()})
+			}
+			cur.Reset()
+			path = append(path, pathKey{name: k, index: !quoted})
+			closed = true
+			i += end
+		default:
+			if closed {
+				// Text directly following a bracket continues a new key.
+				closed = false
+			}
+			cur.WriteByte(c)
+		}
+	}
+	if !closed {
+		path = append(path, pathKey{name: cur.String()})
+	}
+	return path
+}
+
+// parseBracket parses a bracketed key at the start of s, either quoted
+// (["a.b"]) or bare ([0]). It returns the index of the closing bracket, the
+// key and whether it was quoted.
+func parseBracket(s string) (int, string, bool, bool) {
+	if strings.HasPrefix(s, `["`) {
+		end := strings.Index(s[2:], `"]`)
+		if end < 0 {
+			return 0, "", false, false
+		}
+		return end + 3, s[2 : end+2], true, true
+	}
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return 0, "", false, false
+	}
+	return end, s[1:end], false, true
+}
+
+// JoinPath joins keys into a path which ParsePath splits back into the same
+// keys. Keys containing dots or brackets are quoted within brackets.
+func JoinPath(path ...string) string {
+	var b strings.Builder
+	for i, k := range path {
+		if strings.ContainsAny(k, ".[]") {
+			b.WriteString(`["`)
+			b.WriteString(k)
+			b.WriteString(`"]`)
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(k)
+	}
+	return b.String()
+}
+
+// joinKey appends a map key to a path, where an empty path is the root.
+func joinKey(path string, key string) string {
+	if path == "" {
+		return JoinPath(key)
+	}
+	if strings.ContainsAny(key, ".[]") {
+		return path + JoinPath(key)
+	}
+	return path + "." + key
+}
+
+// joinIndex appends a slice index to a path.
+func joinIndex(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
@@ -0,0 +1,45 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package releasevalues
+
+import (
+	"fmt"
+
+	"helm.sh/helm/v4/pkg/strvals"
+)
+
+// ParseSet parses Helm `--set` style assignments into a Values tree.
+//
+// Each assignment follows the rules of `helm install --set`:
+//
+//	image.tag=v2                  nested keys
+//	args[0]=--verbose             list indices
+//	resources=null                explicit null
+//	hosts=a\,b                    escaped separators (also `\.` and `\=`)
+//
+// Values are typed: booleans, integers and null are inferred, anything else is
+// a string. Later assignments override earlier ones. The result is intended to
+// be merged onto base values with Values.Merge.
+func ParseSet(assignments []string) (Values, error) {
+	vals := map[string]interface{}{}
+	for _, a := range assignments {
+		if err := strvals.ParseInto(a, vals); err != nil {
+			return nil, fmt.Errorf("failed parsing set value %q: %w", a, err)
+		}
+	}
+	return vals, nil
+}
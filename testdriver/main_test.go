@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,11 +19,21 @@ import (
 	chart "helm.sh/helm/v4/pkg/chart/v2"
 	chartloader "helm.sh/helm/v4/pkg/chart/v2/loader"
 	chartutil "helm.sh/helm/v4/pkg/chart/v2/util"
+	"sigs.k8s.io/yaml"
 )
 
 type RendererPluginInput struct {
-	Chart      *chart.Chart `json:"chart"`
-	ValuesJSON []byte       `json:"values"`
+	Chart          *chart.Chart `json:"chart"`
+	ChartArchive   []byte       `json:"chartArchive,omitempty"`
+	ValuesJSON     []byte       `json:"values"`
+	ValuesPath     string       `json:"valuesPath,omitempty"`
+	ComputedValues []byte       `json:"computedValues,omitempty"`
+	SingleStream   bool         `json:"singleStream,omitempty"`
+	WrapInList     bool         `json:"wrapInList,omitempty"`
+	PartialResults bool         `json:"partialResults,omitempty"`
+	LogFormat      string       `json:"logFormat,omitempty"`
+	GroupByChart   bool         `json:"groupByChart,omitempty"`
+	HooksByPhase   bool         `json:"hooksByPhase,omitempty"`
 }
 
 type RendererPluginOutputManifest struct {
@@ -28,8 +41,37 @@ type RendererPluginOutputManifest struct {
 	Manifest []byte `json:"manifest"`
 }
 
+type RendererPluginOutputError struct {
+	Filename string `json:"filename"`
+	Error    string `json:"error"`
+}
+
+type RendererPluginOutputMetadata struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	AppVersion string `json:"appVersion"`
+	Digest     string `json:"digest"`
+}
+
+type RendererPluginOutputAPIVersion struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+}
+
 type RendererPluginOutput struct {
 	Manifests []RendererPluginOutputManifest `json:"manifests"`
+	Stream    string                         `json:"stream"`
+	Warnings  []string                       `json:"warnings"`
+	Errors    []RendererPluginOutputError    `json:"errors"`
+	Metadata  RendererPluginOutputMetadata   `json:"metadata"`
+
+	ChartGroups map[string][]RendererPluginOutputManifest `json:"chartGroups"`
+	Hooks       map[string][]RendererPluginOutputManifest `json:"hooks"`
+
+	RenderedBytes     int `json:"renderedBytes"`
+	PeakTemplateBytes int `json:"peakTemplateBytes"`
+
+	APIVersions []RendererPluginOutputAPIVersion `json:"apiVersions"`
 }
 
 type testChart struct {
@@ -109,6 +151,12 @@ func init() {
 }
 
 func loadFilePlugin(ctx context.Context, pluginPath string) (*extism.Plugin, error) {
+	return loadFilePluginWithPaths(ctx, pluginPath, map[string]string{})
+}
+
+// loadFilePluginWithPaths loads the plugin with access to the host paths of
+// allowedPaths, mapped to their plugin paths.
+func loadFilePluginWithPaths(ctx context.Context, pluginPath string, allowedPaths map[string]string) (*extism.Plugin, error) {
 	//pluginBytes, err := os.ReadFile(plugnPath)
 	//require.Nil(t, err)
 
@@ -130,7 +178,7 @@ func loadFilePlugin(ctx context.Context, pluginPath string) (*extism.Plugin, err
 		},
 		Config: map[string]string{},
 		//AllowedHosts: []string{"ghcr.io"},
-		AllowedPaths: map[string]string{},
+		AllowedPaths: allowedPaths,
 		Timeout:      0,
 	}
 
@@ -192,6 +240,91 @@ func loadFilePlugin(ctx context.Context, pluginPath string) (*extism.Plugin, err
 				api.ValueTypeI64,
 			},
 		),
+		extism.NewHostFunctionWithStack(
+			"resolve_secret",
+			func(ctx context.Context, plugin *extism.CurrentPlugin, stack []uint64) {
+				ref, _ := plugin.ReadString(stack[0])
+				_ = plugin.Free(stack[0])
+
+				fmt.Printf("received unimplemented secret resolution: %q\n", ref)
+
+				type resolveSecretResult struct {
+					Error  *string `json:"error,omitempty"`
+					Result string  `json:"result"`
+				}
+
+				result := resolveSecretResult{}
+				resultData, _ := json.Marshal(&result)
+
+				resultBytes, _ := plugin.WriteBytes(resultData)
+				stack[0] = resultBytes
+			},
+			[]api.ValueType{
+				api.ValueTypeI64, // ref
+			},
+			[]api.ValueType{
+				api.ValueTypeI64,
+			},
+		),
+		extism.NewHostFunctionWithStack(
+			"resolve_image_digest",
+			func(ctx context.Context, plugin *extism.CurrentPlugin, stack []uint64) {
+				ref, _ := plugin.ReadString(stack[0])
+				_ = plugin.Free(stack[0])
+
+				fmt.Printf("received unimplemented image digest resolution: %q\n", ref)
+
+				type resolveImageDigestResult struct {
+					Error  *string `json:"error,omitempty"`
+					Result string  `json:"result"`
+				}
+
+				result := resolveImageDigestResult{Result: ref}
+				resultData, _ := json.Marshal(&result)
+
+				resultBytes, _ := plugin.WriteBytes(resultData)
+				stack[0] = resultBytes
+			},
+			[]api.ValueType{
+				api.ValueTypeI64, // ref
+			},
+			[]api.ValueType{
+				api.ValueTypeI64,
+			},
+		),
+		extism.NewHostFunctionWithStack(
+			"fetch_chart_dependency",
+			func(ctx context.Context, plugin *extism.CurrentPlugin, stack []uint64) {
+				name, _ := plugin.ReadString(stack[0])
+				_ = plugin.Free(stack[0])
+				version, _ := plugin.ReadString(stack[1])
+				_ = plugin.Free(stack[1])
+				repository, _ := plugin.ReadString(stack[2])
+				_ = plugin.Free(stack[2])
+
+				fmt.Printf("received unimplemented chart dependency fetch: %q %q %q\n", name, version, repository)
+
+				type fetchChartDependencyResult struct {
+					Error  *string `json:"error,omitempty"`
+					Result []byte  `json:"result"`
+				}
+
+				errMsg := "not implemented"
+				result := fetchChartDependencyResult{Error: &errMsg}
+				resultData, _ := json.Marshal(&result)
+
+				resultBytes, _ := plugin.WriteBytes(resultData)
+				stack[0] = resultBytes
+			},
+			[]api.ValueType{
+				api.ValueTypeI64, // name
+				api.ValueTypeI64, // version
+				api.ValueTypeI64, // repository
+			},
+			[]api.ValueType{
+				api.ValueTypeI64,
+			},
+		),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize plugin: %w", err)
@@ -222,6 +355,563 @@ func TestRenderChart(t *testing.T) {
 	//assert.Fail(t, "fail", "time taken: %s", end.Sub(start))
 }
 
+func TestRenderChartSingleStream(t *testing.T) {
+
+	ctx := context.Background()
+
+	pluginPath := "../gotemplate-renderer.wasm"
+	plugin, err := loadFilePlugin(ctx, pluginPath)
+	require.Nil(t, err)
+
+	testChart := testCharts["simple"]
+
+	input, err := makePluginInput(testChart.Chart, testChart.TestValues)
+	require.Nil(t, err)
+	input.SingleStream = true
+
+	output, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+
+	assert.Empty(t, output.Manifests)
+
+	// Resources are ordered by kind in install order, followed by hooks
+	sources := regexp.MustCompile(`(?m)^# Source: (.*)$`).FindAllStringSubmatch(output.Stream, -1)
+	sourceFiles := []string{}
+	for _, s := range sources {
+		sourceFiles = append(sourceFiles, s[1])
+	}
+	assert.Equal(t, []string{
+		"testchart/templates/serviceaccount.yaml",
+		"testchart/templates/service.yaml",
+		"testchart/templates/deployment.yaml",
+		"testchart/templates/tests/test-connection.yaml",
+	}, sourceFiles)
+
+	assert.True(t, strings.HasPrefix(output.Stream, "---\n# Source: testchart/templates/serviceaccount.yaml\napiVersion: v1\nkind: ServiceAccount\n"))
+	assert.Equal(t, 4, strings.Count(output.Stream, "---\n"))
+}
+
+func TestRenderChartWrapInList(t *testing.T) {
+
+	ctx := context.Background()
+
+	pluginPath := "../gotemplate-renderer.wasm"
+	plugin, err := loadFilePlugin(ctx, pluginPath)
+	require.Nil(t, err)
+
+	testChart := testCharts["simple"]
+
+	input, err := makePluginInput(testChart.Chart, testChart.TestValues)
+	require.Nil(t, err)
+	input.WrapInList = true
+
+	output, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+
+	assert.Empty(t, output.Manifests)
+
+	var list struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Items      []struct {
+			Kind     string `json:"kind"`
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	require.Nil(t, yaml.Unmarshal([]byte(output.Stream), &list))
+	assert.Equal(t, "v1", list.APIVersion)
+	assert.Equal(t, "List", list.Kind)
+
+	// Resources are ordered by kind in install order, followed by hooks
+	kinds := []string{}
+	for _, item := range list.Items {
+		kinds = append(kinds, item.Kind)
+		assert.NotEmpty(t, item.Metadata.Name)
+	}
+	assert.Equal(t, []string{"ServiceAccount", "Service", "Deployment", "Pod"}, kinds)
+
+	input.SingleStream = true
+	_, err = callPlugin(plugin, input)
+	assert.ErrorContains(t, err, "wrapInList cannot be combined with singleStream")
+}
+
+func TestRenderChartComputedValues(t *testing.T) {
+
+	ctx := context.Background()
+
+	pluginPath := "../gotemplate-renderer.wasm"
+	plugin, err := loadFilePlugin(ctx, pluginPath)
+	require.Nil(t, err)
+
+	chrt := &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV2,
+			Name:       "computed",
+			Version:    "0.1.0",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/secret.yaml", Data: []byte("token: {{ .Values.token }}\nlimit: {{ .Values.limit }}")},
+		},
+	}
+
+	input, err := makePluginInput(chrt, chartutil.Values{"token": "static", "limit": 1})
+	require.Nil(t, err)
+	// Numbers are decoded like those of the values, so large integers are
+	// not formatted as floats (1e+06)
+	input.ComputedValues = []byte(`{"Values": {"token": "dynamic", "limit": 1000000}}`)
+
+	output, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+
+	require.Len(t, output.Manifests, 1)
+	assert.Equal(t, "token: dynamic\nlimit: 1000000", string(output.Manifests[0].Manifest))
+}
+
+func TestRenderChartArchive(t *testing.T) {
+
+	ctx := context.Background()
+
+	pluginPath := "../gotemplate-renderer.wasm"
+	plugin, err := loadFilePlugin(ctx, pluginPath)
+	require.Nil(t, err)
+
+	testChart := testCharts["simple"]
+
+	archivePath, err := chartutil.Save(testChart.Chart, t.TempDir())
+	require.Nil(t, err)
+	archive, err := os.ReadFile(archivePath)
+	require.Nil(t, err)
+
+	input, err := makePluginInput(testChart.Chart, testChart.TestValues)
+	require.Nil(t, err)
+	input.Chart = nil
+	input.ChartArchive = archive
+
+	output, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+
+	filenames := []string{}
+	for _, m := range output.Manifests {
+		filenames = append(filenames, m.Filename)
+	}
+	assert.Contains(t, filenames, "testchart/templates/deployment.yaml")
+
+	// Providing both the chart and its archive is rejected
+	input.Chart = testChart.Chart
+	_, err = callPlugin(plugin, input)
+	assert.NotNil(t, err)
+
+	t.Run("gitlab", func(t *testing.T) {
+		// A fresh plugin, so that the memory of the renders above does not
+		// count towards its limit
+		plugin, err := loadFilePlugin(ctx, pluginPath)
+		require.Nil(t, err)
+
+		archive, err := os.ReadFile("testdata/gitlab-8.9.2.tgz")
+		require.Nil(t, err)
+
+		testChart := testCharts["gitlab"]
+		input, err := makePluginInput(testChart.Chart, testChart.TestValues)
+		require.Nil(t, err)
+		input.Chart = nil
+		input.ChartArchive = archive
+
+		output, err := callPlugin(plugin, input)
+		require.Nil(t, err)
+		assert.NotEmpty(t, output.Manifests)
+	})
+}
+
+func TestRenderChartPartialResults(t *testing.T) {
+
+	ctx := context.Background()
+
+	pluginPath := "../gotemplate-renderer.wasm"
+	plugin, err := loadFilePlugin(ctx, pluginPath)
+	require.Nil(t, err)
+
+	chrt := &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV2,
+			Name:       "partial",
+			Version:    "0.1.0",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/good.yaml", Data: []byte("good: {{ .Values.good }}")},
+			{Name: "templates/bad.yaml", Data: []byte(`{{ fail "broken" }}`)},
+		},
+	}
+
+	input, err := makePluginInput(chrt, chartutil.Values{"good": "yes"})
+	require.Nil(t, err)
+
+	// Without partial results the render fails
+	_, err = callPlugin(plugin, input)
+	assert.NotNil(t, err)
+
+	input.PartialResults = true
+	output, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+
+	require.Len(t, output.Manifests, 1)
+	assert.Equal(t, "partial/templates/good.yaml", output.Manifests[0].Filename)
+	assert.Equal(t, "good: yes", string(output.Manifests[0].Manifest))
+
+	require.Len(t, output.Errors, 1)
+	assert.Equal(t, "partial/templates/bad.yaml", output.Errors[0].Filename)
+	assert.Contains(t, output.Errors[0].Error, "broken")
+}
+
+func TestRenderChartMetadata(t *testing.T) {
+
+	ctx := context.Background()
+
+	pluginPath := "../gotemplate-renderer.wasm"
+	plugin, err := loadFilePlugin(ctx, pluginPath)
+	require.Nil(t, err)
+
+	testChart := testCharts["simple"]
+
+	input, err := makePluginInput(testChart.Chart, testChart.TestValues)
+	require.Nil(t, err)
+
+	first, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+	second, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+
+	assert.Equal(t, "testchart", first.Metadata.Name)
+	assert.Equal(t, "0.1.0", first.Metadata.Version)
+	assert.Equal(t, "1.16.0", first.Metadata.AppVersion)
+	assert.Regexp(t, "^[0-9a-f]{64}$", first.Metadata.Digest)
+	assert.Equal(t, first.Metadata, second.Metadata)
+
+	// Different manifests have a different digest
+	input, err = makePluginInput(testChart.Chart, chartutil.Values{"replicaCount": 5})
+	require.Nil(t, err)
+	third, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+	assert.NotEqual(t, first.Metadata.Digest, third.Metadata.Digest)
+}
+
+func TestRenderChartManifestOrder(t *testing.T) {
+
+	ctx := context.Background()
+
+	pluginPath := "../gotemplate-renderer.wasm"
+	plugin, err := loadFilePlugin(ctx, pluginPath)
+	require.Nil(t, err)
+
+	testChart := testCharts["simple"]
+
+	input, err := makePluginInput(testChart.Chart, testChart.TestValues)
+	require.Nil(t, err)
+
+	first, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+	second, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+
+	require.Greater(t, len(first.Manifests), 1)
+	assert.Equal(t, first.Manifests, second.Manifests)
+	assert.IsIncreasing(t, manifestFilenames(first.Manifests))
+}
+
+func TestRenderChartJSONLogs(t *testing.T) {
+
+	ctx := context.Background()
+
+	pluginPath := "../gotemplate-renderer.wasm"
+	plugin, err := loadFilePlugin(ctx, pluginPath)
+	require.Nil(t, err)
+
+	var logs []string
+	plugin.SetLogger(func(_ extism.LogLevel, s string) {
+		logs = append(logs, s)
+	})
+
+	testChart := testCharts["simple"]
+
+	input, err := makePluginInput(testChart.Chart, testChart.TestValues)
+	require.Nil(t, err)
+	input.LogFormat = "json"
+
+	_, err = callPlugin(plugin, input)
+	require.Nil(t, err)
+
+	entries := jsonLogEntries(t, logs)
+	require.Len(t, entries, 3, logs)
+	assert.Equal(t, "debug", entries[0]["level"])
+	assert.Equal(t, "running gotemplate-renderer plugin", entries[0]["message"])
+
+	assert.Equal(t, "info", entries[1]["level"])
+	assert.Equal(t, "rendered chart", entries[1]["message"])
+	assert.Equal(t, "testchart", entries[1]["chart"])
+	assert.NotEmpty(t, entries[1]["duration"])
+
+	// Followed by a summary of the render
+	assert.Equal(t, "info", entries[2]["level"])
+	assert.Regexp(t, `^parsed \d+ templates, rendered \d+ \(\d+ empty\), skipped \d+ in `, entries[2]["message"])
+	assert.Equal(t, "testchart", entries[2]["chart"])
+
+	// Errors are logged as JSON only
+	logs = nil
+	input.SingleStream = true
+	input.GroupByChart = true
+	_, err = callPlugin(plugin, input)
+	require.NotNil(t, err)
+
+	entries = jsonLogEntries(t, logs)
+	require.Len(t, entries, 2, logs)
+	assert.Equal(t, "error", entries[1]["level"])
+	assert.Equal(t, "failed", entries[1]["message"])
+	assert.Equal(t, "groupByChart cannot be combined with singleStream", entries[1]["error"])
+	assert.Equal(t, "testchart", entries[1]["chart"])
+	assert.NotContains(t, logs, "groupByChart cannot be combined with singleStream")
+}
+
+// jsonLogEntries parses the JSON log messages of the plugin, skipping those of
+// the extism runtime.
+func jsonLogEntries(t *testing.T, logs []string) []map[string]string {
+	t.Helper()
+
+	var entries []map[string]string
+	for _, line := range logs {
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var entry map[string]string
+		require.Nil(t, json.Unmarshal([]byte(line), &entry), line)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestRenderChartGroupByChart(t *testing.T) {
+
+	ctx := context.Background()
+
+	pluginPath := "../gotemplate-renderer.wasm"
+	plugin, err := loadFilePlugin(ctx, pluginPath)
+	require.Nil(t, err)
+
+	sub, err := chartloader.LoadDir("testdata/simple_chart")
+	require.Nil(t, err)
+
+	umbrella := &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV2,
+			Name:       "umbrella",
+			Version:    "0.1.0",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/configmap.yaml", Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: umbrella\n")},
+		},
+	}
+	umbrella.AddDependency(sub)
+
+	// Dependencies are not serialized with the chart, so pass an archive
+	archivePath, err := chartutil.Save(umbrella, t.TempDir())
+	require.Nil(t, err)
+	archive, err := os.ReadFile(archivePath)
+	require.Nil(t, err)
+
+	input, err := makePluginInput(umbrella, map[string]any{})
+	require.Nil(t, err)
+	input.Chart = nil
+	input.ChartArchive = archive
+	input.GroupByChart = true
+
+	output, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+
+	require.Len(t, output.ChartGroups, 2)
+	assert.Equal(t, []string{"umbrella/templates/configmap.yaml"}, manifestFilenames(output.ChartGroups["umbrella"]))
+	assert.Contains(t, manifestFilenames(output.ChartGroups["umbrella/charts/testchart"]), "umbrella/charts/testchart/templates/deployment.yaml")
+	assert.Len(t, output.Manifests, len(output.ChartGroups["umbrella"])+len(output.ChartGroups["umbrella/charts/testchart"]))
+}
+
+func TestRenderChartHooksByPhase(t *testing.T) {
+
+	ctx := context.Background()
+
+	pluginPath := "../gotemplate-renderer.wasm"
+	plugin, err := loadFilePlugin(ctx, pluginPath)
+	require.Nil(t, err)
+
+	hook := func(name, phases, weight string) string {
+		return fmt.Sprintf(`apiVersion: batch/v1
+kind: Job
+metadata:
+  name: %s
+  annotations:
+    "helm.sh/hook": %s
+    "helm.sh/hook-weight": "%s"
+`, name, phases, weight)
+	}
+	chrt := &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV2,
+			Name:       "hooks",
+			Version:    "0.1.0",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/configmap.yaml", Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config\n")},
+			{Name: "templates/migrate.yaml", Data: []byte(hook("migrate", "pre-install,pre-upgrade", "5"))},
+			{Name: "templates/backup.yaml", Data: []byte(hook("backup", "pre-upgrade", "-1"))},
+		},
+	}
+
+	input, err := makePluginInput(chrt, map[string]any{})
+	require.Nil(t, err)
+	input.HooksByPhase = true
+
+	output, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+
+	require.Len(t, output.Hooks, 2)
+	assert.Equal(t, []string{"hooks/templates/migrate.yaml"}, manifestFilenames(output.Hooks["pre-install"]))
+	assert.Equal(t, []string{"hooks/templates/backup.yaml", "hooks/templates/migrate.yaml"}, manifestFilenames(output.Hooks["pre-upgrade"]))
+	assert.Contains(t, string(output.Hooks["pre-upgrade"][0].Manifest), "name: backup")
+	assert.Len(t, output.Manifests, 3)
+
+	input.SingleStream = true
+	_, err = callPlugin(plugin, input)
+	assert.ErrorContains(t, err, "hooksByPhase cannot be combined with singleStream")
+}
+
+func TestRenderChartRenderedBytes(t *testing.T) {
+
+	ctx := context.Background()
+
+	pluginPath := "../gotemplate-renderer.wasm"
+	plugin, err := loadFilePlugin(ctx, pluginPath)
+	require.Nil(t, err)
+
+	for _, chartName := range []string{"simple", "gitlab"} {
+		t.Run(chartName, func(t *testing.T) {
+			testChart := testCharts[chartName]
+
+			input, err := makePluginInput(testChart.Chart, testChart.TestValues)
+			require.Nil(t, err)
+
+			output, err := callPlugin(plugin, input)
+			require.Nil(t, err)
+
+			total, largest := 0, 0
+			for _, m := range output.Manifests {
+				total += len(m.Manifest)
+				largest = max(largest, len(m.Manifest))
+			}
+
+			// The reported sizes also cover output that is not returned as a
+			// manifest, e.g. the whitespace of partials and disabled
+			// templates, so are proportional rather than equal.
+			assert.GreaterOrEqual(t, output.RenderedBytes, total)
+			assert.LessOrEqual(t, output.RenderedBytes, 2*total)
+			assert.GreaterOrEqual(t, output.PeakTemplateBytes, largest)
+			assert.LessOrEqual(t, output.PeakTemplateBytes, output.RenderedBytes)
+		})
+	}
+}
+
+func TestRenderChartAPIVersions(t *testing.T) {
+
+	ctx := context.Background()
+
+	pluginPath := "../gotemplate-renderer.wasm"
+	plugin, err := loadFilePlugin(ctx, pluginPath)
+	require.Nil(t, err)
+
+	testChart := testCharts["simple"]
+
+	input, err := makePluginInput(testChart.Chart, testChart.TestValues)
+	require.Nil(t, err)
+
+	output, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+
+	assert.Equal(t, []RendererPluginOutputAPIVersion{
+		{APIVersion: "apps/v1", Kind: "Deployment"},
+		{APIVersion: "v1", Kind: "Pod"},
+		{APIVersion: "v1", Kind: "Service"},
+		{APIVersion: "v1", Kind: "ServiceAccount"},
+	}, output.APIVersions)
+}
+
+func TestRenderChartValuesPath(t *testing.T) {
+
+	ctx := context.Background()
+
+	valuesDir := t.TempDir()
+
+	pluginPath := "../gotemplate-renderer.wasm"
+	plugin, err := loadFilePluginWithPaths(ctx, pluginPath, map[string]string{valuesDir: "/values"})
+	require.Nil(t, err)
+
+	testChart := testCharts["simple"]
+
+	input, err := makePluginInput(testChart.Chart, testChart.TestValues)
+	require.Nil(t, err)
+
+	expected, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+
+	valuesYAML, err := yaml.JSONToYAML(input.ValuesJSON)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(filepath.Join(valuesDir, "values.yaml"), valuesYAML, 0o644))
+
+	input.ValuesPath = "/values/values.yaml"
+	_, err = callPlugin(plugin, input)
+	assert.ErrorContains(t, err, "only one of values or valuesPath may be provided")
+
+	input.ValuesJSON = nil
+	output, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+	assert.Equal(t, expected.Manifests, output.Manifests)
+
+	input.ValuesPath = "/values/missing.yaml"
+	_, err = callPlugin(plugin, input)
+	assert.ErrorContains(t, err, `failed to read values file "/values/missing.yaml"`)
+
+	// Numbers are decoded the same from values and a values file
+	chrt := &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV2,
+			Name:       "numbers",
+			Version:    "0.1.0",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/cm.yaml", Data: []byte("replicas: {{ .Values.replicas }}")},
+		},
+	}
+	input, err = makePluginInput(chrt, chartutil.Values{"replicas": 1234567})
+	require.Nil(t, err)
+	output, err = callPlugin(plugin, input)
+	require.Nil(t, err)
+	require.Len(t, output.Manifests, 1)
+	assert.Equal(t, "replicas: 1234567", string(output.Manifests[0].Manifest))
+
+	valuesYAML, err = yaml.JSONToYAML(input.ValuesJSON)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(filepath.Join(valuesDir, "numbers.yaml"), valuesYAML, 0o644))
+	input.ValuesJSON = nil
+	input.ValuesPath = "/values/numbers.yaml"
+	fromPath, err := callPlugin(plugin, input)
+	require.Nil(t, err)
+	assert.Equal(t, output.Manifests, fromPath.Manifests)
+}
+
+func manifestFilenames(manifests []RendererPluginOutputManifest) []string {
+	filenames := make([]string, 0, len(manifests))
+	for _, m := range manifests {
+		filenames = append(filenames, m.Filename)
+	}
+	return filenames
+}
+
 func BenchmarkRenderChart_SimpleChart(b *testing.B) {
 
 	ctx := context.Background()
@@ -266,41 +956,55 @@ func BenchmarkRenderChart_GitlabChart(b *testing.B) {
 
 func renderChart(plugin *extism.Plugin, chrt *chart.Chart, testValues map[string]any) error {
 
-	renderValues, err := makeRenderValues(chrt, testValues)
+	input, err := makePluginInput(chrt, testValues)
 	if err != nil {
 		return err
 	}
 
+	_, err = callPlugin(plugin, input)
+	return err
+	//fmt.Printf("output: %+v\n", output)
+	//assert.Fail(t, "forced failure")
+}
+
+func makePluginInput(chrt *chart.Chart, testValues map[string]any) (*RendererPluginInput, error) {
+
+	renderValues, err := makeRenderValues(chrt, testValues)
+	if err != nil {
+		return nil, err
+	}
+
 	renderValuesJSON, err := json.Marshal(renderValues)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	input := RendererPluginInput{
+	return &RendererPluginInput{
 		Chart:      chrt,
 		ValuesJSON: renderValuesJSON,
-	}
+	}, nil
+}
+
+func callPlugin(plugin *extism.Plugin, input *RendererPluginInput) (*RendererPluginOutput, error) {
 
 	inputData, err := json.Marshal(input)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	exitCode, outputData, err := plugin.Call("helm_chart_renderer", inputData)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if exitCode != 0 {
-		return fmt.Errorf("plugin failed: exit code = %d", exitCode)
+		return nil, fmt.Errorf("plugin failed: exit code = %d", exitCode)
 	}
 
 	output := RendererPluginOutput{}
 	if err := json.Unmarshal(outputData, &output); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
-	//fmt.Printf("output: %+v\n", output)
-	//assert.Fail(t, "forced failure")
+	return &output, nil
 }